@@ -5,9 +5,14 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"log/slog"
 	"net"
+	"net/http"
+	"os"
+	"time"
 
 	"github.com/Dyastin-0/tcprp/core"
+	"github.com/Dyastin-0/tcprp/core/admin"
 	"github.com/Dyastin-0/tcprp/core/proxy"
 	"github.com/caddyserver/certmagic"
 	"github.com/common-nighthawk/go-figure"
@@ -15,6 +20,9 @@ import (
 	"github.com/urfave/cli/v3"
 )
 
+// shutdownTimeout bounds closing the open connections when the server stops.
+const shutdownTimeout = 10 * time.Second
+
 func New() *cli.Command {
 	return &cli.Command{
 		Name:    "tcprp",
@@ -63,6 +71,19 @@ func startCommand() *cli.Command {
 				Aliases: []string{"a"},
 				Value:   ":443",
 			},
+			&cli.StringFlag{
+				Name:  "admin",
+				Usage: "address of the admin api, on loopback if it has no host, disabled if empty",
+			},
+			&cli.StringFlag{
+				Name:    "admin-token",
+				Usage:   "bearer token required by the admin api, and to serve it on other than loopback",
+				Sources: cli.EnvVars("TCPRP_ADMIN_TOKEN"),
+			},
+			&cli.StringFlag{
+				Name:  "access-log",
+				Usage: "file the json access log is appended to, - for stdout, disabled if empty",
+			},
 		},
 		Action: startAction,
 	}
@@ -73,12 +94,37 @@ func startAction(ctx context.Context, cmd *cli.Command) error {
 	api := cmd.String("api")
 	email := cmd.String("email")
 	addr := cmd.String("addr")
+	adminAddr := cmd.String("admin")
+	adminToken := cmd.String("admin-token")
+	accessLogPath := cmd.String("access-log")
+
+	if adminAddr != "" {
+		var err error
+		adminAddr, err = admin.ListenAddr(adminAddr, adminToken)
+		if err != nil {
+			return err
+		}
+	}
 
 	proxy := proxy.New()
 	err := proxy.Config.Load(configPath)
 	if err != nil {
 		return err
 	}
+	defer proxy.Config.Close()
+
+	switch accessLogPath {
+	case "":
+	case "-":
+		proxy.AccessLog = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	default:
+		accessLog, err := os.OpenFile(accessLogPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+		if err != nil {
+			return err
+		}
+		defer accessLog.Close()
+		proxy.AccessLog = slog.New(slog.NewJSONHandler(accessLog, nil))
+	}
 
 	provider := &cloudflare.Provider{
 		APIToken: api,
@@ -112,19 +158,50 @@ func startAction(ctx context.Context, cmd *cli.Command) error {
 		return err
 	}
 
+	// adminErr receives the error the admin api stopped with, which stops the server too.
+	adminErr := make(chan error, 1)
+	if adminAddr != "" {
+		adminLn, err := net.Listen("tcp", adminAddr)
+		if err != nil {
+			ln.Close()
+			return fmt.Errorf("admin api: %w", err)
+		}
+
+		adminServer := &http.Server{Handler: admin.New(proxy, adminToken)}
+		defer adminServer.Close()
+
+		go func() {
+			if err := adminServer.Serve(adminLn); !errors.Is(err, http.ErrServerClosed) {
+				adminErr <- fmt.Errorf("admin api: %w", err)
+				ln.Close()
+			}
+		}()
+	}
+
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+
 	for {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		default:
-			conn, err := ln.Accept()
-			if err != nil {
-				if errors.Is(err, net.ErrClosed) {
-					return nil
-				}
-				continue
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				break
 			}
-			go proxy.Handler(conn)
+			continue
 		}
+		go proxy.Handler(conn)
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	err = proxy.Shutdown(shutdownCtx)
+	select {
+	case serveErr := <-adminErr:
+		return errors.Join(serveErr, err)
+	default:
+		return err
 	}
 }
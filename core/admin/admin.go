@@ -0,0 +1,163 @@
+// Package admin implements an HTTP API for managing a running tcprp.
+package admin
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/Dyastin-0/tcprp/core/proxy"
+)
+
+// Admin serves the admin API of a proxy.
+type Admin struct {
+	proxy *proxy.Proxy
+	mux   *http.ServeMux
+	token string
+}
+
+// New returns a new Admin for p. If token is not empty,
+// requests must carry it as a bearer token.
+func New(p *proxy.Proxy, token string) *Admin {
+	a := &Admin{
+		proxy: p,
+		mux:   http.NewServeMux(),
+		token: token,
+	}
+
+	a.mux.HandleFunc("PUT /split", a.setSplitWeight)
+	a.mux.HandleFunc("PUT /maintenance", a.setMaintenance)
+	a.mux.HandleFunc("DELETE /cache", a.purgeCache)
+	a.mux.HandleFunc("GET /metrics", a.metrics)
+
+	return a
+}
+
+func (a *Admin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if a.token != "" {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="tcprp admin"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+	a.mux.ServeHTTP(w, r)
+}
+
+// ListenAddr returns the address to serve the admin API on for addr: a loopback address
+// if addr has no host, or addr itself. Other than loopback hosts require a token.
+func ListenAddr(addr, token string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", fmt.Errorf("invalid admin address '%s': %w", addr, err)
+	}
+	if host == "" {
+		return net.JoinHostPort("127.0.0.1", port), nil
+	}
+
+	ip := net.ParseIP(host)
+	if token == "" && host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return "", fmt.Errorf("admin address '%s' is not loopback, which requires an admin token", addr)
+	}
+	return addr, nil
+}
+
+// setSplitWeight sets the split weight of a domain or one of its routes.
+func (a *Admin) setSplitWeight(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	weight, err := strconv.Atoi(query.Get("weight"))
+	if err != nil {
+		http.Error(w, "invalid weight", http.StatusBadRequest)
+		return
+	}
+
+	err = a.proxy.Config.SetSplitWeight(query.Get("domain"), query.Get("pattern"), weight)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	fmt.Fprintf(w, "weight set to %d\n", weight)
+}
+
+// setMaintenance toggles the maintenance page of a domain.
+func (a *Admin) setMaintenance(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	enabled, err := strconv.ParseBool(query.Get("enabled"))
+	if err != nil {
+		http.Error(w, "invalid enabled", http.StatusBadRequest)
+		return
+	}
+
+	err = a.proxy.Config.SetMaintenance(query.Get("domain"), enabled)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	fmt.Fprintf(w, "maintenance set to %t\n", enabled)
+}
+
+// purgeCache removes the cached responses of a host whose request URI starts with a prefix,
+// or of every host if no host is given.
+func (a *Admin) purgeCache(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	purged := a.proxy.Config.PurgeCache(query.Get("host"), query.Get("prefix"))
+
+	fmt.Fprintf(w, "purged %d entries\n", purged)
+}
+
+// metrics writes the metrics of every domain in the Prometheus text format.
+func (a *Admin) metrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	tracked, evicted := a.proxy.Config.TrackedClients()
+	fmt.Fprintf(w, "tcprp_limiter_tracked_clients %d\n", tracked)
+	fmt.Fprintf(w, "tcprp_limiter_evicted_clients_total %d\n", evicted)
+
+	if global := a.proxy.Config.GlobalConnLimiter; global != nil {
+		fmt.Fprintf(w, "tcprp_conn_limit_active{scope=\"global\"} %d\n", global.Active())
+		fmt.Fprintf(w, "tcprp_conn_limit_rejections_total{scope=\"global\"} %d\n", global.Rejected())
+	}
+
+	domains := a.proxy.Config.Proxies.GetKeysWithVal()
+	slices.Sort(domains)
+
+	for _, domain := range domains {
+		proxy := a.proxy.Config.Proxies.Get(domain)
+		if proxy == nil || (*proxy).Metrics == nil {
+			continue
+		}
+		m := (*proxy).Metrics
+
+		fmt.Fprintf(w, "tcprp_ingress_bytes_total{domain=%q} %d\n", domain, m.GetIngressBytes())
+		fmt.Fprintf(w, "tcprp_egress_bytes_total{domain=%q} %d\n", domain, m.GetEgressBytes())
+		fmt.Fprintf(w, "tcprp_connections_total{domain=%q} %d\n", domain, m.GetConnectionCount())
+		fmt.Fprintf(w, "tcprp_active_connections{domain=%q} %d\n", domain, m.GetActiveConnections())
+		fmt.Fprintf(w, "tcprp_websocket_messages_total{domain=%q,direction=\"ingress\"} %d\n", domain, m.GetWebSocketIngressMessages())
+		fmt.Fprintf(w, "tcprp_websocket_messages_total{domain=%q,direction=\"egress\"} %d\n", domain, m.GetWebSocketEgressMessages())
+
+		if cl := (*proxy).ConnLimiter; cl != nil {
+			fmt.Fprintf(w, "tcprp_conn_limit_active{scope=\"proxy\",domain=%q} %d\n", domain, cl.Active())
+			fmt.Fprintf(w, "tcprp_conn_limit_rejections_total{scope=\"proxy\",domain=%q} %d\n", domain, cl.Rejected())
+		}
+		for _, route := range (*proxy).Routes {
+			if cl := route.ConnLimiter; cl != nil {
+				fmt.Fprintf(w, "tcprp_conn_limit_active{scope=\"route\",domain=%q,route=%q} %d\n", domain, route.Pattern, cl.Active())
+				fmt.Fprintf(w, "tcprp_conn_limit_rejections_total{scope=\"route\",domain=%q,route=%q} %d\n", domain, route.Pattern, cl.Rejected())
+			}
+		}
+
+		for ja4, count := range m.Fingerprints.Snapshot() {
+			fmt.Fprintf(w, "tcprp_tls_fingerprint_total{domain=%q,ja4=%q} %d\n", domain, ja4, count)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package admin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Dyastin-0/tcprp/core/proxy"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdminToken(t *testing.T) {
+	a := New(proxy.New(), "secret")
+
+	for header, status := range map[string]int{
+		"":              http.StatusUnauthorized,
+		"Bearer wrong":  http.StatusUnauthorized,
+		"Basic secret":  http.StatusUnauthorized,
+		"Bearer secret": http.StatusOK,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		if header != "" {
+			req.Header.Set("Authorization", header)
+		}
+		rec := httptest.NewRecorder()
+		a.ServeHTTP(rec, req)
+		require.Equal(t, status, rec.Code, header)
+	}
+
+	rec := httptest.NewRecorder()
+	New(proxy.New(), "").ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+}
+
+func TestListenAddr(t *testing.T) {
+	addr, err := ListenAddr(":9000", "")
+	require.NoError(t, err)
+	require.Equal(t, "127.0.0.1:9000", addr)
+
+	for _, loopback := range []string{"127.0.0.1:9000", "[::1]:9000", "localhost:9000"} {
+		addr, err = ListenAddr(loopback, "")
+		require.NoError(t, err)
+		require.Equal(t, loopback, addr)
+	}
+
+	_, err = ListenAddr("0.0.0.0:9000", "")
+	require.Error(t, err)
+	_, err = ListenAddr("10.0.0.1:9000", "")
+	require.Error(t, err)
+	_, err = ListenAddr("9000", "")
+	require.Error(t, err)
+
+	addr, err = ListenAddr("0.0.0.0:9000", "secret")
+	require.NoError(t, err)
+	require.Equal(t, "0.0.0.0:9000", addr)
+}
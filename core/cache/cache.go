@@ -0,0 +1,412 @@
+// Package cache implements an HTTP response cache with memory and disk stores.
+package cache
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultMaxEntrySize is the size of the largest response body cached by a Cache without a limit.
+const DefaultMaxEntrySize = 1 << 20
+
+// cacheableStatus are the statuses cacheable by default.
+var cacheableStatus = []int{
+	http.StatusOK,
+	http.StatusNonAuthoritativeInfo,
+	http.StatusNoContent,
+	http.StatusMultipleChoices,
+	http.StatusMovedPermanently,
+	http.StatusNotFound,
+	http.StatusMethodNotAllowed,
+	http.StatusGone,
+	http.StatusRequestURITooLong,
+	http.StatusNotImplemented,
+	http.StatusPermanentRedirect,
+}
+
+// hopHeaders are the headers of a single connection, which are not stored.
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// Entry is a stored response.
+type Entry struct {
+	Key        string
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+	// Stored is when the response was stored or last revalidated.
+	Stored time.Time
+	// Vary lists the request headers selecting the variant of a response.
+	// An entry with Vary is only a marker, and the variants are stored under their own keys.
+	Vary []string
+}
+
+// size returns the approximate number of bytes held by e.
+func (e *Entry) size() int64 {
+	n := len(e.Key) + len(e.Body)
+	for name, values := range e.Header {
+		for _, value := range values {
+			n += len(name) + len(value)
+		}
+	}
+	return int64(n)
+}
+
+// Store holds entries by key.
+type Store interface {
+	Get(key string) (*Entry, bool)
+	Set(e *Entry)
+	// Purge removes the entries whose key matches and returns how many were removed.
+	Purge(match func(key string) bool) int
+	// Close releases the store, which stores nothing afterwards.
+	Close() error
+}
+
+// Cache caches responses to GET requests in a Store, following RFC 9111 for a shared cache.
+type Cache struct {
+	store        Store
+	maxEntrySize int64
+}
+
+// New returns a new Cache storing response bodies of up to maxEntrySize bytes in store.
+func New(store Store, maxEntrySize int64) *Cache {
+	if maxEntrySize <= 0 {
+		maxEntrySize = DefaultMaxEntrySize
+	}
+	return &Cache{store: store, maxEntrySize: maxEntrySize}
+}
+
+// Key returns the key of the response to req from backend: its host without port, its request URI
+// and backend, which tells apart the responses of the routes and targets serving the same URI.
+func Key(req *http.Request, backend string) string {
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(host) + req.URL.RequestURI() + "\x00" + backend
+}
+
+// Lookup returns the entry stored under key for req, and whether it is fresh enough to serve.
+// A stale entry can be revalidated with Conditional and Revalidate.
+func (c *Cache) Lookup(key string, req *http.Request) (*Entry, bool) {
+	if req.Method != http.MethodGet {
+		return nil, false
+	}
+
+	reqCC := parseCacheControl(req.Header)
+	if reqCC.has("no-store") {
+		return nil, false
+	}
+
+	e, ok := c.store.Get(key)
+	if ok && e.Vary != nil {
+		e, ok = c.store.Get(variantKey(key, e.Vary, req))
+	}
+	if !ok {
+		return nil, false
+	}
+
+	now := time.Now()
+	age := e.age(now)
+	respCC := parseCacheControl(e.Header)
+
+	fresh := age < e.lifetime(respCC) &&
+		!respCC.has("no-cache") &&
+		!reqCC.has("no-cache") &&
+		req.Header.Get("Pragma") != "no-cache"
+
+	if maxAge, ok := reqCC.seconds("max-age"); ok && age > maxAge {
+		fresh = false
+	}
+
+	return e, fresh
+}
+
+// Store stores resp to req under key if it is cacheable, and reports whether it was stored.
+// If authenticated is set, req was authorized by the proxy, for example with an API key or an
+// auth service, and resp is only stored if it is explicitly public or has an s-maxage. The body of a cacheable resp is read up to the entry size limit and replaced with a reader
+// returning the same bytes, so resp can still be written to the client.
+func (c *Cache) Store(key string, req *http.Request, resp *http.Response, authenticated bool) bool {
+	if !c.storable(req, resp, authenticated) {
+		return false
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, c.maxEntrySize+1))
+	if err != nil || int64(len(body)) > c.maxEntrySize {
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+		return false
+	}
+	resp.Body.Close()
+
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.TransferEncoding = nil
+
+	header := resp.Header.Clone()
+	for _, name := range hopHeaders {
+		header.Del(name)
+	}
+	header.Set("Content-Length", strconv.Itoa(len(body)))
+
+	e := &Entry{
+		Key:        key,
+		StatusCode: resp.StatusCode,
+		Header:     header,
+		Body:       body,
+		Stored:     time.Now(),
+	}
+
+	if vary := varyHeaders(resp.Header); len(vary) > 0 {
+		c.store.Set(&Entry{Key: key, Vary: vary, Stored: e.Stored})
+		e.Key = variantKey(key, vary, req)
+	}
+
+	c.store.Set(e)
+	return true
+}
+
+// storable reports whether resp to req, authenticated by the proxy if authenticated is set, may be stored.
+func (c *Cache) storable(req *http.Request, resp *http.Response, authenticated bool) bool {
+	if req.Method != http.MethodGet || !slices.Contains(cacheableStatus, resp.StatusCode) {
+		return false
+	}
+
+	reqCC := parseCacheControl(req.Header)
+	respCC := parseCacheControl(resp.Header)
+
+	if reqCC.has("no-store") || respCC.has("no-store") || respCC.has("private") {
+		return false
+	}
+	if req.Header.Get("Authorization") != "" &&
+		!respCC.has("public") && !respCC.has("s-maxage") && !respCC.has("must-revalidate") {
+		return false
+	}
+	if authenticated && !respCC.has("public") && !respCC.has("s-maxage") {
+		return false
+	}
+	if resp.Header.Get("Set-Cookie") != "" || resp.Header.Get("Vary") == "*" {
+		return false
+	}
+
+	// Without explicit freshness, a response is only worth storing if it can be revalidated.
+	_, maxAge := respCC.seconds("max-age")
+	_, sMaxAge := respCC.seconds("s-maxage")
+	return maxAge || sMaxAge || resp.Header.Get("Expires") != "" ||
+		resp.Header.Get("ETag") != "" || resp.Header.Get("Last-Modified") != ""
+}
+
+// Conditional adds the validators of e to req, so the backend can answer 304 if e is still valid.
+// It reports false, leaving req unchanged, if e has no validators or req already is conditional.
+func Conditional(req *http.Request, e *Entry) bool {
+	if req.Header.Get("If-None-Match") != "" || req.Header.Get("If-Modified-Since") != "" {
+		return false
+	}
+
+	etag, lastModified := e.Header.Get("ETag"), e.Header.Get("Last-Modified")
+	switch {
+	case etag != "":
+		req.Header.Set("If-None-Match", etag)
+	case lastModified != "":
+		req.Header.Set("If-Modified-Since", lastModified)
+	default:
+		return false
+	}
+	return true
+}
+
+// Revalidate updates e with the headers of resp, a 304 to its conditional request,
+// and returns the updated entry.
+func (c *Cache) Revalidate(e *Entry, resp *http.Response) *Entry {
+	updated := *e
+	updated.Header = e.Header.Clone()
+	for name, values := range resp.Header {
+		if slices.Contains(hopHeaders, name) || name == "Content-Length" {
+			continue
+		}
+		updated.Header[name] = values
+	}
+	updated.Stored = time.Now()
+
+	c.store.Set(&updated)
+	return &updated
+}
+
+// Purge removes the entries of host whose request URI starts with prefix,
+// or of every host if host is empty, and returns how many were removed.
+func (c *Cache) Purge(host, prefix string) int {
+	return PurgeStore(c.store, host, prefix)
+}
+
+// PurgeStore is Purge on store.
+func PurgeStore(store Store, host, prefix string) int {
+	host = strings.ToLower(host)
+	return store.Purge(func(key string) bool {
+		i := strings.IndexByte(key, '/')
+		if i < 0 {
+			return false
+		}
+		return (host == "" || key[:i] == host) && strings.HasPrefix(key[i:], prefix)
+	})
+}
+
+// Response returns the response to req served from e, or a 304 if req's validators match e.
+func (e *Entry) Response(req *http.Request) *http.Response {
+	header := e.Header.Clone()
+	header.Set("Age", strconv.Itoa(int(e.age(time.Now())/time.Second)))
+
+	resp := &http.Response{
+		StatusCode: e.StatusCode,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     header,
+		Request:    req,
+	}
+
+	if e.notModified(req) {
+		resp.StatusCode = http.StatusNotModified
+		resp.Header.Del("Content-Length")
+		resp.Body = http.NoBody
+		return resp
+	}
+
+	resp.ContentLength = int64(len(e.Body))
+	resp.Body = io.NopCloser(bytes.NewReader(e.Body))
+	return resp
+}
+
+// notModified reports whether the validators of req match e.
+func (e *Entry) notModified(req *http.Request) bool {
+	if e.StatusCode != http.StatusOK {
+		return false
+	}
+
+	if inm := req.Header.Get("If-None-Match"); inm != "" {
+		etag := strings.TrimPrefix(e.Header.Get("ETag"), "W/")
+		if etag == "" {
+			return false
+		}
+		for _, candidate := range strings.Split(inm, ",") {
+			candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+			if candidate == "*" || candidate == etag {
+				return true
+			}
+		}
+		return false
+	}
+
+	ims, err := http.ParseTime(req.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	lastModified, err := http.ParseTime(e.Header.Get("Last-Modified"))
+	return err == nil && !lastModified.After(ims)
+}
+
+// age returns the age of e at now, including the age it had when stored.
+func (e *Entry) age(now time.Time) time.Duration {
+	age := now.Sub(e.Stored)
+	if initial, err := strconv.Atoi(e.Header.Get("Age")); err == nil && initial > 0 {
+		age += time.Duration(initial) * time.Second
+	}
+	return age
+}
+
+// lifetime returns the freshness lifetime of e given its cache directives.
+func (e *Entry) lifetime(cc cacheControl) time.Duration {
+	if sMaxAge, ok := cc.seconds("s-maxage"); ok {
+		return sMaxAge
+	}
+	if maxAge, ok := cc.seconds("max-age"); ok {
+		return maxAge
+	}
+
+	expires, err := http.ParseTime(e.Header.Get("Expires"))
+	if err != nil {
+		return 0
+	}
+	date, err := http.ParseTime(e.Header.Get("Date"))
+	if err != nil {
+		date = e.Stored
+	}
+	return expires.Sub(date)
+}
+
+// cacheControl holds the directives of Cache-Control headers, keyed by lowercase name.
+type cacheControl map[string]string
+
+// parseCacheControl returns the directives of the Cache-Control headers of h.
+func parseCacheControl(h http.Header) cacheControl {
+	cc := cacheControl{}
+	for _, value := range h.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			name, arg, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			if name != "" {
+				cc[strings.ToLower(name)] = strings.Trim(arg, `"`)
+			}
+		}
+	}
+	return cc
+}
+
+// has reports whether the directive name is present.
+func (cc cacheControl) has(name string) bool {
+	_, ok := cc[name]
+	return ok
+}
+
+// seconds returns the delta-seconds argument of the directive name.
+func (cc cacheControl) seconds(name string) (time.Duration, bool) {
+	arg, ok := cc[name]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+// varyHeaders returns the canonical names of the Vary headers of h.
+func varyHeaders(h http.Header) []string {
+	var vary []string
+	for _, value := range h.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				vary = append(vary, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	slices.Sort(vary)
+	return slices.Compact(vary)
+}
+
+// variantKey returns the key of the variant of the response under key selected by req.
+func variantKey(key string, vary []string, req *http.Request) string {
+	var b strings.Builder
+	b.WriteString(key)
+	for _, name := range vary {
+		b.WriteByte(0)
+		b.WriteString(name)
+		b.WriteByte('=')
+		b.WriteString(strings.Join(req.Header.Values(name), ","))
+	}
+	return b.String()
+}
@@ -0,0 +1,214 @@
+package cache
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newResponse(status int, body string, header ...string) *http.Response {
+	resp := &http.Response{
+		StatusCode: status,
+		Header:     make(http.Header),
+		Body:       io.NopCloser(strings.NewReader(body)),
+	}
+	for i := 0; i+1 < len(header); i += 2 {
+		resp.Header.Add(header[i], header[i+1])
+	}
+	return resp
+}
+
+func readBody(t *testing.T, resp *http.Response) string {
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return string(body)
+}
+
+func TestCache(t *testing.T) {
+	c := New(NewMemoryStore(1<<20), 8)
+
+	req := httptest.NewRequest(http.MethodGet, "http://app.com:8443/app.js?v=1", nil)
+	key := Key(req, "localhost:8080")
+	require.Equal(t, "app.com/app.js?v=1\x00localhost:8080", key)
+	require.NotEqual(t, key, Key(req, "localhost:8081"))
+
+	resp := newResponse(http.StatusOK, "console", "Cache-Control", "max-age=60", "ETag", `"v1"`, "Connection", "close")
+	require.True(t, c.Store(key, req, resp, false))
+	require.Equal(t, "console", readBody(t, resp))
+
+	e, fresh := c.Lookup(key, req)
+	require.True(t, fresh)
+	require.Empty(t, e.Header.Get("Connection"))
+
+	hit := e.Response(req)
+	require.Equal(t, http.StatusOK, hit.StatusCode)
+	require.Equal(t, "console", readBody(t, hit))
+
+	conditional := httptest.NewRequest(http.MethodGet, "http://app.com/app.js?v=1", nil)
+	conditional.Header.Set("If-None-Match", `W/"v1"`)
+	require.Equal(t, http.StatusNotModified, e.Response(conditional).StatusCode)
+
+	noCache := httptest.NewRequest(http.MethodGet, "http://app.com/app.js?v=1", nil)
+	noCache.Header.Set("Cache-Control", "no-cache")
+	_, fresh = c.Lookup(key, noCache)
+	require.False(t, fresh)
+
+	// Bodies over the entry size are not stored, but are still readable.
+	large := newResponse(http.StatusOK, "large response body", "Cache-Control", "max-age=60")
+	require.False(t, c.Store("app.com/large", req, large, false))
+	require.Equal(t, "large response body", readBody(t, large))
+
+	for _, resp := range []*http.Response{
+		newResponse(http.StatusOK, "", "Cache-Control", "no-store, max-age=60"),
+		newResponse(http.StatusOK, "", "Cache-Control", "private, max-age=60"),
+		newResponse(http.StatusOK, "", "Cache-Control", "max-age=60", "Set-Cookie", "a=b"),
+		newResponse(http.StatusOK, "", "Cache-Control", "max-age=60", "Vary", "*"),
+		newResponse(http.StatusOK, ""),
+		newResponse(http.StatusInternalServerError, "", "Cache-Control", "max-age=60"),
+	} {
+		require.False(t, c.Store("app.com/skipped", req, resp, false))
+	}
+
+	authorized := httptest.NewRequest(http.MethodGet, "http://app.com/private", nil)
+	authorized.Header.Set("Authorization", "Bearer token")
+	require.False(t, c.Store("app.com/private", authorized, newResponse(http.StatusOK, "", "Cache-Control", "max-age=60"), false))
+	require.True(t, c.Store("app.com/private", authorized, newResponse(http.StatusOK, "", "Cache-Control", "public, max-age=60"), false))
+
+	// Requests authenticated by the proxy are only stored if the response is explicitly shared.
+	require.False(t, c.Store("app.com/account", req, newResponse(http.StatusOK, "", "Cache-Control", "max-age=60"), true))
+	require.False(t, c.Store("app.com/account", req, newResponse(http.StatusOK, "", "Cache-Control", "max-age=60, must-revalidate"), true))
+	require.True(t, c.Store("app.com/account", req, newResponse(http.StatusOK, "", "Cache-Control", "s-maxage=60"), true))
+	require.True(t, c.Store("app.com/account", req, newResponse(http.StatusOK, "", "Cache-Control", "public, max-age=60"), true))
+}
+
+func TestCacheRevalidate(t *testing.T) {
+	c := New(NewMemoryStore(1<<20), 0)
+
+	req := httptest.NewRequest(http.MethodGet, "http://app.com/index.html", nil)
+	key := Key(req, "localhost:8080")
+
+	resp := newResponse(http.StatusOK, "index", "Cache-Control", "no-cache", "ETag", `"v1"`)
+	require.True(t, c.Store(key, req, resp, false))
+
+	e, fresh := c.Lookup(key, req)
+	require.NotNil(t, e)
+	require.False(t, fresh)
+
+	require.True(t, Conditional(req, e))
+	require.Equal(t, `"v1"`, req.Header.Get("If-None-Match"))
+	require.False(t, Conditional(req, e))
+
+	e = c.Revalidate(e, newResponse(http.StatusNotModified, "", "Cache-Control", "max-age=60", "ETag", `"v1"`))
+	req.Header.Del("If-None-Match")
+	_, fresh = c.Lookup(key, req)
+	require.True(t, fresh)
+	require.Equal(t, "index", readBody(t, e.Response(req)))
+
+	expired := newResponse(http.StatusOK, "old", "Cache-Control", "max-age=60", "Age", "120")
+	require.True(t, c.Store("app.com/old", req, expired, false))
+	_, fresh = c.Lookup("app.com/old", req)
+	require.False(t, fresh)
+}
+
+func TestCacheVary(t *testing.T) {
+	c := New(NewMemoryStore(1<<20), 0)
+
+	gzip := httptest.NewRequest(http.MethodGet, "http://app.com/", nil)
+	gzip.Header.Set("Accept-Encoding", "gzip")
+	plain := httptest.NewRequest(http.MethodGet, "http://app.com/", nil)
+
+	require.True(t, c.Store(Key(gzip, "localhost:8080"), gzip, newResponse(http.StatusOK, "gzipped", "Cache-Control", "max-age=60", "Vary", "accept-encoding"), false))
+
+	e, fresh := c.Lookup(Key(gzip, "localhost:8080"), gzip)
+	require.True(t, fresh)
+	require.Equal(t, "gzipped", string(e.Body))
+
+	e, _ = c.Lookup(Key(plain, "localhost:8080"), plain)
+	require.Nil(t, e)
+
+	require.True(t, c.Store(Key(plain, "localhost:8080"), plain, newResponse(http.StatusOK, "plain", "Cache-Control", "max-age=60", "Vary", "Accept-Encoding"), false))
+	e, _ = c.Lookup(Key(plain, "localhost:8080"), plain)
+	require.Equal(t, "plain", string(e.Body))
+	e, _ = c.Lookup(Key(gzip, "localhost:8080"), gzip)
+	require.Equal(t, "gzipped", string(e.Body))
+
+	require.Equal(t, 3, c.Purge("APP.com", "/"))
+	e, _ = c.Lookup(Key(gzip, "localhost:8080"), gzip)
+	require.Nil(t, e)
+}
+
+func TestStores(t *testing.T) {
+	dir := t.TempDir()
+	disk, err := NewDiskStore(dir, 1<<20)
+	require.NoError(t, err)
+
+	for name, store := range map[string]Store{"memory": NewMemoryStore(1 << 20), "disk": disk} {
+		t.Run(name, func(t *testing.T) {
+			store.Set(&Entry{Key: "app.com/a", StatusCode: http.StatusOK, Header: http.Header{"Etag": {`"a"`}}, Body: []byte("a"), Stored: time.Now()})
+			store.Set(&Entry{Key: "app.com/b", StatusCode: http.StatusOK, Body: []byte("b")})
+			store.Set(&Entry{Key: "api.com/a", StatusCode: http.StatusOK, Body: []byte("c")})
+
+			e, ok := store.Get("app.com/a")
+			require.True(t, ok)
+			require.Equal(t, "a", string(e.Body))
+			require.Equal(t, `"a"`, e.Header.Get("ETag"))
+
+			require.Equal(t, 1, PurgeStore(store, "app.com", "/b"))
+			_, ok = store.Get("app.com/b")
+			require.False(t, ok)
+
+			require.Equal(t, 2, PurgeStore(store, "", ""))
+			_, ok = store.Get("api.com/a")
+			require.False(t, ok)
+		})
+	}
+
+	t.Run("eviction", func(t *testing.T) {
+		store := NewMemoryStore(100)
+		store.Set(&Entry{Key: "app.com/a", Body: make([]byte, 30)})
+		store.Set(&Entry{Key: "app.com/b", Body: make([]byte, 30)})
+		store.Get("app.com/a")
+		store.Set(&Entry{Key: "app.com/c", Body: make([]byte, 30)})
+
+		_, ok := store.Get("app.com/a")
+		require.True(t, ok)
+		_, ok = store.Get("app.com/b")
+		require.False(t, ok)
+	})
+
+	t.Run("restart", func(t *testing.T) {
+		disk.Set(&Entry{Key: "app.com/kept", Body: []byte("kept")})
+
+		reopened, err := NewDiskStore(dir, 1<<20)
+		require.NoError(t, err)
+		e, ok := reopened.Get("app.com/kept")
+		require.True(t, ok)
+		require.Equal(t, "kept", string(e.Body))
+	})
+
+	t.Run("close", func(t *testing.T) {
+		memory := NewMemoryStore(1 << 20)
+		memory.Set(&Entry{Key: "app.com/a", Body: []byte("a")})
+		require.NoError(t, memory.Close())
+		memory.Set(&Entry{Key: "app.com/b", Body: []byte("b")})
+		_, ok := memory.Get("app.com/a")
+		require.False(t, ok)
+		_, ok = memory.Get("app.com/b")
+		require.False(t, ok)
+
+		require.NoError(t, disk.Close())
+		disk.Set(&Entry{Key: "app.com/closed", Body: []byte("closed")})
+
+		reopened, err := NewDiskStore(dir, 1<<20)
+		require.NoError(t, err)
+		_, ok = reopened.Get("app.com/closed")
+		require.False(t, ok)
+		_, ok = reopened.Get("app.com/kept")
+		require.True(t, ok, "entries are kept on disk")
+	})
+}
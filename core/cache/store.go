@@ -0,0 +1,321 @@
+package cache
+
+import (
+	"cmp"
+	"container/list"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// entryExt is the extension of the entry files of a DiskStore.
+const entryExt = ".entry"
+
+// lru orders keys by use and evicts the least recently used beyond maxSize bytes.
+type lru struct {
+	maxSize int64
+	size    int64
+	ll      *list.List
+	items   map[string]*list.Element
+}
+
+// lruItem is a key of an lru and its size.
+type lruItem struct {
+	key  string
+	size int64
+}
+
+// newLRU returns a new lru holding up to maxSize bytes.
+func newLRU(maxSize int64) *lru {
+	return &lru{
+		maxSize: maxSize,
+		ll:      list.New(),
+		items:   make(map[string]*list.Element),
+	}
+}
+
+// add adds or replaces key as the most recently used, and returns the keys evicted to fit it.
+func (l *lru) add(key string, size int64) []string {
+	l.remove(key)
+	l.items[key] = l.ll.PushFront(&lruItem{key: key, size: size})
+	l.size += size
+
+	var evicted []string
+	for l.size > l.maxSize && l.ll.Len() > 1 {
+		item := l.ll.Back().Value.(*lruItem)
+		l.remove(item.key)
+		evicted = append(evicted, item.key)
+	}
+	return evicted
+}
+
+// touch marks key as the most recently used and reports whether it is present.
+func (l *lru) touch(key string) bool {
+	elem, ok := l.items[key]
+	if ok {
+		l.ll.MoveToFront(elem)
+	}
+	return ok
+}
+
+// remove removes key.
+func (l *lru) remove(key string) {
+	if elem, ok := l.items[key]; ok {
+		l.size -= elem.Value.(*lruItem).size
+		l.ll.Remove(elem)
+		delete(l.items, key)
+	}
+}
+
+// purge removes the keys matching and returns them.
+func (l *lru) purge(match func(key string) bool) []string {
+	var purged []string
+	for key := range l.items {
+		if match(key) {
+			purged = append(purged, key)
+		}
+	}
+	for _, key := range purged {
+		l.remove(key)
+	}
+	return purged
+}
+
+// MemoryStore is a Store keeping up to a maximum size of entries in memory.
+type MemoryStore struct {
+	mu      sync.Mutex
+	lru     *lru
+	entries map[string]*Entry
+	closed  bool
+}
+
+// NewMemoryStore returns a new MemoryStore holding up to maxSize bytes.
+func NewMemoryStore(maxSize int64) *MemoryStore {
+	return &MemoryStore{
+		lru:     newLRU(maxSize),
+		entries: make(map[string]*Entry),
+	}
+}
+
+// Get returns the entry of key.
+func (s *MemoryStore) Get(key string) (*Entry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.lru.touch(key) {
+		return nil, false
+	}
+	return s.entries[key], true
+}
+
+// Set stores e, evicting the least recently used entries if the store is full.
+func (s *MemoryStore) Set(e *Entry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return
+	}
+	s.entries[e.Key] = e
+	for _, key := range s.lru.add(e.Key, e.size()) {
+		delete(s.entries, key)
+	}
+}
+
+// Purge removes the entries whose key matches.
+func (s *MemoryStore) Purge(match func(key string) bool) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	purged := s.lru.purge(match)
+	for _, key := range purged {
+		delete(s.entries, key)
+	}
+	return len(purged)
+}
+
+// Close drops the entries of the store.
+func (s *MemoryStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	s.lru = newLRU(s.lru.maxSize)
+	clear(s.entries)
+	return nil
+}
+
+// DiskStore is a Store keeping up to a maximum size of entries in files of a directory.
+// Entries in the directory are kept across restarts.
+type DiskStore struct {
+	dir string
+
+	mu     sync.Mutex
+	lru    *lru
+	closed bool
+}
+
+// NewDiskStore returns a new DiskStore holding up to maxSize bytes in dir,
+// loading the entries already there.
+func NewDiskStore(dir string, maxSize int64) (*DiskStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+
+	s := &DiskStore{dir: dir, lru: newLRU(maxSize)}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	type stored struct {
+		key  string
+		size int64
+		mod  int64
+	}
+	var entries []stored
+	for _, file := range files {
+		if strings.HasPrefix(file.Name(), "tmp-") {
+			os.Remove(filepath.Join(dir, file.Name()))
+			continue
+		}
+		if file.IsDir() || !strings.HasSuffix(file.Name(), entryExt) {
+			continue
+		}
+		path := filepath.Join(dir, file.Name())
+		e, err := readEntry(path)
+		if err != nil || s.path(e.Key) != path {
+			os.Remove(path)
+			continue
+		}
+		info, err := file.Info()
+		if err != nil {
+			continue
+		}
+		entries = append(entries, stored{key: e.Key, size: info.Size(), mod: info.ModTime().UnixNano()})
+	}
+
+	// Oldest first, so the most recently stored entries are kept.
+	slices.SortFunc(entries, func(a, b stored) int { return cmp.Compare(a.mod, b.mod) })
+	for _, e := range entries {
+		s.evict(s.lru.add(e.key, e.size))
+	}
+
+	return s, nil
+}
+
+// Get returns the entry of key.
+func (s *DiskStore) Get(key string) (*Entry, bool) {
+	s.mu.Lock()
+	ok := s.lru.touch(key)
+	s.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	e, err := readEntry(s.path(key))
+	if err != nil {
+		s.mu.Lock()
+		s.lru.remove(key)
+		s.mu.Unlock()
+		return nil, false
+	}
+	return e, true
+}
+
+// Set stores e, evicting the least recently used entries if the store is full.
+// Entries that cannot be written are not stored.
+func (s *DiskStore) Set(e *Entry) {
+	s.mu.Lock()
+	closed := s.closed
+	s.mu.Unlock()
+	if closed {
+		return
+	}
+
+	path := s.path(e.Key)
+
+	tmp, err := os.CreateTemp(s.dir, "tmp-*")
+	if err != nil {
+		return
+	}
+	err = gob.NewEncoder(tmp).Encode(e)
+	info, statErr := tmp.Stat()
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = statErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		// The entry is not tracked, so it must not outgrow the store reopening the directory.
+		s.evict([]string{e.Key})
+		return
+	}
+	s.evict(s.lru.add(e.Key, info.Size()))
+}
+
+// Purge removes the entries whose key matches.
+func (s *DiskStore) Purge(match func(key string) bool) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	purged := s.lru.purge(match)
+	s.evict(purged)
+	return len(purged)
+}
+
+// Close stops the store from writing entries, leaving the ones in its directory
+// to the next store opening it.
+func (s *DiskStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	return nil
+}
+
+// evict removes the files of keys, s.mu must be held.
+func (s *DiskStore) evict(keys []string) {
+	for _, key := range keys {
+		os.Remove(s.path(key))
+	}
+}
+
+// path returns the file of the entry of key.
+func (s *DiskStore) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(s.dir, hex.EncodeToString(sum[:])+entryExt)
+}
+
+// readEntry reads the entry file at path.
+func readEntry(path string) (*Entry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var e Entry
+	if err := gob.NewDecoder(f).Decode(&e); err != nil {
+		return nil, fmt.Errorf("invalid cache entry '%s': %w", path, err)
+	}
+	return &e, nil
+}
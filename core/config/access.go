@@ -0,0 +1,277 @@
+package config
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Dyastin-0/tcprp/core/geoip"
+)
+
+// accessReloadInterval is how often access list files are checked for changes.
+const accessReloadInterval = time.Second
+
+// AccessConfig represents CIDR allow and deny lists, given inline or as files
+// with one address or CIDR per line. Files are reloaded when they change.
+// Countries and ASNs are looked up in the geoip databases.
+type AccessConfig struct {
+	Allow          []string `yaml:"allow,omitempty"`
+	Deny           []string `yaml:"deny,omitempty"`
+	AllowFile      string   `yaml:"allow_file,omitempty"`
+	DenyFile       string   `yaml:"deny_file,omitempty"`
+	AllowCountries []string `yaml:"allow_countries,omitempty"`
+	DenyCountries  []string `yaml:"deny_countries,omitempty"`
+	AllowASNs      []uint   `yaml:"allow_asns,omitempty"`
+	DenyASNs       []uint   `yaml:"deny_asns,omitempty"`
+}
+
+// AccessList decides which client IPs are allowed.
+// Deny entries take precedence, and non-empty allow lists deny every address none of them contains.
+type AccessList struct {
+	allow     []netip.Prefix
+	deny      []netip.Prefix
+	allowFile *prefixFile
+	denyFile  *prefixFile
+	allowGeo  *GeoMatch
+	denyGeo   *GeoMatch
+	geo       *geoip.DB
+}
+
+// prefixFile is a list of prefixes loaded from a file, reloaded in the background
+// when its modification time changes.
+type prefixFile struct {
+	path     string
+	prefixes atomic.Pointer[[]netip.Prefix]
+	modTime  time.Time
+	mu       sync.Mutex
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+// NewAccessList returns a new AccessList from conf, looking up countries and ASNs in geo.
+func NewAccessList(conf *AccessConfig, geo *geoip.DB) (*AccessList, error) {
+	a := &AccessList{
+		allowGeo: newGeoMatch(conf.AllowCountries, conf.AllowASNs),
+		denyGeo:  newGeoMatch(conf.DenyCountries, conf.DenyASNs),
+		geo:      geo,
+	}
+
+	if geo == nil && (a.allowGeo != nil || a.denyGeo != nil) {
+		return nil, fmt.Errorf("country and asn rules require geoip databases")
+	}
+
+	var err error
+	if a.allow, err = parsePrefixes(conf.Allow); err != nil {
+		return nil, err
+	}
+	if a.deny, err = parsePrefixes(conf.Deny); err != nil {
+		return nil, err
+	}
+
+	if conf.AllowFile != "" {
+		if a.allowFile, err = newPrefixFile(conf.AllowFile); err != nil {
+			return nil, err
+		}
+	}
+	if conf.DenyFile != "" {
+		if a.denyFile, err = newPrefixFile(conf.DenyFile); err != nil {
+			return nil, err
+		}
+	}
+
+	return a, nil
+}
+
+// Allowed reports whether ip is allowed. A nil AccessList allows every address.
+func (a *AccessList) Allowed(ip string) bool {
+	if a == nil {
+		return true
+	}
+
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+
+	var info geoip.Info
+	if a.allowGeo != nil || a.denyGeo != nil {
+		info = a.geo.Lookup(ip)
+	}
+
+	if containsAddr(a.deny, addr) || containsAddr(a.denyFile.get(), addr) || a.denyGeo.Matches(info) {
+		return false
+	}
+
+	allowFile := a.allowFile.get()
+	if len(a.allow) == 0 && a.allowFile == nil && a.allowGeo == nil {
+		return true
+	}
+	return containsAddr(a.allow, addr) || containsAddr(allowFile, addr) || a.allowGeo.Matches(info)
+}
+
+// Close stops reloading the files of the access list. Their last prefixes are still used.
+func (a *AccessList) Close() error {
+	a.allowFile.close()
+	a.denyFile.close()
+	return nil
+}
+
+// GeoMatchConfig represents countries and ASNs matching clients.
+type GeoMatchConfig struct {
+	Countries []string `yaml:"countries,omitempty"`
+	ASNs      []uint   `yaml:"asns,omitempty"`
+}
+
+// GeoMatch matches clients from any of its countries or ASNs.
+type GeoMatch struct {
+	countries []string
+	asns      []uint
+}
+
+// newGeoMatch returns a new GeoMatch, or nil if it would match nothing.
+func newGeoMatch(countries []string, asns []uint) *GeoMatch {
+	if len(countries) == 0 && len(asns) == 0 {
+		return nil
+	}
+
+	m := &GeoMatch{asns: asns}
+	for _, country := range countries {
+		m.countries = append(m.countries, strings.ToUpper(country))
+	}
+	return m
+}
+
+// Matches reports whether info is from one of the countries or ASNs of m.
+// A nil GeoMatch matches nothing.
+func (m *GeoMatch) Matches(info geoip.Info) bool {
+	if m == nil {
+		return false
+	}
+	return (info.Country != "" && slices.Contains(m.countries, info.Country)) ||
+		(info.ASN != 0 && slices.Contains(m.asns, info.ASN))
+}
+
+// newPrefixFile returns a new prefixFile loaded from path, checking it for changes until it is closed.
+func newPrefixFile(path string) (*prefixFile, error) {
+	f := &prefixFile{path: path, stop: make(chan struct{}), done: make(chan struct{})}
+	if err := f.load(); err != nil {
+		return nil, err
+	}
+	go f.watch(accessReloadInterval)
+	return f, nil
+}
+
+// get returns the prefixes of f.
+func (f *prefixFile) get() []netip.Prefix {
+	if f == nil {
+		return nil
+	}
+	return *f.prefixes.Load()
+}
+
+// watch reloads the file every interval until f is closed, so connections never wait on the disk.
+// The previous prefixes are kept if the file can no longer be read or parsed.
+func (f *prefixFile) watch(interval time.Duration) {
+	defer close(f.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			f.load()
+		case <-f.stop:
+			return
+		}
+	}
+}
+
+// close stops watching the file, returning once it is no longer reloaded.
+// It is safe to call more than once.
+func (f *prefixFile) close() {
+	if f == nil {
+		return
+	}
+	f.stopOnce.Do(func() { close(f.stop) })
+	<-f.done
+}
+
+// load loads the prefixes of the file if its modification time changed.
+func (f *prefixFile) load() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return fmt.Errorf("failed to read access list: %w", err)
+	}
+	if f.prefixes.Load() != nil && info.ModTime().Equal(f.modTime) {
+		return nil
+	}
+
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return fmt.Errorf("failed to read access list: %w", err)
+	}
+
+	var entries []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		if line = strings.TrimSpace(line); line != "" {
+			entries = append(entries, line)
+		}
+	}
+
+	prefixes, err := parsePrefixes(entries)
+	if err != nil {
+		return fmt.Errorf("%w in '%s'", err, f.path)
+	}
+
+	f.prefixes.Store(&prefixes)
+	f.modTime = info.ModTime()
+	return nil
+}
+
+// parsePrefixes parses addresses and CIDRs, addresses being single address prefixes.
+func parsePrefixes(entries []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(entries))
+	for _, entry := range entries {
+		if !strings.Contains(entry, "/") {
+			addr, err := netip.ParseAddr(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid address '%s'", entry)
+			}
+			addr = addr.Unmap()
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cidr '%s'", entry)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// containsAddr reports whether any of prefixes contains addr.
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
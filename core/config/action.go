@@ -0,0 +1,200 @@
+package config
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// RespondConfig represents a fixed response served without a backend, with a status from 200 to 599.
+type RespondConfig struct {
+	Status      int    `yaml:"status"`
+	Body        string `yaml:"body,omitempty"`
+	ContentType string `yaml:"content_type,omitempty"`
+}
+
+// RedirectConfig represents a redirect served without a backend.
+// To may contain {host}, {path}, {query} and {uri} placeholders.
+// {host} is the server name the client connected to, not its Host header.
+type RedirectConfig struct {
+	To     string `yaml:"to"`
+	Status int    `yaml:"status,omitempty"`
+}
+
+// MaintenanceConfig represents a maintenance page served instead of the proxy's routes.
+type MaintenanceConfig struct {
+	Enabled     bool   `yaml:"enabled"`
+	Body        string `yaml:"body,omitempty"`
+	File        string `yaml:"file,omitempty"`
+	ContentType string `yaml:"content_type,omitempty"`
+	RetryAfter  int    `yaml:"retry_after,omitempty"`
+}
+
+// Maintenance serves a 503 page while enabled.
+type Maintenance struct {
+	body        string
+	contentType string
+	retryAfter  int
+	enabled     atomic.Bool
+}
+
+// validate validates the respond action.
+func (r *RespondConfig) validate() error {
+	if r.Status < 200 || r.Status > 599 {
+		return fmt.Errorf("invalid respond status %d", r.Status)
+	}
+	return nil
+}
+
+// validate validates the redirect action and defaults its status to 302.
+func (r *RedirectConfig) validate() error {
+	if r.To == "" {
+		return fmt.Errorf("empty redirect destination")
+	}
+	switch r.Status {
+	case 0:
+		r.Status = http.StatusFound
+	case http.StatusMovedPermanently, http.StatusFound,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+	default:
+		return fmt.Errorf("invalid redirect status %d", r.Status)
+	}
+	return nil
+}
+
+// validateAction checks that exactly one of target, respond or redirect is set.
+func validateAction(target string, respond *RespondConfig, redirect *RedirectConfig) error {
+	n := 0
+	if target != "" {
+		n++
+	}
+	if respond != nil {
+		if err := respond.validate(); err != nil {
+			return err
+		}
+		n++
+	}
+	if redirect != nil {
+		if err := redirect.validate(); err != nil {
+			return err
+		}
+		n++
+	}
+
+	switch n {
+	case 0:
+		return fmt.Errorf("empty target")
+	case 1:
+		return nil
+	default:
+		return fmt.Errorf("only one of target, respond or redirect can be set")
+	}
+}
+
+// NewMaintenance returns a new Maintenance from conf.
+func NewMaintenance(conf *MaintenanceConfig) (*Maintenance, error) {
+	m := &Maintenance{
+		body:        conf.Body,
+		contentType: conf.ContentType,
+		retryAfter:  conf.RetryAfter,
+	}
+
+	if conf.File != "" {
+		data, err := os.ReadFile(conf.File)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read maintenance page: %w", err)
+		}
+		m.body = string(data)
+	}
+
+	if m.body == "" {
+		m.body = "Service is under maintenance"
+	}
+
+	if m.contentType == "" {
+		m.contentType = http.DetectContentType([]byte(m.body))
+	}
+
+	m.enabled.Store(conf.Enabled)
+	return m, nil
+}
+
+// Enabled reports whether the maintenance page is served.
+func (m *Maintenance) Enabled() bool {
+	return m != nil && m.enabled.Load()
+}
+
+// SetEnabled atomically toggles the maintenance page.
+func (m *Maintenance) SetEnabled(enabled bool) {
+	m.enabled.Store(enabled)
+}
+
+// Response returns the maintenance response for req, or nil if disabled.
+func (m *Maintenance) Response(req *http.Request) *http.Response {
+	if !m.Enabled() {
+		return nil
+	}
+
+	resp := newResponse(req, http.StatusServiceUnavailable, m.contentType, m.body)
+	if m.retryAfter > 0 {
+		resp.Header.Set("Retry-After", strconv.Itoa(m.retryAfter))
+	}
+	return resp
+}
+
+// Response returns the static response of the result for req to host,
+// or nil if the result forwards to a target.
+func (r RouteResult) Response(req *http.Request, host string) *http.Response {
+	if r.Respond != nil {
+		contentType := r.Respond.ContentType
+		if contentType == "" && r.Respond.Body != "" {
+			contentType = http.DetectContentType([]byte(r.Respond.Body))
+		}
+		return newResponse(req, r.Respond.Status, contentType, r.Respond.Body)
+	}
+
+	if r.Redirect != nil {
+		location := strings.NewReplacer(
+			"{host}", host,
+			"{path}", localPath(req.URL.EscapedPath()),
+			"{query}", req.URL.RawQuery,
+			"{uri}", localPath(req.URL.RequestURI()),
+		).Replace(r.Redirect.To)
+
+		resp := newResponse(req, r.Redirect.Status, "", "")
+		resp.Header.Set("Location", location)
+		return resp
+	}
+
+	return nil
+}
+
+// localPath returns p with its leading slashes collapsed,
+// so a Location cannot read it as a protocol-relative URL such as //evil.com.
+func localPath(p string) string {
+	if strings.HasPrefix(p, "//") {
+		return "/" + strings.TrimLeft(p, "/")
+	}
+	return p
+}
+
+// newResponse returns a new HTTP/1.1 response for req.
+func newResponse(req *http.Request, statusCode int, contentType, body string) *http.Response {
+	resp := &http.Response{
+		StatusCode:    statusCode,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Request:       req,
+		Header:        make(http.Header),
+		ContentLength: int64(len(body)),
+		Body:          io.NopCloser(strings.NewReader(body)),
+	}
+	if contentType != "" {
+		resp.Header.Set("Content-Type", contentType)
+	}
+	return resp
+}
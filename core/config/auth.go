@@ -0,0 +1,347 @@
+package config
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// defaultAuthRealm is the realm of the challenges of an AuthConfig without one.
+const defaultAuthRealm = "tcprp"
+
+// maxVerifiedPasswords bounds the cache of verified basic auth credentials.
+const maxVerifiedPasswords = 1024
+
+// bcryptSlots bounds the concurrent bcrypt comparisons,
+// so clients sending wrong passwords cannot take every CPU.
+var bcryptSlots = make(chan struct{}, max(runtime.GOMAXPROCS(0)/2, 1))
+
+// AuthConfig represents the authentication of terminated HTTP requests.
+// A request is authenticated if any of the configured methods accepts its credentials.
+type AuthConfig struct {
+	Realm  string            `yaml:"realm,omitempty"`
+	Basic  *BasicAuthConfig  `yaml:"basic,omitempty"`
+	APIKey *APIKeyAuthConfig `yaml:"api_key,omitempty"`
+	JWT    *JWTAuthConfig    `yaml:"jwt,omitempty"`
+}
+
+// BasicAuthConfig represents users with bcrypt password hashes,
+// given inline or as an htpasswd file created with htpasswd -B.
+type BasicAuthConfig struct {
+	Users        map[string]string `yaml:"users,omitempty"`
+	HtpasswdFile string            `yaml:"htpasswd_file,omitempty"`
+}
+
+// APIKeyAuthConfig represents static API keys sent in a header,
+// given inline or as a file with one key per line.
+type APIKeyAuthConfig struct {
+	Header   string   `yaml:"header,omitempty"`
+	Keys     []string `yaml:"keys,omitempty"`
+	KeysFile string   `yaml:"keys_file,omitempty"`
+}
+
+// JWTAuthConfig represents the verification of bearer tokens signed by local keys or the keys of a JWKS file.
+// Keys are PEM public keys or certificates, and Secret is an HMAC key.
+// Claims are required claim values, and ForwardClaims maps claims to the request headers they are forwarded in.
+type JWTAuthConfig struct {
+	Keys          []string          `yaml:"keys,omitempty"`
+	Secret        string            `yaml:"secret,omitempty"`
+	JWKSFile      string            `yaml:"jwks_file,omitempty"`
+	Issuer        string            `yaml:"issuer,omitempty"`
+	Audience      []string          `yaml:"audience,omitempty"`
+	Claims        map[string]string `yaml:"claims,omitempty"`
+	ForwardClaims map[string]string `yaml:"forward_claims,omitempty"`
+	Leeway        time.Duration     `yaml:"leeway,omitempty"`
+}
+
+// Auth authenticates HTTP requests.
+type Auth struct {
+	realm  string
+	basic  *basicAuth
+	apiKey *apiKeyAuth
+	jwt    *jwtAuth
+}
+
+// AuthResult is the outcome of authenticating a request.
+type AuthResult struct {
+	// Status is 401 if the request lacks valid credentials, 403 if they are not permitted,
+	// and zero if the request is authenticated.
+	Status int
+	// Challenges are the WWW-Authenticate values of a 401.
+	Challenges []string
+	// Claims are the verified claims of the JWT the request was authenticated by, if any.
+	Claims map[string]any
+}
+
+// basicAuth verifies basic auth credentials, caching the verified ones to skip bcrypt.
+type basicAuth struct {
+	users map[string][]byte
+	// dummy is compared against for unknown users, so they take as long as known ones.
+	dummy []byte
+
+	mu       sync.Mutex
+	verified map[[sha256.Size]byte]struct{}
+}
+
+// apiKeyAuth verifies API keys by their digests.
+type apiKeyAuth struct {
+	header string
+	keys   [][sha256.Size]byte
+}
+
+// NewAuth returns a new Auth from conf.
+func NewAuth(conf *AuthConfig) (*Auth, error) {
+	a := &Auth{realm: conf.Realm}
+	if a.realm == "" {
+		a.realm = defaultAuthRealm
+	}
+
+	var err error
+	if conf.Basic != nil {
+		if a.basic, err = newBasicAuth(conf.Basic); err != nil {
+			return nil, err
+		}
+	}
+	if conf.APIKey != nil {
+		if a.apiKey, err = newAPIKeyAuth(conf.APIKey); err != nil {
+			return nil, err
+		}
+	}
+	if conf.JWT != nil {
+		if a.jwt, err = newJWTAuth(conf.JWT); err != nil {
+			return nil, err
+		}
+	}
+
+	if a.basic == nil && a.apiKey == nil && a.jwt == nil {
+		return nil, fmt.Errorf("auth requires basic, api_key or jwt")
+	}
+
+	return a, nil
+}
+
+// Authenticate checks the credentials of req. On success, the claims forwarded
+// by the JWT method are set on req, and they are removed from it otherwise.
+// A nil Auth authenticates every request.
+func (a *Auth) Authenticate(req *http.Request) AuthResult {
+	if a == nil {
+		return AuthResult{}
+	}
+
+	a.jwt.removeForwarded(req.Header)
+
+	if a.basic != nil {
+		if user, password, ok := req.BasicAuth(); ok && a.basic.verify(user, password) {
+			return AuthResult{}
+		}
+	}
+
+	if a.apiKey != nil {
+		if key := req.Header.Get(a.apiKey.header); key != "" && a.apiKey.verify(key) {
+			return AuthResult{}
+		}
+	}
+
+	var tokenErr error
+	if a.jwt != nil {
+		if token, ok := bearerToken(req); ok {
+			claims, err := a.jwt.verify(token)
+			if err == nil {
+				a.jwt.forward(req.Header, claims)
+				return AuthResult{Claims: claims}
+			}
+			if err == errClaimMismatch {
+				return AuthResult{Status: http.StatusForbidden}
+			}
+			tokenErr = err
+		}
+	}
+
+	return AuthResult{Status: http.StatusUnauthorized, Challenges: a.challenges(tokenErr != nil)}
+}
+
+// VerifiesJWT reports whether a authenticates requests by JWT.
+func (a *Auth) VerifiesJWT() bool {
+	return a != nil && a.jwt != nil
+}
+
+// challenges returns the WWW-Authenticate values of the methods answering with one.
+func (a *Auth) challenges(invalidToken bool) []string {
+	var challenges []string
+	if a.basic != nil {
+		challenges = append(challenges, fmt.Sprintf(`Basic realm="%s", charset="UTF-8"`, a.realm))
+	}
+	if a.jwt != nil {
+		challenge := fmt.Sprintf(`Bearer realm="%s"`, a.realm)
+		if invalidToken {
+			challenge += `, error="invalid_token"`
+		}
+		challenges = append(challenges, challenge)
+	}
+	return challenges
+}
+
+// newBasicAuth returns a new basicAuth from conf.
+func newBasicAuth(conf *BasicAuthConfig) (*basicAuth, error) {
+	b := &basicAuth{
+		users:    make(map[string][]byte),
+		verified: make(map[[sha256.Size]byte]struct{}),
+	}
+
+	if conf.HtpasswdFile != "" {
+		lines, err := readLines(conf.HtpasswdFile)
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range lines {
+			user, hash, ok := strings.Cut(line, ":")
+			if !ok {
+				return nil, fmt.Errorf("invalid htpasswd line for user '%s'", user)
+			}
+			b.users[user] = []byte(hash)
+		}
+	}
+
+	for user, hash := range conf.Users {
+		b.users[user] = []byte(hash)
+	}
+
+	if len(b.users) == 0 {
+		return nil, fmt.Errorf("basic auth requires users")
+	}
+
+	cost := bcrypt.MinCost
+	for user, hash := range b.users {
+		hashCost, err := bcrypt.Cost(hash)
+		if err != nil {
+			return nil, fmt.Errorf("invalid password hash for user '%s', only bcrypt is supported: %w", user, err)
+		}
+		cost = max(cost, hashCost)
+	}
+
+	var err error
+	if b.dummy, err = bcrypt.GenerateFromPassword([]byte(rand.Text()), cost); err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// verify reports whether password is the password of user.
+func (b *basicAuth) verify(user, password string) bool {
+	hash, ok := b.users[user]
+	if !ok {
+		b.compare(b.dummy, password)
+		return false
+	}
+
+	digest := sha256.Sum256([]byte(user + "\x00" + password))
+
+	b.mu.Lock()
+	_, verified := b.verified[digest]
+	b.mu.Unlock()
+	if verified {
+		return true
+	}
+
+	if !b.compare(hash, password) {
+		return false
+	}
+
+	b.mu.Lock()
+	if len(b.verified) >= maxVerifiedPasswords {
+		clear(b.verified)
+	}
+	b.verified[digest] = struct{}{}
+	b.mu.Unlock()
+
+	return true
+}
+
+// compare reports whether password matches the bcrypt hash, waiting for a free slot.
+func (b *basicAuth) compare(hash []byte, password string) bool {
+	bcryptSlots <- struct{}{}
+	defer func() { <-bcryptSlots }()
+
+	return bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil
+}
+
+// newAPIKeyAuth returns a new apiKeyAuth from conf.
+func newAPIKeyAuth(conf *APIKeyAuthConfig) (*apiKeyAuth, error) {
+	a := &apiKeyAuth{header: conf.Header}
+	if a.header == "" {
+		a.header = APIKeyHeader
+	}
+
+	keys := conf.Keys
+	if conf.KeysFile != "" {
+		lines, err := readLines(conf.KeysFile)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, lines...)
+	}
+
+	for _, key := range keys {
+		if key == "" {
+			return nil, fmt.Errorf("empty api key")
+		}
+		a.keys = append(a.keys, sha256.Sum256([]byte(key)))
+	}
+
+	if len(a.keys) == 0 {
+		return nil, fmt.Errorf("api key auth requires keys")
+	}
+
+	return a, nil
+}
+
+// verify reports whether key is one of the keys of a, in constant time.
+func (a *apiKeyAuth) verify(key string) bool {
+	digest := sha256.Sum256([]byte(key))
+
+	found := 0
+	for _, k := range a.keys {
+		found |= subtle.ConstantTimeCompare(digest[:], k[:])
+	}
+	return found == 1
+}
+
+// bearerToken returns the bearer token of req.
+func bearerToken(req *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(req.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return "", false
+	}
+	return token, true
+}
+
+// readLines returns the non-empty lines of the file at path, skipping # comments.
+func readLines(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var lines []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines, scanner.Err()
+}
@@ -0,0 +1,232 @@
+package config
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// defaultAuthRequestTimeout bounds an auth subrequest without a configured timeout.
+const defaultAuthRequestTimeout = 5 * time.Second
+
+// maxAuthRequestCache bounds the number of cached auth subrequest results.
+const maxAuthRequestCache = 10000
+
+// defaultAuthRequestHeaders are the request headers sent to the auth service
+// if none are configured.
+var defaultAuthRequestHeaders = []string{"Authorization", "Cookie"}
+
+// AuthRequestConfig represents an external auth service checking each request,
+// with the contract of nginx auth_request and Traefik forwardAuth.
+// Headers are the request headers sent to the service, and ResponseHeaders are
+// the headers of its 2xx responses copied onto the request sent to the backend.
+type AuthRequestConfig struct {
+	URL             string        `yaml:"url"`
+	Headers         []string      `yaml:"headers,omitempty"`
+	ResponseHeaders []string      `yaml:"response_headers,omitempty"`
+	Timeout         time.Duration `yaml:"timeout,omitempty"`
+	CacheTTL        time.Duration `yaml:"cache_ttl,omitempty"`
+}
+
+// AuthRequest checks requests with subrequests to an auth service.
+type AuthRequest struct {
+	url             string
+	headers         []string
+	responseHeaders []string
+	client          *http.Client
+	cacheTTL        time.Duration
+
+	mu    sync.Mutex
+	cache map[[sha256.Size]byte]*authRequestResult
+}
+
+// authRequestResult is the cached outcome of an auth subrequest.
+type authRequestResult struct {
+	status  int
+	header  http.Header
+	expires time.Time
+}
+
+// NewAuthRequest returns a new AuthRequest from conf.
+func NewAuthRequest(conf *AuthRequestConfig) (*AuthRequest, error) {
+	u, err := url.Parse(conf.URL)
+	if err != nil {
+		return nil, err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("auth request url must be an absolute http or https url")
+	}
+
+	timeout := conf.Timeout
+	if timeout <= 0 {
+		timeout = defaultAuthRequestTimeout
+	}
+
+	headers := conf.Headers
+	if len(headers) == 0 {
+		headers = defaultAuthRequestHeaders
+	}
+
+	return &AuthRequest{
+		url:             conf.URL,
+		headers:         headers,
+		responseHeaders: conf.ResponseHeaders,
+		cacheTTL:        conf.CacheTTL,
+		cache:           make(map[[sha256.Size]byte]*authRequestResult),
+		client: &http.Client{
+			Timeout: timeout,
+			Transport: &http.Transport{
+				IdleConnTimeout: 90 * time.Second,
+			},
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}, nil
+}
+
+// Close closes the idle connections to the auth service.
+func (a *AuthRequest) Close() error {
+	a.client.CloseIdleConnections()
+	return nil
+}
+
+// Check sends a subrequest for req from clientIP to the auth service and returns its status:
+// 200 if req is allowed, 401 or 403 if the service denies it, and 500 if the service failed.
+// On 200, the response headers of the service are copied onto req. On 401 and 403,
+// the returned header holds the WWW-Authenticate and Set-Cookie headers for the client.
+// A nil AuthRequest allows every request.
+func (a *AuthRequest) Check(req *http.Request, clientIP string) (int, http.Header) {
+	if a == nil {
+		return http.StatusOK, nil
+	}
+
+	for _, name := range a.responseHeaders {
+		req.Header.Del(name)
+	}
+
+	key := a.cacheKey(req, clientIP)
+	res := a.cached(key)
+	if res == nil {
+		res = a.send(req, clientIP)
+		a.store(key, res)
+	}
+
+	if res.status == http.StatusOK {
+		for _, name := range a.responseHeaders {
+			for _, value := range res.header.Values(name) {
+				req.Header.Add(name, value)
+			}
+		}
+	}
+	return res.status, res.header
+}
+
+// send sends the subrequest for req.
+func (a *AuthRequest) send(req *http.Request, clientIP string) *authRequestResult {
+	sub, err := http.NewRequestWithContext(req.Context(), req.Method, a.url, nil)
+	if err != nil {
+		return &authRequestResult{status: http.StatusInternalServerError}
+	}
+
+	for _, name := range a.headers {
+		for _, value := range req.Header.Values(name) {
+			sub.Header.Add(name, value)
+		}
+	}
+	sub.Header.Set("X-Original-Method", req.Method)
+	sub.Header.Set("X-Original-URI", req.URL.RequestURI())
+	sub.Header.Set("X-Forwarded-Method", req.Method)
+	sub.Header.Set("X-Forwarded-Proto", "https")
+	sub.Header.Set("X-Forwarded-Host", req.Host)
+	sub.Header.Set("X-Forwarded-Uri", req.URL.RequestURI())
+	sub.Header.Set("X-Forwarded-For", clientIP)
+
+	resp, err := a.client.Do(sub)
+	if err != nil {
+		return &authRequestResult{status: http.StatusInternalServerError}
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		header := make(http.Header)
+		for _, name := range a.responseHeaders {
+			for _, value := range resp.Header.Values(name) {
+				header.Add(name, value)
+			}
+		}
+		return &authRequestResult{status: http.StatusOK, header: header}
+
+	case resp.StatusCode == http.StatusUnauthorized, resp.StatusCode == http.StatusForbidden:
+		header := make(http.Header)
+		for _, name := range []string{"WWW-Authenticate", "Set-Cookie"} {
+			for _, value := range resp.Header.Values(name) {
+				header.Add(name, value)
+			}
+		}
+		return &authRequestResult{status: resp.StatusCode, header: header}
+	}
+
+	return &authRequestResult{status: http.StatusInternalServerError}
+}
+
+// cacheKey returns the key of the result of req from clientIP,
+// covering everything sent to the auth service.
+func (a *AuthRequest) cacheKey(req *http.Request, clientIP string) [sha256.Size]byte {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%s\x00%s\x00", req.Method, req.Host, req.URL.RequestURI(), clientIP)
+	for _, name := range a.headers {
+		for _, value := range req.Header.Values(name) {
+			fmt.Fprintf(h, "%s\x00%s\x00", name, value)
+		}
+	}
+
+	var key [sha256.Size]byte
+	h.Sum(key[:0])
+	return key
+}
+
+// cached returns the unexpired result cached under key, or nil.
+func (a *AuthRequest) cached(key [sha256.Size]byte) *authRequestResult {
+	if a.cacheTTL <= 0 {
+		return nil
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	res, ok := a.cache[key]
+	if !ok || time.Now().After(res.expires) {
+		return nil
+	}
+	return res
+}
+
+// store caches res under key, unless the auth service failed.
+func (a *AuthRequest) store(key [sha256.Size]byte, res *authRequestResult) {
+	if a.cacheTTL <= 0 || res.status == http.StatusInternalServerError {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if len(a.cache) >= maxAuthRequestCache {
+		now := time.Now()
+		for k, r := range a.cache {
+			if now.After(r.expires) {
+				delete(a.cache, k)
+			}
+		}
+		if len(a.cache) >= maxAuthRequestCache {
+			clear(a.cache)
+		}
+	}
+
+	res.expires = time.Now().Add(a.cacheTTL)
+	a.cache[key] = res
+}
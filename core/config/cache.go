@@ -0,0 +1,50 @@
+package config
+
+import (
+	"fmt"
+
+	"github.com/Dyastin-0/tcprp/core/cache"
+)
+
+// CacheStoreConfig represents a response cache store holding up to MaxSize bytes,
+// in files of the Path directory, or in memory if Path is empty.
+type CacheStoreConfig struct {
+	Path    string `yaml:"path,omitempty"`
+	MaxSize int64  `yaml:"max_size"`
+}
+
+// CacheConfig represents the response cache of a proxy or route, kept in one of the cache stores.
+type CacheConfig struct {
+	Store        string `yaml:"store"`
+	MaxEntrySize int64  `yaml:"max_entry_size,omitempty"`
+}
+
+// newCacheStore returns a new cache store from conf.
+func newCacheStore(conf *CacheStoreConfig) (cache.Store, error) {
+	if conf.MaxSize <= 0 {
+		return nil, fmt.Errorf("cache store requires a max size")
+	}
+	if conf.Path == "" {
+		return cache.NewMemoryStore(conf.MaxSize), nil
+	}
+	return cache.NewDiskStore(conf.Path, conf.MaxSize)
+}
+
+// newCache returns a new response cache from conf.
+func (c *Config) newCache(conf *CacheConfig) (*cache.Cache, error) {
+	store, ok := c.cacheStores[conf.Store]
+	if !ok {
+		return nil, fmt.Errorf("unknown cache store '%s'", conf.Store)
+	}
+	return cache.New(store, conf.MaxEntrySize), nil
+}
+
+// PurgeCache removes the cached responses of host whose request URI starts with prefix,
+// or of every host if host is empty, and returns how many were removed.
+func (c *Config) PurgeCache(host, prefix string) int {
+	purged := 0
+	for _, store := range c.cacheStores {
+		purged += cache.PurgeStore(store, host, prefix)
+	}
+	return purged
+}
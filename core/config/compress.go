@@ -0,0 +1,148 @@
+package config
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Response encodings, in their Content-Encoding spelling.
+const (
+	EncodingBrotli = "br"
+	EncodingZstd   = "zstd"
+	EncodingGzip   = "gzip"
+)
+
+// DefaultCompressMinSize is the size of the smallest response compressed without a configured minimum.
+const DefaultCompressMinSize = 1024
+
+// DefaultCompressEncodings are the encodings offered without configured ones, preferred in order.
+var DefaultCompressEncodings = []string{EncodingBrotli, EncodingZstd, EncodingGzip}
+
+// DefaultCompressTypes are the content types compressed without configured ones.
+var DefaultCompressTypes = []string{
+	"text/*",
+	"application/javascript",
+	"application/json",
+	"application/manifest+json",
+	"application/wasm",
+	"application/xml",
+	"image/svg+xml",
+}
+
+// CompressConfig represents the compression of responses.
+// Encodings are preferred in order when clients accept several equally,
+// and Types are content types, or a type followed by /* for all its subtypes.
+type CompressConfig struct {
+	Encodings []string `yaml:"encodings,omitempty"`
+	Types     []string `yaml:"types,omitempty"`
+	MinSize   int64    `yaml:"min_size,omitempty"`
+}
+
+// Compression decides which responses are compressed, and with which encoding.
+type Compression struct {
+	encodings []string
+	types     []string
+	minSize   int64
+}
+
+// NewCompression returns a new Compression from conf.
+func NewCompression(conf *CompressConfig) (*Compression, error) {
+	c := &Compression{
+		encodings: conf.Encodings,
+		types:     conf.Types,
+		minSize:   conf.MinSize,
+	}
+
+	if len(c.encodings) == 0 {
+		c.encodings = DefaultCompressEncodings
+	}
+	for _, encoding := range c.encodings {
+		if !slices.Contains(DefaultCompressEncodings, encoding) {
+			return nil, fmt.Errorf("unknown encoding '%s'", encoding)
+		}
+	}
+
+	if len(c.types) == 0 {
+		c.types = DefaultCompressTypes
+	}
+	if c.minSize <= 0 {
+		c.minSize = DefaultCompressMinSize
+	}
+
+	return c, nil
+}
+
+// Compressible reports whether resp to req can be compressed: it is a complete,
+// unencoded response of an allowed content type, and not known to be smaller than the minimum size.
+func (c *Compression) Compressible(req *http.Request, resp *http.Response) bool {
+	if req.Method == http.MethodHead || !req.ProtoAtLeast(1, 1) || !resp.ProtoAtLeast(1, 1) {
+		return false
+	}
+
+	switch {
+	case resp.StatusCode < http.StatusOK,
+		resp.StatusCode == http.StatusNoContent,
+		resp.StatusCode == http.StatusPartialContent,
+		resp.StatusCode == http.StatusNotModified:
+		return false
+	}
+
+	if encoding := resp.Header.Get("Content-Encoding"); encoding != "" && !strings.EqualFold(encoding, "identity") {
+		return false
+	}
+	if resp.Header.Get("Content-Range") != "" ||
+		strings.Contains(strings.ToLower(resp.Header.Get("Cache-Control")), "no-transform") {
+		return false
+	}
+	if resp.ContentLength >= 0 && resp.ContentLength < c.minSize {
+		return false
+	}
+
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	return slices.ContainsFunc(c.types, func(t string) bool {
+		if prefix, ok := strings.CutSuffix(t, "/*"); ok {
+			return strings.HasPrefix(mediaType, prefix+"/")
+		}
+		return mediaType == t
+	})
+}
+
+// Negotiate returns the encoding to compress with for the Accept-Encoding header acceptEncoding,
+// or an empty string if the client accepts none of them.
+func (c *Compression) Negotiate(acceptEncoding string) string {
+	accepted := make(map[string]float64)
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+				q = parsed
+			}
+		}
+		accepted[name] = q
+	}
+
+	best, bestQ := "", 0.0
+	for _, encoding := range c.encodings {
+		q, ok := accepted[encoding]
+		if !ok {
+			q, ok = accepted["*"]
+		}
+		if ok && q > bestQ {
+			best, bestQ = encoding, q
+		}
+	}
+	return best
+}
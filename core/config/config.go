@@ -3,10 +3,13 @@ package config
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"regexp"
 	"time"
 
+	"github.com/Dyastin-0/tcprp/core/cache"
+	"github.com/Dyastin-0/tcprp/core/geoip"
 	"github.com/Dyastin-0/tcprp/core/limiter"
 	"github.com/Dyastin-0/tcprp/core/metrics"
 	"gopkg.in/yaml.v3"
@@ -18,38 +21,160 @@ type LimiterConfig struct {
 	Cooldown int64 `yaml:"cooldown"`
 }
 
+// ConnLimitConfig represents caps on concurrent connections, in total and per client IP.
+type ConnLimitConfig struct {
+	Max          int           `yaml:"max,omitempty"`
+	PerIP        int           `yaml:"per_ip,omitempty"`
+	Mode         string        `yaml:"mode,omitempty"`
+	QueueTimeout time.Duration `yaml:"queue_timeout,omitempty"`
+}
+
+// GeoIPConfig represents the MaxMind databases client IPs are looked up in,
+// such as a country and an ASN database.
+type GeoIPConfig struct {
+	Databases []string `yaml:"databases"`
+}
+
+// LimiterStoreConfig represents a store sharing rate limits between tcprp instances.
+type LimiterStoreConfig struct {
+	// Redis is a redis:// or rediss:// url.
+	Redis   string        `yaml:"redis"`
+	Prefix  string        `yaml:"prefix,omitempty"`
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+}
+
+// BandwidthConfig represents bandwidth caps per connection, per client IP and for the whole proxy.
+type BandwidthConfig struct {
+	PerConn *BandwidthLimitConfig `yaml:"per_conn,omitempty"`
+	PerIP   *BandwidthLimitConfig `yaml:"per_ip,omitempty"`
+	Total   *BandwidthLimitConfig `yaml:"total,omitempty"`
+}
+
+// BandwidthLimitConfig represents a cap in bytes per second for each direction,
+// upload being from the client to the target.
+type BandwidthLimitConfig struct {
+	Upload   int `yaml:"upload,omitempty"`
+	Download int `yaml:"download,omitempty"`
+	Burst    int `yaml:"burst,omitempty"`
+}
+
+type StickyConfig struct {
+	Mode string `yaml:"mode"`
+	Name string `yaml:"name,omitempty"`
+}
+
+type SplitConfig struct {
+	Target string        `yaml:"target"`
+	Weight int           `yaml:"weight"`
+	Sticky *StickyConfig `yaml:"sticky,omitempty"`
+}
+
+type FingerprintRuleConfig struct {
+	JA3     string         `yaml:"ja3,omitempty"`
+	JA4     string         `yaml:"ja4,omitempty"`
+	Action  string         `yaml:"action"`
+	Limiter *LimiterConfig `yaml:"rate_limit,omitempty"`
+}
+
+type ALPNRouteConfig struct {
+	Protocols []string `yaml:"protocols"`
+	Target    string   `yaml:"target"`
+}
+
 type RouteConfig struct {
-	Pattern     string         `yaml:"pattern"`
-	Target      string         `yaml:"target"`
-	Terminate   bool           `yaml:"terminate,omitempty"`
-	RewriteRule *RewriteRule   `yaml:"rewrite,omitempty"`
-	Limiter     *LimiterConfig `yaml:"rate_limit,omitempty"`
+	Pattern      string              `yaml:"pattern"`
+	Target       string              `yaml:"target,omitempty"`
+	Respond      *RespondConfig      `yaml:"respond,omitempty"`
+	Redirect     *RedirectConfig     `yaml:"redirect,omitempty"`
+	Terminate    *bool               `yaml:"terminate,omitempty"`
+	RewriteRule  *RewriteRule        `yaml:"rewrite,omitempty"`
+	Limiter      *LimiterConfig      `yaml:"rate_limit,omitempty"`
+	Access       *AccessConfig       `yaml:"access,omitempty"`
+	Geo          *GeoMatchConfig     `yaml:"geo,omitempty"`
+	ConnLimit    *ConnLimitConfig    `yaml:"max_conns,omitempty"`
+	RequestLimit *RequestLimitConfig `yaml:"request_limit,omitempty"`
+	Auth         *AuthConfig         `yaml:"auth,omitempty"`
+	AuthRequest  *AuthRequestConfig  `yaml:"auth_request,omitempty"`
+	Cache        *CacheConfig        `yaml:"cache,omitempty"`
+	Compress     *CompressConfig     `yaml:"compress,omitempty"`
+	WAF          *WAFConfig          `yaml:"waf,omitempty"`
+	WebSocket    *WebSocketConfig    `yaml:"websocket,omitempty"`
+	Split        *SplitConfig        `yaml:"split,omitempty"`
+	Headers      *HeaderRules        `yaml:"headers,omitempty"`
+	Limits       RequestLimits       `yaml:",inline"`
 }
 
 type ProxyConfig struct {
-	Target    string         `yaml:"target"`
-	Proto     string         `yaml:"proto"`
-	Terminate bool           `yaml:"terminate,omitempty"`
-	Routes    []*RouteConfig `yaml:"routes,omitempty"`
-	Limiter   *LimiterConfig `yaml:"rate_limit,omitempty"`
+	Target       string                      `yaml:"target,omitempty"`
+	Respond      *RespondConfig              `yaml:"respond,omitempty"`
+	Redirect     *RedirectConfig             `yaml:"redirect,omitempty"`
+	Maintenance  *MaintenanceConfig          `yaml:"maintenance,omitempty"`
+	Proto        string                      `yaml:"proto"`
+	Terminate    bool                        `yaml:"terminate,omitempty"`
+	Routes       []*RouteConfig              `yaml:"routes,omitempty"`
+	ALPNRoutes   []*ALPNRouteConfig          `yaml:"alpn,omitempty"`
+	Fingerprints []*FingerprintRuleConfig    `yaml:"fingerprints,omitempty"`
+	ECHKeys      []*ECHKeyConfig             `yaml:"ech_keys,omitempty"`
+	Timeouts     *Timeouts                   `yaml:"timeouts,omitempty"`
+	Limiter      *LimiterConfig              `yaml:"rate_limit,omitempty"`
+	Access       *AccessConfig               `yaml:"access,omitempty"`
+	Bandwidth    *BandwidthConfig            `yaml:"bandwidth,omitempty"`
+	ConnLimit    *ConnLimitConfig            `yaml:"max_conns,omitempty"`
+	RequestLimit *RequestLimitConfig         `yaml:"request_limit,omitempty"`
+	Auth         *AuthConfig                 `yaml:"auth,omitempty"`
+	AuthRequest  *AuthRequestConfig          `yaml:"auth_request,omitempty"`
+	Cache        *CacheConfig                `yaml:"cache,omitempty"`
+	Compress     *CompressConfig             `yaml:"compress,omitempty"`
+	WAF          *WAFConfig                  `yaml:"waf,omitempty"`
+	WebSocket    *WebSocketConfig            `yaml:"websocket,omitempty"`
+	Split        *SplitConfig                `yaml:"split,omitempty"`
+	Headers      *HeaderRules                `yaml:"headers,omitempty"`
+	ErrorPages   map[string]*ErrorPageConfig `yaml:"error_pages,omitempty"`
+	Limits       RequestLimits               `yaml:",inline"`
 }
 
 // ConfigFile represents the YAML structure.
 type ConfigFile struct {
-	Proxies       map[string]ProxyConfig `yaml:"proxies"`
-	GlobalLimiter *LimiterConfig         `yaml:"global_rate_limit,omitempty"`
+	Proxies         map[string]ProxyConfig       `yaml:"proxies"`
+	GlobalLimiter   *LimiterConfig               `yaml:"global_rate_limit,omitempty"`
+	GlobalConnLimit *ConnLimitConfig             `yaml:"global_max_conns,omitempty"`
+	Access          *AccessConfig                `yaml:"access,omitempty"`
+	GeoIP           *GeoIPConfig                 `yaml:"geoip,omitempty"`
+	CacheStores     map[string]*CacheStoreConfig `yaml:"cache_stores,omitempty"`
+	LimiterStore    *LimiterStoreConfig          `yaml:"rate_limit_store,omitempty"`
+	Janitor         *JanitorConfig               `yaml:"rate_limit_janitor,omitempty"`
+	ECHPolicy       string                       `yaml:"ech_policy,omitempty"`
+	Timeouts        *Timeouts                    `yaml:"timeouts,omitempty"`
 }
 
 // Config holds the loaded configuration.
 type Config struct {
-	Proxies       *Trie[*Proxy]
-	GlobalLimiter *limiter.Limiter
+	Proxies           *Trie[*Proxy]
+	GlobalLimiter     *limiter.Limiter
+	GlobalConnLimiter *limiter.ConnLimiter
+	Access            *AccessList
+	GeoIP             *geoip.DB
+	// LimiterStore shares the buckets of the rate limiters, kept in process if nil.
+	LimiterStore limiter.Store
+	Janitor      JanitorConfig
+
+	limiters    []*limiter.Limiter
+	cacheStores map[string]cache.Store
+	// closers are closed with the limiters when the config is reloaded or closed.
+	closers   []io.Closer
+	ECHPolicy string
+	Timeouts  Timeouts
 }
 
+// DefaultLimiterStoreTimeout is how long rate limiters wait for their store before using local buckets.
+const DefaultLimiterStoreTimeout = 50 * time.Millisecond
+
 // New creates a new configuration instance.
 func New() *Config {
 	return &Config{
-		Proxies: NewTrie[*Proxy](),
+		Proxies:  NewTrie[*Proxy](),
+		Timeouts: DefaultTimeouts,
+		Janitor:  DefaultJanitor,
 	}
 }
 
@@ -71,76 +196,554 @@ func (c *Config) LoadBytes(data []byte) error {
 	return c.loadProxies(configFile)
 }
 
-// loadProxies loads proxy configurations into the trie.
+// loadProxies loads configFile into a new config, which replaces c and has its proxies set
+// in the trie only once it succeeds, releasing what the previous load built.
+// A failed load leaves c as it was.
 func (c *Config) loadProxies(configFile ConfigFile) error {
+	next := &Config{Proxies: c.Proxies}
+
+	proxies, err := next.load(configFile)
+	if err != nil {
+		// Nothing refers to what a failed load built.
+		next.release(nil)
+		return err
+	}
+
+	previous := *c
+	*c = *next
+	for domain, p := range proxies {
+		c.Proxies.Set(domain, p)
+	}
+
+	previous.release(c.LimiterStore)
+	return nil
+}
+
+// Close stops the janitors of the config's limiters, and closes its limiter store,
+// GeoIP databases, cache stores, the connections of its auth requests
+// and the reloading of its access list files.
+func (c *Config) Close() error {
+	c.release(nil)
+	return nil
+}
+
+// release stops the limiters of c and closes what it built, except keep,
+// the limiter store of the config replacing c.
+func (c *Config) release(keep limiter.Store) {
+	stopLimiters(c.limiters, c.LimiterStore, keep)
+	for _, closer := range c.closers {
+		closer.Close()
+	}
+	c.limiters, c.closers = nil, nil
+}
+
+// load loads configFile into the config, which must be new,
+// and returns its proxies by domain.
+func (c *Config) load(configFile ConfigFile) (map[string]*Proxy, error) {
+	switch configFile.ECHPolicy {
+	case "", ECHOuter:
+		c.ECHPolicy = ECHOuter
+	case ECHReject:
+		c.ECHPolicy = ECHReject
+	default:
+		return nil, fmt.Errorf("unknown ech policy '%s'", configFile.ECHPolicy)
+	}
+
+	c.Timeouts = DefaultTimeouts
+	if configFile.Timeouts != nil {
+		c.Timeouts = configFile.Timeouts.inherit(DefaultTimeouts)
+	}
+
+	c.Janitor = DefaultJanitor
+	if configFile.Janitor != nil {
+		janitor, err := configFile.Janitor.inherit(DefaultJanitor)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rate limit janitor: %w", err)
+		}
+		c.Janitor = janitor
+	}
+
+	if configFile.LimiterStore != nil {
+		store, err := configFile.LimiterStore.newStore()
+		if err != nil {
+			return nil, fmt.Errorf("invalid rate limit store: %w", err)
+		}
+		c.LimiterStore = store
+	}
+
+	if configFile.GeoIP != nil {
+		if len(configFile.GeoIP.Databases) == 0 {
+			return nil, fmt.Errorf("geoip requires at least one database")
+		}
+		db, err := geoip.Open(configFile.GeoIP.Databases...)
+		if err != nil {
+			return nil, err
+		}
+		c.GeoIP = db
+		c.closers = append(c.closers, db)
+	}
+
+	c.cacheStores = make(map[string]cache.Store, len(configFile.CacheStores))
+	for name, storeConf := range configFile.CacheStores {
+		store, err := newCacheStore(storeConf)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cache store '%s': %w", name, err)
+		}
+		c.cacheStores[name] = store
+		c.closers = append(c.closers, store)
+	}
+
+	if configFile.Access != nil {
+		access, err := NewAccessList(configFile.Access, c.GeoIP)
+		if err != nil {
+			return nil, fmt.Errorf("invalid global access list: %w", err)
+		}
+		c.Access = access
+		c.closers = append(c.closers, access)
+	}
+
 	if configFile.GlobalLimiter != nil {
-		c.GlobalLimiter = limiter.New(
+		c.GlobalLimiter = c.newLimiter("global",
 			limiter.WithBurst(configFile.GlobalLimiter.Burst),
 			limiter.WithRPS(configFile.GlobalLimiter.Rate),
 			limiter.WithCooldown(time.Duration(configFile.GlobalLimiter.Cooldown)*time.Minute),
 		)
 	}
 
+	if configFile.GlobalConnLimit != nil {
+		connLimiter, err := configFile.GlobalConnLimit.newConnLimiter()
+		if err != nil {
+			return nil, fmt.Errorf("invalid global connection limit: %w", err)
+		}
+		c.GlobalConnLimiter = connLimiter
+	}
+
+	proxies := make(map[string]*Proxy, len(configFile.Proxies))
 	for domain, proxy := range configFile.Proxies {
-		if proxy.Target == "" {
-			return fmt.Errorf("empty target for domain '%s'", domain)
+		if err := validateAction(proxy.Target, proxy.Respond, proxy.Redirect); err != nil {
+			return nil, fmt.Errorf("%w for domain '%s'", err, domain)
+		}
+		if proxy.Target == "" && (!proxy.Terminate || proxy.Proto != "http") {
+			return nil, fmt.Errorf("respond and redirect require terminate and proto http for domain '%s'", domain)
 		}
 
 		p := &Proxy{
 			Proto:     proxy.Proto,
 			Target:    proxy.Target,
+			Respond:   proxy.Respond,
+			Redirect:  proxy.Redirect,
 			Terminate: proxy.Terminate,
+			Headers:   proxy.Headers,
+			Timeouts:  c.Timeouts,
+			Limits:    DefaultRequestLimits,
 			Metrics:   metrics.New(),
+			GeoIP:     c.GeoIP,
+		}
+
+		if proxy.Timeouts != nil {
+			p.Timeouts = proxy.Timeouts.inherit(c.Timeouts)
+		}
+
+		if !proxy.Limits.isZero() {
+			if !proxy.Terminate || proxy.Proto != "http" {
+				return nil, fmt.Errorf("request limits require terminate and proto http for domain '%s'", domain)
+			}
+			if err := proxy.Limits.validate(); err != nil {
+				return nil, fmt.Errorf("%w for domain '%s'", err, domain)
+			}
+			p.Limits = proxy.Limits.inherit(DefaultRequestLimits)
 		}
 
 		if proxy.Limiter != nil {
-			p.Limiter = limiter.New(
+			p.Limiter = c.newLimiter(domain,
 				limiter.WithBurst(proxy.Limiter.Burst),
 				limiter.WithRPS(proxy.Limiter.Rate),
 				limiter.WithCooldown(time.Duration(proxy.Limiter.Cooldown)*time.Minute),
 			)
 		}
 
+		if proxy.Access != nil {
+			access, err := NewAccessList(proxy.Access, c.GeoIP)
+			if err != nil {
+				return nil, fmt.Errorf("invalid access list for domain '%s': %w", domain, err)
+			}
+			p.Access = access
+			c.closers = append(c.closers, access)
+		}
+
+		if proxy.Bandwidth != nil {
+			if err := proxy.Bandwidth.validate(); err != nil {
+				return nil, fmt.Errorf("invalid bandwidth for domain '%s': %w", domain, err)
+			}
+			p.Upload, p.Download = proxy.Bandwidth.newBandwidths()
+		}
+
+		if proxy.ConnLimit != nil {
+			connLimiter, err := proxy.ConnLimit.newConnLimiter()
+			if err != nil {
+				return nil, fmt.Errorf("invalid connection limit for domain '%s': %w", domain, err)
+			}
+			p.ConnLimiter = connLimiter
+		}
+
+		if proxy.RequestLimit != nil {
+			requestLimiter, err := newRequestLimiter(proxy.RequestLimit, c.newLimiter, domain+" request")
+			if err != nil {
+				return nil, fmt.Errorf("invalid request limit for domain '%s': %w", domain, err)
+			}
+			p.RequestLimiter = requestLimiter
+		}
+
+		if proxy.Auth != nil {
+			if !proxy.Terminate || proxy.Proto != "http" {
+				return nil, fmt.Errorf("auth requires terminate and proto http for domain '%s'", domain)
+			}
+			auth, err := NewAuth(proxy.Auth)
+			if err != nil {
+				return nil, fmt.Errorf("invalid auth for domain '%s': %w", domain, err)
+			}
+			p.Auth = auth
+		}
+
+		if proxy.AuthRequest != nil {
+			if !proxy.Terminate || proxy.Proto != "http" {
+				return nil, fmt.Errorf("auth request requires terminate and proto http for domain '%s'", domain)
+			}
+			authRequest, err := NewAuthRequest(proxy.AuthRequest)
+			if err != nil {
+				return nil, fmt.Errorf("invalid auth request for domain '%s': %w", domain, err)
+			}
+			p.AuthRequest = authRequest
+			c.closers = append(c.closers, authRequest)
+		}
+
+		if proxy.Cache != nil {
+			if !proxy.Terminate || proxy.Proto != "http" {
+				return nil, fmt.Errorf("cache requires terminate and proto http for domain '%s'", domain)
+			}
+			responseCache, err := c.newCache(proxy.Cache)
+			if err != nil {
+				return nil, fmt.Errorf("invalid cache for domain '%s': %w", domain, err)
+			}
+			p.Cache = responseCache
+		}
+
+		if proxy.Compress != nil {
+			if !proxy.Terminate || proxy.Proto != "http" {
+				return nil, fmt.Errorf("compress requires terminate and proto http for domain '%s'", domain)
+			}
+			compression, err := NewCompression(proxy.Compress)
+			if err != nil {
+				return nil, fmt.Errorf("invalid compress for domain '%s': %w", domain, err)
+			}
+			p.Compression = compression
+		}
+
+		if proxy.WAF != nil {
+			if !proxy.Terminate || proxy.Proto != "http" {
+				return nil, fmt.Errorf("waf requires terminate and proto http for domain '%s'", domain)
+			}
+			engine, err := NewWAF(proxy.WAF)
+			if err != nil {
+				return nil, fmt.Errorf("invalid waf for domain '%s': %w", domain, err)
+			}
+			p.WAF = engine
+		}
+
+		if proxy.WebSocket != nil {
+			if !proxy.Terminate || proxy.Proto != "http" {
+				return nil, fmt.Errorf("websocket requires terminate and proto http for domain '%s'", domain)
+			}
+			ws, err := NewWebSocket(proxy.WebSocket, p.Timeouts.StreamIdle)
+			if err != nil {
+				return nil, fmt.Errorf("invalid websocket for domain '%s': %w", domain, err)
+			}
+			p.WebSocket = ws
+		}
+
+		for _, alpnConf := range proxy.ALPNRoutes {
+			if len(alpnConf.Protocols) == 0 {
+				return nil, fmt.Errorf("empty protocols for alpn route in domain '%s'", domain)
+			}
+			if alpnConf.Target == "" {
+				return nil, fmt.Errorf("empty target for alpn route %v in domain '%s'", alpnConf.Protocols, domain)
+			}
+			p.ALPNRoutes = append(p.ALPNRoutes, &ALPNRoute{
+				Protocols: alpnConf.Protocols,
+				Target:    alpnConf.Target,
+			})
+		}
+
+		if len(proxy.ECHKeys) > 0 {
+			if !proxy.Terminate {
+				return nil, fmt.Errorf("ech keys require terminate for domain '%s'", domain)
+			}
+			keys, err := newECHKeys(proxy.ECHKeys)
+			if err != nil {
+				return nil, fmt.Errorf("%w for domain '%s'", err, domain)
+			}
+			p.ECHKeys = keys
+		}
+
+		for i, ruleConf := range proxy.Fingerprints {
+			rule, err := newFingerprintRule(ruleConf, c.newLimiter, fmt.Sprintf("%s fingerprint %d", domain, i))
+			if err != nil {
+				return nil, fmt.Errorf("invalid fingerprint rule for domain '%s': %w", domain, err)
+			}
+			p.Fingerprints = append(p.Fingerprints, rule)
+		}
+
+		if proxy.Maintenance != nil {
+			maintenance, err := NewMaintenance(proxy.Maintenance)
+			if err != nil {
+				return nil, fmt.Errorf("invalid maintenance for domain '%s': %w", domain, err)
+			}
+			p.Maintenance = maintenance
+		}
+
+		if len(proxy.ErrorPages) > 0 {
+			pages, err := NewErrorPages(proxy.ErrorPages)
+			if err != nil {
+				return nil, fmt.Errorf("invalid error pages for domain '%s': %w", domain, err)
+			}
+			p.ErrorPages = pages
+		}
+
+		if proxy.Split != nil {
+			split, err := NewSplit(proxy.Split.Target, proxy.Split.Weight, proxy.Split.Sticky)
+			if err != nil {
+				return nil, fmt.Errorf("invalid split for domain '%s': %w", domain, err)
+			}
+			p.Split = split
+		}
+
 		if len(proxy.Routes) > 0 {
 			p.Routes = make([]*Route, len(proxy.Routes))
 			for i, routeConf := range proxy.Routes {
+				// Paths are only known after termination, which is decided per domain,
+				// so a route cannot terminate differently from its domain.
+				if routeConf.Terminate != nil && *routeConf.Terminate != proxy.Terminate {
+					return nil, fmt.Errorf("route '%s' in domain '%s' sets terminate to %t, but termination is decided per domain",
+						routeConf.Pattern, domain, *routeConf.Terminate)
+				}
+
 				route := &Route{
 					Target:      routeConf.Target,
-					Terminate:   routeConf.Terminate,
+					Respond:     routeConf.Respond,
+					Redirect:    routeConf.Redirect,
+					Terminate:   proxy.Terminate,
 					Pattern:     routeConf.Pattern,
 					RewriteRule: routeConf.RewriteRule,
+					Headers:     routeConf.Headers,
+					Limits:      p.Limits,
+				}
+
+				if !routeConf.Limits.isZero() {
+					if !proxy.Terminate || proxy.Proto != "http" {
+						return nil, fmt.Errorf("request limits of route '%s' require terminate and proto http for domain '%s'", routeConf.Pattern, domain)
+					}
+					if err := routeConf.Limits.validate(); err != nil {
+						return nil, fmt.Errorf("%w for route '%s' in domain '%s'", err, routeConf.Pattern, domain)
+					}
+					route.Limits = routeConf.Limits.inherit(p.Limits)
 				}
 
 				if routeConf.Limiter != nil {
-					route.Limiter = limiter.New(
+					route.Limiter = c.newLimiter(domain+routeConf.Pattern,
 						limiter.WithBurst(routeConf.Limiter.Burst),
 						limiter.WithRPS(routeConf.Limiter.Rate),
 						limiter.WithCooldown(time.Duration(routeConf.Limiter.Cooldown)*time.Minute),
 					)
 				}
 
+				if routeConf.Access != nil {
+					access, err := NewAccessList(routeConf.Access, c.GeoIP)
+					if err != nil {
+						return nil, fmt.Errorf("invalid access list for route '%s' in domain '%s': %w", routeConf.Pattern, domain, err)
+					}
+					route.Access = access
+					c.closers = append(c.closers, access)
+				}
+
+				if routeConf.Geo != nil {
+					if c.GeoIP == nil {
+						return nil, fmt.Errorf("geo match of route '%s' in domain '%s' requires geoip databases", routeConf.Pattern, domain)
+					}
+					route.Geo = newGeoMatch(routeConf.Geo.Countries, routeConf.Geo.ASNs)
+				}
+
+				if routeConf.ConnLimit != nil {
+					connLimiter, err := routeConf.ConnLimit.newConnLimiter()
+					if err != nil {
+						return nil, fmt.Errorf("invalid connection limit for route '%s' in domain '%s': %w", routeConf.Pattern, domain, err)
+					}
+					route.ConnLimiter = connLimiter
+				}
+
+				if routeConf.RequestLimit != nil {
+					requestLimiter, err := newRequestLimiter(routeConf.RequestLimit, c.newLimiter, domain+routeConf.Pattern+" request")
+					if err != nil {
+						return nil, fmt.Errorf("invalid request limit for route '%s' in domain '%s': %w", routeConf.Pattern, domain, err)
+					}
+					route.RequestLimiter = requestLimiter
+				}
+
+				if routeConf.Auth != nil {
+					if !proxy.Terminate || proxy.Proto != "http" {
+						return nil, fmt.Errorf("auth of route '%s' requires terminate and proto http for domain '%s'", routeConf.Pattern, domain)
+					}
+					auth, err := NewAuth(routeConf.Auth)
+					if err != nil {
+						return nil, fmt.Errorf("invalid auth for route '%s' in domain '%s': %w", routeConf.Pattern, domain, err)
+					}
+					route.Auth = auth
+				}
+
+				if routeConf.AuthRequest != nil {
+					if !proxy.Terminate || proxy.Proto != "http" {
+						return nil, fmt.Errorf("auth request of route '%s' requires terminate and proto http for domain '%s'", routeConf.Pattern, domain)
+					}
+					authRequest, err := NewAuthRequest(routeConf.AuthRequest)
+					if err != nil {
+						return nil, fmt.Errorf("invalid auth request for route '%s' in domain '%s': %w", routeConf.Pattern, domain, err)
+					}
+					route.AuthRequest = authRequest
+					c.closers = append(c.closers, authRequest)
+				}
+
+				if routeConf.Cache != nil {
+					if !proxy.Terminate || proxy.Proto != "http" {
+						return nil, fmt.Errorf("cache of route '%s' requires terminate and proto http for domain '%s'", routeConf.Pattern, domain)
+					}
+					responseCache, err := c.newCache(routeConf.Cache)
+					if err != nil {
+						return nil, fmt.Errorf("invalid cache for route '%s' in domain '%s': %w", routeConf.Pattern, domain, err)
+					}
+					route.Cache = responseCache
+				}
+
+				if routeConf.Compress != nil {
+					if !proxy.Terminate || proxy.Proto != "http" {
+						return nil, fmt.Errorf("compress of route '%s' requires terminate and proto http for domain '%s'", routeConf.Pattern, domain)
+					}
+					compression, err := NewCompression(routeConf.Compress)
+					if err != nil {
+						return nil, fmt.Errorf("invalid compress for route '%s' in domain '%s': %w", routeConf.Pattern, domain, err)
+					}
+					route.Compression = compression
+				}
+
+				if routeConf.WAF != nil {
+					if !proxy.Terminate || proxy.Proto != "http" {
+						return nil, fmt.Errorf("waf of route '%s' requires terminate and proto http for domain '%s'", routeConf.Pattern, domain)
+					}
+					engine, err := NewWAF(routeConf.WAF)
+					if err != nil {
+						return nil, fmt.Errorf("invalid waf for route '%s' in domain '%s': %w", routeConf.Pattern, domain, err)
+					}
+					route.WAF = engine
+				}
+
+				if routeConf.WebSocket != nil {
+					if !proxy.Terminate || proxy.Proto != "http" {
+						return nil, fmt.Errorf("websocket of route '%s' requires terminate and proto http for domain '%s'", routeConf.Pattern, domain)
+					}
+					ws, err := NewWebSocket(routeConf.WebSocket, p.Timeouts.StreamIdle)
+					if err != nil {
+						return nil, fmt.Errorf("invalid websocket for route '%s' in domain '%s': %w", routeConf.Pattern, domain, err)
+					}
+					route.WebSocket = ws
+				}
+
+				if routeConf.Split != nil {
+					split, err := NewSplit(routeConf.Split.Target, routeConf.Split.Weight, routeConf.Split.Sticky)
+					if err != nil {
+						return nil, fmt.Errorf("invalid split for route '%s' in domain '%s': %w", routeConf.Pattern, domain, err)
+					}
+					route.Split = split
+				}
+
 				p.Routes[i] = route
 			}
 
 			for _, route := range p.Routes {
-				if route.Target == "" {
-					return fmt.Errorf("empty target for route '%s' in domain '%s'", route.Pattern, domain)
+				if err := validateAction(route.Target, route.Respond, route.Redirect); err != nil {
+					return nil, fmt.Errorf("%w for route '%s' in domain '%s'", err, route.Pattern, domain)
 				}
 				if route.RewriteRule != nil && route.RewriteRule.From != "" {
 					if _, err := regexp.Compile(route.RewriteRule.From); err != nil {
-						return fmt.Errorf("invalid regex '%s' in rewrite rule for domain '%s': %w",
+						return nil, fmt.Errorf("invalid regex '%s' in rewrite rule for domain '%s': %w",
 							route.RewriteRule.From, domain, err)
 					}
 				}
+				if route.RewriteRule != nil && route.RewriteRule.Query != nil {
+					if err := route.RewriteRule.Query.validate(); err != nil {
+						return nil, fmt.Errorf("invalid query rewrite for route '%s' in domain '%s': %w", route.Pattern, domain, err)
+					}
+				}
 			}
 		}
 
 		p.sortRoutes()
-		c.Proxies.Set(domain, p)
+		proxies[domain] = p
+	}
+	return proxies, nil
+}
+
+// newStore returns the store of the config.
+func (c *LimiterStoreConfig) newStore() (limiter.Store, error) {
+	if c.Redis == "" {
+		return nil, fmt.Errorf("empty redis url")
+	}
+
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = DefaultLimiterStoreTimeout
+	}
+
+	prefix := c.Prefix
+	if prefix == "" {
+		prefix = "tcprp:"
+	}
+
+	return limiter.NewRedisStore(c.Redis, prefix, timeout)
+}
+
+// validate checks that no bandwidth cap is negative.
+func (c *BandwidthConfig) validate() error {
+	for _, limit := range []*BandwidthLimitConfig{c.PerConn, c.PerIP, c.Total} {
+		if limit != nil && (limit.Upload < 0 || limit.Download < 0 || limit.Burst < 0) {
+			return fmt.Errorf("negative bandwidth cap")
+		}
 	}
 	return nil
 }
 
+// newBandwidths returns the upload and download Bandwidth of the config.
+func (c *BandwidthConfig) newBandwidths() (*limiter.Bandwidth, *limiter.Bandwidth) {
+	limits := func(limit *BandwidthLimitConfig) (limiter.BandwidthLimit, limiter.BandwidthLimit) {
+		if limit == nil {
+			return limiter.BandwidthLimit{}, limiter.BandwidthLimit{}
+		}
+		return limiter.BandwidthLimit{Rate: limit.Upload, Burst: limit.Burst},
+			limiter.BandwidthLimit{Rate: limit.Download, Burst: limit.Burst}
+	}
+
+	connUp, connDown := limits(c.PerConn)
+	ipUp, ipDown := limits(c.PerIP)
+	totalUp, totalDown := limits(c.Total)
+
+	return limiter.NewBandwidth(connUp, ipUp, totalUp), limiter.NewBandwidth(connDown, ipDown, totalDown)
+}
+
+// newConnLimiter returns a new ConnLimiter from the config.
+func (c *ConnLimitConfig) newConnLimiter() (*limiter.ConnLimiter, error) {
+	if c.Max < 0 || c.PerIP < 0 {
+		return nil, fmt.Errorf("negative connection cap")
+	}
+	return limiter.NewConnLimiter(c.Max, c.PerIP, c.Mode, c.QueueTimeout)
+}
+
 // GetProxy finds a proxy for the given domain.
 func (c *Config) GetProxy(domain string) *Proxy {
 	if proxy := c.Proxies.Get(domain); proxy != nil {
@@ -154,14 +757,56 @@ func (c *Config) GetProxy(domain string) *Proxy {
 	return nil
 }
 
+// SetSplitWeight sets the split weight of the route matching pattern in domain.
+// An empty pattern sets the weight of the domain's own split.
+func (c *Config) SetSplitWeight(domain, pattern string, weight int) error {
+	proxy := c.Proxies.Get(domain)
+	if proxy == nil {
+		return fmt.Errorf("no proxy found for domain '%s'", domain)
+	}
+
+	split := (*proxy).Split
+	if pattern != "" {
+		split = nil
+		for _, route := range (*proxy).Routes {
+			if route.Pattern == pattern {
+				split = route.Split
+				break
+			}
+		}
+	}
+
+	if split == nil {
+		return fmt.Errorf("no split found for pattern '%s' in domain '%s'", pattern, domain)
+	}
+
+	return split.SetWeight(weight)
+}
+
+// SetMaintenance toggles the maintenance page of domain.
+func (c *Config) SetMaintenance(domain string, enabled bool) error {
+	proxy := c.Proxies.Get(domain)
+	if proxy == nil {
+		return fmt.Errorf("no proxy found for domain '%s'", domain)
+	}
+
+	if (*proxy).Maintenance == nil {
+		return fmt.Errorf("no maintenance page configured for domain '%s'", domain)
+	}
+
+	(*proxy).Maintenance.SetEnabled(enabled)
+	return nil
+}
+
 // AddProxy adds a single proxy configuration to the given domain.
 func (c *Config) AddProxy(domain, target string) error {
 	if target == "" {
 		return fmt.Errorf("target cannot be empty")
 	}
 	proxy := &Proxy{
-		Target:  target,
-		Metrics: metrics.New(),
+		Target:   target,
+		Timeouts: c.Timeouts,
+		Metrics:  metrics.New(),
 	}
 	c.Proxies.Set(domain, proxy)
 	return nil
@@ -174,21 +819,31 @@ func (c *Config) AddProxyWithRoutes(domain, target string, routes []*Route) erro
 	}
 
 	proxy := &Proxy{
-		Target:  target,
-		Metrics: metrics.New(),
-		Routes:  make([]*Route, len(routes)),
+		Target:   target,
+		Timeouts: c.Timeouts,
+		Metrics:  metrics.New(),
+		Routes:   make([]*Route, len(routes)),
 	}
 
 	// Validate and copy routes
 	for i, route := range routes {
-		if route.Target == "" {
-			return fmt.Errorf("empty target for route '%s'", route.Pattern)
+		if route.Terminate != proxy.Terminate {
+			return fmt.Errorf("route '%s' sets terminate to %t, but termination is decided per domain",
+				route.Pattern, route.Terminate)
+		}
+		if err := validateAction(route.Target, route.Respond, route.Redirect); err != nil {
+			return fmt.Errorf("%w for route '%s'", err, route.Pattern)
 		}
 		if route.RewriteRule != nil && route.RewriteRule.From != "" {
 			if _, err := regexp.Compile(route.RewriteRule.From); err != nil {
 				return fmt.Errorf("invalid regex '%s' in rewrite rule: %w", route.RewriteRule.From, err)
 			}
 		}
+		if route.RewriteRule != nil && route.RewriteRule.Query != nil {
+			if err := route.RewriteRule.Query.validate(); err != nil {
+				return fmt.Errorf("invalid query rewrite for route '%s': %w", route.Pattern, err)
+			}
+		}
 		proxy.Routes[i] = route
 	}
 
@@ -0,0 +1,48 @@
+package config
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+)
+
+// ECH policies for connections whose ClientHello is encrypted
+// and cannot be decrypted by the outer SNI's proxy.
+const (
+	// ECHOuter routes on the outer SNI, the client-facing public name.
+	ECHOuter = "outer"
+	// ECHReject closes the connection. Browsers send GREASE ECH extensions,
+	// so this rejects them too unless the public name can decrypt.
+	ECHReject = "reject"
+)
+
+// ECHKeyConfig represents an ECH key pair, both base64 encoded.
+type ECHKeyConfig struct {
+	// Config is a marshalled ECHConfig, as published to clients.
+	Config string `yaml:"config"`
+	// PrivateKey is the marshalled HPKE private key of Config.
+	PrivateKey string `yaml:"private_key"`
+	// Retry sends Config to clients whose ECH was rejected.
+	Retry bool `yaml:"retry,omitempty"`
+}
+
+// newECHKeys decodes the ECH keys in conf.
+func newECHKeys(conf []*ECHKeyConfig) ([]tls.EncryptedClientHelloKey, error) {
+	keys := make([]tls.EncryptedClientHelloKey, len(conf))
+	for i, keyConf := range conf {
+		config, err := base64.StdEncoding.DecodeString(keyConf.Config)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ech config: %w", err)
+		}
+		privateKey, err := base64.StdEncoding.DecodeString(keyConf.PrivateKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ech private key: %w", err)
+		}
+		keys[i] = tls.EncryptedClientHelloKey{
+			Config:      config,
+			PrivateKey:  privateKey,
+			SendAsRetry: keyConf.Retry,
+		}
+	}
+	return keys, nil
+}
@@ -0,0 +1,155 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	htmltemplate "html/template"
+	"mime"
+	"os"
+	"strconv"
+	"strings"
+	texttemplate "text/template"
+)
+
+// ErrorPageConfig represents the templates of an error page.
+// Templates are given inline or as files, and are executed with ErrorData.
+type ErrorPageConfig struct {
+	HTML     string `yaml:"html,omitempty"`
+	HTMLFile string `yaml:"html_file,omitempty"`
+	JSON     string `yaml:"json,omitempty"`
+	JSONFile string `yaml:"json_file,omitempty"`
+}
+
+// ErrorData is the data an error page template is executed with.
+type ErrorData struct {
+	Status     int
+	StatusText string
+	Message    string
+	RequestID  string
+}
+
+// ErrorPage holds the parsed templates of an error page.
+type ErrorPage struct {
+	html *htmltemplate.Template
+	json *texttemplate.Template
+}
+
+// ErrorPages holds error pages keyed by status code ("502"),
+// status class ("5xx") or "default".
+type ErrorPages map[string]*ErrorPage
+
+// NewErrorPages parses the error page templates in conf.
+func NewErrorPages(conf map[string]*ErrorPageConfig) (ErrorPages, error) {
+	pages := make(ErrorPages, len(conf))
+
+	for key, pageConf := range conf {
+		page := &ErrorPage{}
+
+		html, err := templateSource(pageConf.HTML, pageConf.HTMLFile)
+		if err != nil {
+			return nil, err
+		}
+		if html != "" {
+			page.html, err = htmltemplate.New(key).Parse(html)
+			if err != nil {
+				return nil, fmt.Errorf("invalid html error page '%s': %w", key, err)
+			}
+		}
+
+		js, err := templateSource(pageConf.JSON, pageConf.JSONFile)
+		if err != nil {
+			return nil, err
+		}
+		if js != "" {
+			page.json, err = texttemplate.New(key).Funcs(texttemplate.FuncMap{
+				"json": jsonString,
+			}).Parse(js)
+			if err != nil {
+				return nil, fmt.Errorf("invalid json error page '%s': %w", key, err)
+			}
+		}
+
+		pages[key] = page
+	}
+
+	return pages, nil
+}
+
+// Render renders the error page for data.Status, negotiating the format with accept.
+// It returns false if no page is configured for the status.
+func (e ErrorPages) Render(accept string, data ErrorData) (string, []byte, bool) {
+	page := e.lookup(data.Status)
+	if page == nil || (page.html == nil && page.json == nil) {
+		return "", nil, false
+	}
+
+	var buf bytes.Buffer
+
+	if page.json != nil && (page.html == nil || prefersJSON(accept)) {
+		if err := page.json.Execute(&buf, data); err != nil {
+			return "", nil, false
+		}
+		return "application/json", buf.Bytes(), true
+	}
+
+	if err := page.html.Execute(&buf, data); err != nil {
+		return "", nil, false
+	}
+	return "text/html; charset=utf-8", buf.Bytes(), true
+}
+
+// lookup returns the page for status, falling back to its class and the default page.
+func (e ErrorPages) lookup(status int) *ErrorPage {
+	if page, ok := e[strconv.Itoa(status)]; ok {
+		return page
+	}
+	if page, ok := e[strconv.Itoa(status/100)+"xx"]; ok {
+		return page
+	}
+	return e["default"]
+}
+
+// prefersJSON reports whether accept ranks application/json above text/html.
+func prefersJSON(accept string) bool {
+	html, js := -1.0, -1.0
+	for part := range strings.SplitSeq(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				q = f
+			}
+		}
+
+		switch mediaType {
+		case "application/json":
+			js = max(js, q)
+		case "text/html":
+			html = max(html, q)
+		}
+	}
+	return js > html
+}
+
+// templateSource returns the inline template, or the content of file.
+func templateSource(inline, file string) (string, error) {
+	if file == "" {
+		return inline, nil
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return "", fmt.Errorf("failed to read error page: %w", err)
+	}
+	return string(data), nil
+}
+
+// jsonString returns v encoded as JSON.
+func jsonString(v any) (string, error) {
+	data, err := json.Marshal(v)
+	return string(data), err
+}
@@ -0,0 +1,68 @@
+package config
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Dyastin-0/tcprp/core/limiter"
+)
+
+// Fingerprint rule actions.
+const (
+	FingerprintDeny  = "deny"
+	FingerprintLimit = "limit"
+)
+
+// FingerprintRule denies or rate limits connections by TLS fingerprint.
+// A rule matches if either its JA3 hash or its JA4 fingerprint matches.
+type FingerprintRule struct {
+	JA3     string
+	JA4     string
+	Deny    bool
+	Limiter *limiter.Limiter
+}
+
+// newFingerprintRule returns a new FingerprintRule from conf, with a limiter from newLimiter under scope.
+func newFingerprintRule(conf *FingerprintRuleConfig, newLimiter limiterFunc, scope string) (*FingerprintRule, error) {
+	if conf.JA3 == "" && conf.JA4 == "" {
+		return nil, fmt.Errorf("fingerprint rule requires ja3 or ja4")
+	}
+
+	rule := &FingerprintRule{
+		JA3: conf.JA3,
+		JA4: conf.JA4,
+	}
+
+	switch conf.Action {
+	case FingerprintDeny:
+		rule.Deny = true
+	case FingerprintLimit:
+		if conf.Limiter == nil {
+			return nil, fmt.Errorf("fingerprint limit action requires rate_limit")
+		}
+		rule.Limiter = newLimiter(scope,
+			limiter.WithBurst(conf.Limiter.Burst),
+			limiter.WithRPS(conf.Limiter.Rate),
+			limiter.WithCooldown(time.Duration(conf.Limiter.Cooldown)*time.Minute),
+		)
+	default:
+		return nil, fmt.Errorf("unknown fingerprint action '%s'", conf.Action)
+	}
+
+	return rule, nil
+}
+
+// AllowFingerprint checks if a connection with the given JA3 hash and JA4 fingerprint should be allowed.
+// Connections matching a limit rule share one bucket per fingerprint.
+func (p *Proxy) AllowFingerprint(ja3, ja4 string) bool {
+	for _, rule := range p.Fingerprints {
+		if (rule.JA3 == "" || rule.JA3 != ja3) && (rule.JA4 == "" || rule.JA4 != ja4) {
+			continue
+		}
+		if rule.Deny {
+			return false
+		}
+		return rule.Limiter.AllowKey(ja3 + "|" + ja4)
+	}
+	return true
+}
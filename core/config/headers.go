@@ -0,0 +1,104 @@
+package config
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// HeaderOps represents header set, add and remove operations.
+// Add appends every value of a header, keeping those already present.
+// Values may contain {sni}, {client_ip}, {route}, {client_cert_subject}, {country} and {asn} placeholders.
+type HeaderOps struct {
+	Set    map[string]string       `yaml:"set,omitempty"`
+	Add    map[string]HeaderValues `yaml:"add,omitempty"`
+	Remove []string                `yaml:"remove,omitempty"`
+}
+
+// HeaderValues are the values of a header, given as a single value or a list.
+type HeaderValues []string
+
+// UnmarshalYAML decodes a single value or a list of values.
+func (v *HeaderValues) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		*v = HeaderValues{node.Value}
+		return nil
+	}
+	return node.Decode((*[]string)(v))
+}
+
+// HeaderRules represents request and response header operations.
+type HeaderRules struct {
+	Request  *HeaderOps `yaml:"request,omitempty"`
+	Response *HeaderOps `yaml:"response,omitempty"`
+}
+
+// HeaderVars holds the values of header template placeholders.
+type HeaderVars struct {
+	SNI               string
+	ClientIP          string
+	Route             string
+	ClientCertSubject string
+	// Country and ASN are looked up in the geoip databases, empty and zero if unknown.
+	Country string
+	ASN     uint
+}
+
+// replacer returns a replacer expanding the placeholders in a header value.
+func (v HeaderVars) replacer() *strings.Replacer {
+	var asn string
+	if v.ASN != 0 {
+		asn = strconv.FormatUint(uint64(v.ASN), 10)
+	}
+	return strings.NewReplacer(
+		"{sni}", v.SNI,
+		"{client_ip}", v.ClientIP,
+		"{route}", v.Route,
+		"{client_cert_subject}", v.ClientCertSubject,
+		"{country}", v.Country,
+		"{asn}", asn,
+	)
+}
+
+// Apply applies the operations to h, removing first, then setting, then adding.
+func (o *HeaderOps) Apply(h http.Header, vars HeaderVars) {
+	if o == nil {
+		return
+	}
+
+	for _, name := range o.Remove {
+		h.Del(name)
+	}
+
+	if len(o.Set) == 0 && len(o.Add) == 0 {
+		return
+	}
+
+	r := vars.replacer()
+	for name, value := range o.Set {
+		h.Set(name, r.Replace(value))
+	}
+	for name, values := range o.Add {
+		for _, value := range values {
+			h.Add(name, r.Replace(value))
+		}
+	}
+}
+
+// ApplyRequest applies the request operations to h.
+func (r *HeaderRules) ApplyRequest(h http.Header, vars HeaderVars) {
+	if r == nil {
+		return
+	}
+	r.Request.Apply(h, vars)
+}
+
+// ApplyResponse applies the response operations to h.
+func (r *HeaderRules) ApplyResponse(h http.Header, vars HeaderVars) {
+	if r == nil {
+		return
+	}
+	r.Response.Apply(h, vars)
+}
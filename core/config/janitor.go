@@ -0,0 +1,91 @@
+package config
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/Dyastin-0/tcprp/core/limiter"
+)
+
+// JanitorConfig represents the cleanup of the clients tracked by every rate limiter.
+// Zero values inherit the defaults.
+type JanitorConfig struct {
+	Interval   time.Duration `yaml:"interval,omitempty"`
+	MaxAge     time.Duration `yaml:"max_age,omitempty"`
+	MaxClients int           `yaml:"max_clients,omitempty"`
+	Eviction   string        `yaml:"eviction,omitempty"`
+}
+
+// DefaultJanitor is the janitor of rate limiters unless configured otherwise.
+var DefaultJanitor = JanitorConfig{
+	Interval:   time.Minute,
+	MaxAge:     10 * time.Minute,
+	MaxClients: 100000,
+	Eviction:   limiter.EvictOldest,
+}
+
+// limiterFunc returns a new Limiter, scoped for the limiter store.
+type limiterFunc func(scope string, opts ...limiter.OptFunc) *limiter.Limiter
+
+// inherit returns j with its zero values set from parent.
+func (j JanitorConfig) inherit(parent JanitorConfig) (JanitorConfig, error) {
+	if j.Interval < 0 || j.MaxAge < 0 || j.MaxClients < 0 {
+		return j, fmt.Errorf("negative janitor value")
+	}
+
+	if j.Interval == 0 {
+		j.Interval = parent.Interval
+	}
+	if j.MaxAge == 0 {
+		j.MaxAge = parent.MaxAge
+	}
+	if j.MaxClients == 0 {
+		j.MaxClients = parent.MaxClients
+	}
+
+	switch j.Eviction {
+	case "":
+		j.Eviction = parent.Eviction
+	case limiter.EvictOldest, limiter.EvictReject:
+	default:
+		return j, fmt.Errorf("unknown eviction policy '%s'", j.Eviction)
+	}
+
+	return j, nil
+}
+
+// newLimiter returns a new Limiter with the store and janitor of the config,
+// stopped when the config is reloaded or closed.
+func (c *Config) newLimiter(scope string, opts ...limiter.OptFunc) *limiter.Limiter {
+	opts = append(opts,
+		limiter.WithStore(c.LimiterStore, scope),
+		limiter.WithJanitor(c.Janitor.Interval, c.Janitor.MaxAge),
+		limiter.WithMaxClients(c.Janitor.MaxClients, c.Janitor.Eviction),
+	)
+
+	l := limiter.New(opts...)
+	c.limiters = append(c.limiters, l)
+	return l
+}
+
+// TrackedClients returns the number of clients tracked by the config's limiters,
+// and the number of clients they evicted or rejected at their cap.
+func (c *Config) TrackedClients() (int, uint64) {
+	tracked, evicted := 0, uint64(0)
+	for _, l := range c.limiters {
+		tracked += l.Tracked()
+		evicted += l.Evicted()
+	}
+	return tracked, evicted
+}
+
+// stopLimiters stops limiters, and closes store unless it is still used as keep.
+func stopLimiters(limiters []*limiter.Limiter, store, keep limiter.Store) {
+	for _, l := range limiters {
+		l.Stop()
+	}
+	if closer, ok := store.(io.Closer); ok && store != keep {
+		closer.Close()
+	}
+}
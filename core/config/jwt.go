@@ -0,0 +1,342 @@
+package config
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// errClaimMismatch is returned for a valid token lacking a required claim value.
+var errClaimMismatch = errors.New("claim mismatch")
+
+// jwtAuth verifies bearer tokens.
+type jwtAuth struct {
+	// keys holds every key, tried in turn for tokens without a known key ID.
+	keys      []jwt.VerificationKey
+	byID      map[string]jwt.VerificationKey
+	parser    *jwt.Parser
+	claims    map[string]string
+	forwarded map[string]string
+}
+
+// jwk is a JSON Web Key, holding the members of the supported key types.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	K   string `json:"k"`
+}
+
+// newJWTAuth returns a new jwtAuth from conf. The keys are read when the config is loaded.
+func newJWTAuth(conf *JWTAuthConfig) (*jwtAuth, error) {
+	a := &jwtAuth{
+		byID:      make(map[string]jwt.VerificationKey),
+		claims:    conf.Claims,
+		forwarded: conf.ForwardClaims,
+	}
+
+	for _, path := range conf.Keys {
+		key, err := readPublicKey(path)
+		if err != nil {
+			return nil, err
+		}
+		a.keys = append(a.keys, key)
+	}
+
+	if conf.Secret != "" {
+		a.keys = append(a.keys, []byte(conf.Secret))
+	}
+
+	if conf.JWKSFile != "" {
+		if err := a.readJWKS(conf.JWKSFile); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(a.keys) == 0 {
+		return nil, fmt.Errorf("jwt auth requires keys, a secret or a jwks file")
+	}
+
+	var methods []string
+	for _, key := range a.keys {
+		for _, method := range signingMethods(key) {
+			if !slices.Contains(methods, method) {
+				methods = append(methods, method)
+			}
+		}
+	}
+
+	opts := []jwt.ParserOption{
+		jwt.WithValidMethods(methods),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(conf.Leeway),
+	}
+	if conf.Issuer != "" {
+		opts = append(opts, jwt.WithIssuer(conf.Issuer))
+	}
+	if len(conf.Audience) > 0 {
+		opts = append(opts, jwt.WithAudience(conf.Audience...))
+	}
+	a.parser = jwt.NewParser(opts...)
+
+	return a, nil
+}
+
+// verify verifies token and returns its claims.
+// It returns errClaimMismatch if the token is valid but lacks a required claim value.
+func (a *jwtAuth) verify(token string) (jwt.MapClaims, error) {
+	claims := jwt.MapClaims{}
+	_, err := a.parser.ParseWithClaims(token, claims, a.keyFunc)
+	if err != nil {
+		return nil, err
+	}
+
+	for name, want := range a.claims {
+		if !claimMatches(claims[name], want) {
+			return nil, errClaimMismatch
+		}
+	}
+
+	return claims, nil
+}
+
+// keyFunc returns the key of the ID of token, or every key if it has no known ID.
+func (a *jwtAuth) keyFunc(token *jwt.Token) (any, error) {
+	if id, ok := token.Header["kid"].(string); ok {
+		if key, ok := a.byID[id]; ok {
+			return key, nil
+		}
+	}
+	return jwt.VerificationKeySet{Keys: a.keys}, nil
+}
+
+// forward sets the forwarded claims of claims on h.
+func (a *jwtAuth) forward(h http.Header, claims jwt.MapClaims) {
+	for claim, header := range a.forwarded {
+		if value := claimString(claims[claim]); value != "" {
+			h.Set(header, value)
+		}
+	}
+}
+
+// removeForwarded removes the headers of the forwarded claims from h,
+// so clients cannot send them. It is a no-op on a nil jwtAuth.
+func (a *jwtAuth) removeForwarded(h http.Header) {
+	if a == nil {
+		return
+	}
+	for _, header := range a.forwarded {
+		h.Del(header)
+	}
+}
+
+// claimMatches reports whether the claim value v is want, or is a list containing want.
+func claimMatches(v any, want string) bool {
+	if values, ok := v.([]any); ok {
+		return slices.ContainsFunc(values, func(v any) bool { return claimString(v) == want })
+	}
+	return v != nil && claimString(v) == want
+}
+
+// claimString returns the claim value v as a string, joining lists with commas.
+func claimString(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	case []any:
+		values := make([]string, 0, len(v))
+		for _, value := range v {
+			values = append(values, claimString(value))
+		}
+		return strings.Join(values, ",")
+	default:
+		data, _ := json.Marshal(v)
+		return string(data)
+	}
+}
+
+// signingMethods returns the JWT algorithms verified with key.
+func signingMethods(key jwt.VerificationKey) []string {
+	switch key.(type) {
+	case *rsa.PublicKey:
+		return []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512"}
+	case *ecdsa.PublicKey:
+		return []string{"ES256", "ES384", "ES512"}
+	case ed25519.PublicKey:
+		return []string{"EdDSA"}
+	case []byte:
+		return []string{"HS256", "HS384", "HS512"}
+	}
+	return nil
+}
+
+// readPublicKey reads a PEM public key or certificate from path.
+func readPublicKey(path string) (jwt.VerificationKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no pem block in jwt key '%s'", path)
+	}
+
+	var key crypto.PublicKey
+	switch block.Type {
+	case "PUBLIC KEY":
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	case "CERTIFICATE":
+		var cert *x509.Certificate
+		if cert, err = x509.ParseCertificate(block.Bytes); err == nil {
+			key = cert.PublicKey
+		}
+	default:
+		return nil, fmt.Errorf("unsupported pem block '%s' in jwt key '%s'", block.Type, path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid jwt key '%s': %w", path, err)
+	}
+
+	if signingMethods(key) == nil {
+		return nil, fmt.Errorf("unsupported key type %T in jwt key '%s'", key, path)
+	}
+	return key, nil
+}
+
+// readJWKS adds the signing keys of the JWKS file at path.
+func (a *jwtAuth) readJWKS(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return fmt.Errorf("invalid jwks '%s': %w", path, err)
+	}
+
+	found := false
+	for i, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			return fmt.Errorf("invalid key %d in jwks '%s': %w", i, path, err)
+		}
+		if k.Kid != "" {
+			a.byID[k.Kid] = key
+		}
+		a.keys = append(a.keys, key)
+		found = true
+	}
+
+	if !found {
+		return fmt.Errorf("no signing keys in jwks '%s'", path)
+	}
+	return nil
+}
+
+// publicKey returns the key of k.
+func (k jwk) publicKey() (jwt.VerificationKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeJWKInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeJWKInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("invalid rsa exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve '%s'", k.Crv)
+		}
+		x, err := decodeJWKInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeJWKInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("point not on curve '%s'", k.Crv)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve '%s'", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+
+	case "oct":
+		secret, err := base64.RawURLEncoding.DecodeString(k.K)
+		if err != nil || len(secret) == 0 {
+			return nil, fmt.Errorf("invalid oct key")
+		}
+		return secret, nil
+	}
+
+	return nil, fmt.Errorf("unsupported key type '%s'", k.Kty)
+}
+
+// decodeJWKInt decodes a base64url big-endian integer of a JWK.
+func decodeJWKInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(b) == 0 {
+		return nil, fmt.Errorf("invalid key parameter")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
@@ -0,0 +1,67 @@
+package config
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// DefaultMaxHeaderBytes bounds the request headers of domains without a configured limit.
+const DefaultMaxHeaderBytes = http.DefaultMaxHeaderBytes
+
+// RequestLimits represents the size limits of requests. A zero limit inherits
+// the limit of the domain, or the default one. Bodies and URIs are unlimited by default.
+type RequestLimits struct {
+	// MaxBodyBytes bounds request bodies, including chunked ones. Bodies with a larger
+	// Content-Length are rejected before the backend is dialed, while chunked bodies are
+	// only found too large once the backend has received them up to the limit.
+	MaxBodyBytes int64 `yaml:"max_body_bytes,omitempty"`
+	// MaxHeaderBytes bounds the request line and headers of a request.
+	MaxHeaderBytes int64 `yaml:"max_header_bytes,omitempty"`
+	// MaxURILength bounds the request URI, in bytes.
+	MaxURILength int `yaml:"max_uri_length,omitempty"`
+}
+
+// DefaultRequestLimits are the limits inherited by domains.
+var DefaultRequestLimits = RequestLimits{
+	MaxHeaderBytes: DefaultMaxHeaderBytes,
+}
+
+// isZero reports whether no limit is set.
+func (l RequestLimits) isZero() bool {
+	return l == RequestLimits{}
+}
+
+// validate returns an error if a limit is negative.
+func (l RequestLimits) validate() error {
+	if l.MaxBodyBytes < 0 || l.MaxHeaderBytes < 0 || l.MaxURILength < 0 {
+		return fmt.Errorf("request limits must not be negative")
+	}
+	return nil
+}
+
+// inherit returns l with its zero limits set from parent.
+func (l RequestLimits) inherit(parent RequestLimits) RequestLimits {
+	if l.MaxBodyBytes == 0 {
+		l.MaxBodyBytes = parent.MaxBodyBytes
+	}
+	if l.MaxHeaderBytes == 0 {
+		l.MaxHeaderBytes = parent.MaxHeaderBytes
+	}
+	if l.MaxURILength == 0 {
+		l.MaxURILength = parent.MaxURILength
+	}
+	return l
+}
+
+// MaxHeaderBytes returns the largest header limit of the domain and its routes,
+// which bounds reading the headers of a request before its route is known.
+func (p *Proxy) MaxHeaderBytes() int64 {
+	n := p.Limits.MaxHeaderBytes
+	for _, route := range p.Routes {
+		n = max(n, route.Limits.MaxHeaderBytes)
+	}
+	if n <= 0 {
+		n = DefaultMaxHeaderBytes
+	}
+	return n
+}
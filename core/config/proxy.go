@@ -1,48 +1,198 @@
 package config
 
 import (
+	"cmp"
+	"crypto/tls"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/url"
+	"path"
 	"regexp"
+	"slices"
 	"sort"
 	"strings"
 
+	"github.com/Dyastin-0/tcprp/core/cache"
+	"github.com/Dyastin-0/tcprp/core/geoip"
 	"github.com/Dyastin-0/tcprp/core/limiter"
 	"github.com/Dyastin-0/tcprp/core/metrics"
+	"github.com/Dyastin-0/tcprp/core/waf"
 )
 
-// RewriteRule represents a URL path rewriting rule.
+// RewriteRule represents a URL rewriting rule.
+// From and To rewrite the decoded path, Host replaces the Host header
+// sent to the backend and Query rewrites the query parameters.
 type RewriteRule struct {
-	From string `yaml:"from"`
-	To   string `yaml:"to"`
+	From  string        `yaml:"from,omitempty"`
+	To    string        `yaml:"to,omitempty"`
+	Host  string        `yaml:"host,omitempty"`
+	Query *QueryRewrite `yaml:"query,omitempty"`
+}
+
+// QueryRewrite represents query parameter rewriting operations.
+// A renamed parameter cannot be renamed again.
+type QueryRewrite struct {
+	Set    map[string]string `yaml:"set,omitempty"`
+	Add    map[string]string `yaml:"add,omitempty"`
+	Remove []string          `yaml:"remove,omitempty"`
+	Rename map[string]string `yaml:"rename,omitempty"`
+}
+
+// validate reports a rename whose target is renamed too, which would depend on the order of renames.
+func (r *QueryRewrite) validate() error {
+	for from, to := range r.Rename {
+		if _, ok := r.Rename[to]; ok {
+			return fmt.Errorf("query parameter '%s' is renamed to '%s', which is renamed again", from, to)
+		}
+	}
+	return nil
+}
+
+// Apply applies the operations to q, renaming first, then removing, setting and adding.
+// Parameters renamed to the same name are appended in the order of their old names.
+// It reports whether any operation changed q.
+func (r *QueryRewrite) Apply(q url.Values) bool {
+	changed := len(r.Set) > 0 || len(r.Add) > 0
+	for _, from := range slices.Sorted(maps.Keys(r.Rename)) {
+		to := r.Rename[from]
+		if values, ok := q[from]; ok {
+			delete(q, from)
+			q[to] = append(q[to], values...)
+			changed = true
+		}
+	}
+	for _, name := range r.Remove {
+		if q.Has(name) {
+			q.Del(name)
+			changed = true
+		}
+	}
+	for name, value := range r.Set {
+		q.Set(name, value)
+	}
+	for name, value := range r.Add {
+		q.Add(name, value)
+	}
+	return changed
 }
 
 // Route represents an HTTP route pattern, its target, and optional rewrite rules.
+// Terminate always matches the route's proxy, since paths are only known after termination.
 type Route struct {
-	Pattern     string
-	Target      string
-	Terminate   bool
-	RewriteRule *RewriteRule
-	Limiter     *limiter.Limiter
-	regex       *regexp.Regexp
+	Pattern        string
+	Target         string
+	Respond        *RespondConfig
+	Redirect       *RedirectConfig
+	Terminate      bool
+	RewriteRule    *RewriteRule
+	Limiter        *limiter.Limiter
+	Access         *AccessList
+	ConnLimiter    *limiter.ConnLimiter
+	RequestLimiter *RequestLimiter
+	Auth           *Auth
+	AuthRequest    *AuthRequest
+	Cache          *cache.Cache
+	Compression    *Compression
+	WAF            waf.Inspector
+	WebSocket      *WebSocket
+	// Geo restricts the route to clients from its countries or ASNs,
+	// other clients fall through to the next matching route.
+	Geo     *GeoMatch
+	Split   *Split
+	Headers *HeaderRules
+	// Limits are the request limits of the route, inherited from its domain.
+	Limits RequestLimits
+	regex  *regexp.Regexp
+}
+
+// ALPNRoute represents a passthrough target for connections offering one of Protocols.
+type ALPNRoute struct {
+	Protocols []string
+	Target    string
 }
 
 // RouteResult contains the matched route information and rewritten path.
 type RouteResult struct {
+	Pattern       string
 	Target        string
+	Respond       *RespondConfig
+	Redirect      *RedirectConfig
 	RewrittenPath string
+	Host          string
+	Query         *QueryRewrite
 	Terminate     bool
 	Matched       bool
 	Limiter       *limiter.Limiter
+	// Access restricts the client IPs of the matched route.
+	Access *AccessList
+	// ConnLimiter caps the concurrent requests to the matched route.
+	ConnLimiter *limiter.ConnLimiter
+	// RequestLimiter limits the requests to the matched route.
+	RequestLimiter *RequestLimiter
+	// Auth authenticates the requests to the matched route.
+	Auth *Auth
+	// AuthRequest checks the requests to the matched route with an auth service.
+	AuthRequest *AuthRequest
+	// Cache caches the responses of the matched route, or of the proxy if the route has no cache.
+	Cache *cache.Cache
+	// Compression compresses the responses of the matched route, or of the proxy if the route does not.
+	Compression *Compression
+	// WAF inspects the requests to the matched route, or to the proxy if the route has no inspector.
+	WAF waf.Inspector
+	// WebSocket parses the upgraded connections of the matched route, or of the proxy if the route does not.
+	WebSocket *WebSocket
+	Headers   *HeaderRules
+	// Limits bounds the size of requests to the matched route, or to the proxy if none matched.
+	Limits RequestLimits
+	// Canary reports whether Target was picked by a split.
+	Canary bool
+	// Cookie is set on the response to keep the client on the picked target.
+	Cookie *http.Cookie
+	split  *Split
+	// rawPath is RewrittenPath as escaped by the client, forwarded if it still encodes it.
+	rawPath string
+	// pathRewritten reports whether a rewrite rule changed the path.
+	pathRewritten bool
 }
 
 // Proxy represents a proxy configuration for a domain.
 type Proxy struct {
 	Target       string
+	Respond      *RespondConfig
+	Redirect     *RedirectConfig
+	Maintenance  *Maintenance
 	Proto        string
 	Terminate    bool
 	WrapTarget   bool
 	Metrics      *metrics.Metrics
 	Routes       []*Route
+	ALPNRoutes   []*ALPNRoute
+	Fingerprints []*FingerprintRule
+	ECHKeys      []tls.EncryptedClientHelloKey
+	Timeouts     Timeouts
 	Limiter      *limiter.Limiter
+	Access       *AccessList
+	ConnLimiter  *limiter.ConnLimiter
+	// Upload and Download throttle the bytes from and to clients of streamed connections.
+	Upload         *limiter.Bandwidth
+	Download       *limiter.Bandwidth
+	RequestLimiter *RequestLimiter
+	// Auth authenticates every request, before the auth of the matched route.
+	Auth *Auth
+	// AuthRequest checks every request with an auth service, after Auth.
+	AuthRequest *AuthRequest
+	Cache       *cache.Cache
+	Compression *Compression
+	WAF         waf.Inspector
+	WebSocket   *WebSocket
+	Split       *Split
+	Headers     *HeaderRules
+	ErrorPages  ErrorPages
+	// Limits bounds the size of requests not matching a route with its own limits.
+	Limits RequestLimits
+	// GeoIP looks up clients for the geo matches of Routes.
+	GeoIP        *geoip.DB
 	sortedRoutes []*Route
 }
 
@@ -56,50 +206,181 @@ func (p *Proxy) sortRoutes() {
 		return
 	}
 	for i := range p.sortedRoutes {
-		if p.sortedRoutes[i].RewriteRule != nil {
+		if p.sortedRoutes[i].RewriteRule != nil && p.sortedRoutes[i].RewriteRule.From != "" {
 			regex, err := regexp.Compile(p.sortedRoutes[i].RewriteRule.From)
 			if err == nil {
 				p.sortedRoutes[i].regex = regex
 			}
 		}
 	}
-	sort.Slice(p.sortedRoutes, func(i, j int) bool {
+	sort.SliceStable(p.sortedRoutes, func(i, j int) bool {
 		if len(p.sortedRoutes[i].Pattern) != len(p.sortedRoutes[j].Pattern) {
 			return len(p.sortedRoutes[i].Pattern) > len(p.sortedRoutes[j].Pattern)
 		}
-		return p.sortedRoutes[i].Pattern < p.sortedRoutes[j].Pattern
+		if p.sortedRoutes[i].Pattern != p.sortedRoutes[j].Pattern {
+			return p.sortedRoutes[i].Pattern < p.sortedRoutes[j].Pattern
+		}
+		// Geo routes are tried before the route they narrow.
+		return p.sortedRoutes[i].Geo != nil && p.sortedRoutes[j].Geo == nil
 	})
 }
 
 // MatchRoute finds the best matching route for the given path and returns route result with rewritten path.
+// Routes with a geo match are skipped, since the client is unknown.
 func (p *Proxy) MatchRoute(path string) RouteResult {
+	return p.matchRoute(path, "", nil)
+}
+
+// matchRoute is MatchRoute for a client looked up as geo, if known,
+// also rewriting rawPath, the escaped form of path sent by the client, if set.
+func (p *Proxy) matchRoute(path, rawPath string, geo *geoip.Info) RouteResult {
 	for _, route := range p.sortedRoutes {
+		if route.Geo != nil && (geo == nil || !route.Geo.Matches(*geo)) {
+			continue
+		}
 		if matchesRoute(path, route.Pattern) {
 			result := RouteResult{
-				Target:        route.Target,
-				Terminate:     route.Terminate,
-				RewrittenPath: path,
-				Limiter:       route.Limiter,
-				Matched:       true,
+				Pattern:        route.Pattern,
+				Target:         route.Target,
+				Respond:        route.Respond,
+				Redirect:       route.Redirect,
+				Terminate:      route.Terminate,
+				RewrittenPath:  path,
+				rawPath:        rawPath,
+				Limiter:        route.Limiter,
+				ConnLimiter:    route.ConnLimiter,
+				Access:         route.Access,
+				RequestLimiter: route.RequestLimiter,
+				Auth:           route.Auth,
+				AuthRequest:    route.AuthRequest,
+				Cache:          cmp.Or(route.Cache, p.Cache),
+				Compression:    cmp.Or(route.Compression, p.Compression),
+				WAF:            cmp.Or(route.WAF, p.WAF),
+				WebSocket:      cmp.Or(route.WebSocket, p.WebSocket),
+				Headers:        route.Headers,
+				Limits:         route.Limits,
+				Matched:        true,
+				split:          route.Split,
 			}
 			if route.RewriteRule != nil {
 				result.RewrittenPath = p.applyRewrite(path, route)
+				result.pathRewritten = result.RewrittenPath != path
+				if rawPath != "" {
+					result.rawPath = p.applyRewrite(rawPath, route)
+				}
+				result.Host = route.RewriteRule.Host
+				result.Query = route.RewriteRule.Query
 			}
 			return result
 		}
 	}
 	return RouteResult{
 		Target:        p.Target,
+		Respond:       p.Respond,
+		Redirect:      p.Redirect,
 		Terminate:     p.Terminate,
 		RewrittenPath: path,
+		rawPath:       rawPath,
 		Limiter:       p.Limiter,
+		Cache:         p.Cache,
+		Compression:   p.Compression,
+		WAF:           p.WAF,
+		WebSocket:     p.WebSocket,
+		Limits:        p.Limits,
 		Matched:       false,
+		split:         p.Split,
+	}
+}
+
+// MatchRequest is MatchRoute on the decoded and cleaned path of req, including the routes
+// with a geo match of clientIP, with the target picked by the matched split, if any.
+// Matching the decoded path keeps encoded paths such as /%61dmin from evading routes.
+// The path of req is only cleaned for matching, it is sent as is unless a rewrite changes it.
+func (p *Proxy) MatchRequest(req *http.Request, clientIP string) RouteResult {
+	var geo *geoip.Info
+	if p.GeoIP != nil {
+		info := p.GeoIP.Lookup(clientIP)
+		geo = &info
+	}
+
+	result := p.matchRoute(cleanPath(req.URL.Path), req.URL.EscapedPath(), geo)
+	if result.split == nil {
+		return result
+	}
+
+	canary, cookie := result.split.pick(req, clientIP)
+	if canary {
+		result.Target = result.split.Target
+		result.Canary = true
+	}
+	result.Cookie = cookie
+	return result
+}
+
+// MatchALPN returns the target of the ALPN route matching the first of protocols,
+// in the client's order of preference, that has a route.
+// It returns an empty string if no ALPN route matches.
+func (p *Proxy) MatchALPN(protocols []string) string {
+	for _, proto := range protocols {
+		for _, route := range p.ALPNRoutes {
+			if slices.Contains(route.Protocols, proto) {
+				return route.Target
+			}
+		}
+	}
+	return ""
+}
+
+// StreamTarget returns the target for a passthrough connection from clientIP.
+func (p *Proxy) StreamTarget(clientIP string) string {
+	if p.Split == nil {
+		return p.Target
+	}
+	if canary, _ := p.Split.pick(nil, clientIP); canary {
+		return p.Split.Target
+	}
+	return p.Target
+}
+
+// Rewrite applies the rewritten path, host and query to req. The path is only replaced
+// if a rewrite rule changed it, keeping the escaping sent by the client where it still
+// encodes the rewritten path, and the query is only re-encoded if a query operation changed it.
+func (r RouteResult) Rewrite(req *http.Request) {
+	if r.pathRewritten {
+		req.URL.Path = r.RewrittenPath
+		req.URL.RawPath = ""
+		if unescaped, err := url.PathUnescape(r.rawPath); err == nil && unescaped == r.RewrittenPath {
+			req.URL.RawPath = r.rawPath
+		}
+	}
+
+	if r.Host != "" {
+		req.Host = r.Host
+	}
+
+	if r.Query != nil {
+		q := req.URL.Query()
+		if r.Query.Apply(q) {
+			req.URL.RawQuery = q.Encode()
+		}
+	}
+}
+
+// cleanPath returns the canonical form of the decoded path p, keeping its trailing slash.
+func cleanPath(p string) string {
+	if p == "" || p[0] != '/' {
+		p = "/" + p
+	}
+	cleaned := path.Clean(p)
+	if p[len(p)-1] == '/' && cleaned != "/" {
+		cleaned += "/"
 	}
+	return cleaned
 }
 
 // applyRewrite applies the rewrite rule to the given path.
 func (p *Proxy) applyRewrite(path string, route *Route) string {
-	if route.RewriteRule == nil {
+	if route.RewriteRule == nil || route.RewriteRule.From == "" {
 		return path
 	}
 	// Use compiled regex if available
@@ -0,0 +1,177 @@
+package config
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Dyastin-0/tcprp/core/limiter"
+)
+
+// Request limit keys. Header and JWT claim keys are suffixed with the header or claim name.
+// The api_key and header keys are sent by the client, which gets a fresh bucket for every
+// value it sends: they share a budget between cooperating clients, and only the ip key
+// bounds a client rotating them. So are JWT claim keys, unless the proxy or route verifies
+// JWTs, in which case they are read from the verified token.
+const (
+	RequestKeyIP     = "ip"
+	RequestKeyPath   = "path"
+	RequestKeyAPIKey = "api_key"
+	RequestKeyHeader = "header:"
+	RequestKeyJWT    = "jwt:"
+)
+
+// APIKeyHeader is the header read by the api_key request limit key.
+const APIKeyHeader = "X-Api-Key"
+
+// RequestLimitConfig represents a per-request rate limit,
+// with optional limits per method replacing the default one.
+type RequestLimitConfig struct {
+	Key      string                    `yaml:"key,omitempty"`
+	Rate     int                       `yaml:"rate"`
+	Burst    int                       `yaml:"burst"`
+	Cooldown int64                     `yaml:"cooldown,omitempty"`
+	Methods  map[string]*LimiterConfig `yaml:"methods,omitempty"`
+}
+
+// RequestLimiter rate limits HTTP requests by a key derived from each request.
+type RequestLimiter struct {
+	key     string
+	limiter *limiter.Limiter
+	methods map[string]*limiter.Limiter
+}
+
+// newRequestLimiter returns a new RequestLimiter from conf, with limiters from newLimiter under scope.
+func newRequestLimiter(conf *RequestLimitConfig, newLimiter limiterFunc, scope string) (*RequestLimiter, error) {
+	key := conf.Key
+	switch {
+	case key == "":
+		key = RequestKeyIP
+	case key == RequestKeyIP, key == RequestKeyPath, key == RequestKeyAPIKey:
+	case strings.HasPrefix(key, RequestKeyHeader) && len(key) > len(RequestKeyHeader):
+	case strings.HasPrefix(key, RequestKeyJWT) && len(key) > len(RequestKeyJWT):
+	default:
+		return nil, fmt.Errorf("unknown request limit key '%s'", key)
+	}
+
+	r := &RequestLimiter{
+		key:     key,
+		methods: make(map[string]*limiter.Limiter, len(conf.Methods)),
+	}
+
+	if conf.Rate > 0 {
+		r.limiter = newRequestBucket(newLimiter, scope, conf.Rate, conf.Burst, conf.Cooldown)
+	}
+
+	for method, methodConf := range conf.Methods {
+		if methodConf.Rate <= 0 {
+			return nil, fmt.Errorf("invalid rate %d for method '%s'", methodConf.Rate, method)
+		}
+		r.methods[strings.ToUpper(method)] = newRequestBucket(newLimiter, scope+" "+strings.ToUpper(method),
+			methodConf.Rate, methodConf.Burst, methodConf.Cooldown)
+	}
+
+	if r.limiter == nil && len(r.methods) == 0 {
+		return nil, fmt.Errorf("request limit requires a rate")
+	}
+
+	return r, nil
+}
+
+// newRequestBucket returns a limiter allowing rate requests per second,
+// denying a client for cooldown minutes once its burst is exhausted.
+func newRequestBucket(newLimiter limiterFunc, scope string, rate, burst int, cooldown int64) *limiter.Limiter {
+	if burst <= 0 {
+		burst = rate
+	}
+
+	opts := []limiter.OptFunc{limiter.WithRPS(rate), limiter.WithBurst(burst)}
+	if cooldown > 0 {
+		opts = append(opts, limiter.WithCooldown(time.Duration(cooldown)*time.Minute))
+	} else {
+		opts = append(opts, limiter.WithoutCooldown)
+	}
+
+	return newLimiter(scope, opts...)
+}
+
+// ClaimKeyed reports whether r is keyed on a JWT claim.
+func (r *RequestLimiter) ClaimKeyed() bool {
+	return r != nil && strings.HasPrefix(r.key, RequestKeyJWT)
+}
+
+// Allow takes a token for req from the limit of its method,
+// or from the default limit if the method has none.
+// Claims are the verified JWT claims of req, if any.
+func (r *RequestLimiter) Allow(req *http.Request, clientIP string, claims map[string]any) limiter.Result {
+	if r == nil {
+		return limiter.Result{Allowed: true}
+	}
+
+	l, ok := r.methods[req.Method]
+	if !ok {
+		l = r.limiter
+	}
+	if l == nil {
+		return limiter.Result{Allowed: true}
+	}
+
+	return l.Take(r.Key(req, clientIP, claims))
+}
+
+// Key returns the key req is limited by, falling back to clientIP if the request lacks it.
+// JWT claims are read from claims, the verified claims of req. Without them, they are read
+// from the token without verifying it, so the key only groups requests and does not
+// authenticate them.
+func (r *RequestLimiter) Key(req *http.Request, clientIP string, claims map[string]any) string {
+	var key string
+
+	switch {
+	case r.key == RequestKeyPath:
+		key = req.URL.Path
+	case r.key == RequestKeyAPIKey:
+		key = req.Header.Get(APIKeyHeader)
+		if key == "" {
+			key = req.URL.Query().Get("api_key")
+		}
+	case strings.HasPrefix(r.key, RequestKeyHeader):
+		key = req.Header.Get(strings.TrimPrefix(r.key, RequestKeyHeader))
+	case strings.HasPrefix(r.key, RequestKeyJWT):
+		if claims == nil {
+			claims = unverifiedClaims(req)
+		}
+		key = claimString(claims[strings.TrimPrefix(r.key, RequestKeyJWT)])
+	}
+
+	if key == "" {
+		return "ip:" + clientIP
+	}
+	return r.key + ":" + key
+}
+
+// unverifiedClaims returns the claims of the bearer token of req, without verifying the token.
+func unverifiedClaims(req *http.Request) map[string]any {
+	token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return nil
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil
+	}
+
+	var claims map[string]any
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil
+	}
+	return claims
+}
@@ -0,0 +1,138 @@
+package config
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand/v2"
+	"net/http"
+	"sync/atomic"
+)
+
+// Sticky modes for a split.
+const (
+	StickyCookie = "cookie"
+	StickyHeader = "header"
+	StickyIP     = "ip"
+)
+
+const (
+	defaultSplitCookie = "tcprp_split"
+
+	splitPrimary = "primary"
+	splitCanary  = "canary"
+)
+
+// Split sends a percentage of traffic to a secondary target.
+type Split struct {
+	Target string
+	Sticky *StickyConfig
+	weight atomic.Int32
+}
+
+// NewSplit returns a new Split sending weight percent of traffic to target.
+func NewSplit(target string, weight int, sticky *StickyConfig) (*Split, error) {
+	if target == "" {
+		return nil, fmt.Errorf("empty split target")
+	}
+
+	if sticky != nil {
+		// The defaults are set on a copy, leaving the caller's config as loaded.
+		copied := *sticky
+		sticky = &copied
+		switch sticky.Mode {
+		case StickyCookie:
+			if sticky.Name == "" {
+				sticky.Name = defaultSplitCookie
+			}
+		case StickyHeader:
+			if sticky.Name == "" {
+				return nil, fmt.Errorf("sticky header mode requires a header name")
+			}
+		case StickyIP:
+		default:
+			return nil, fmt.Errorf("unknown sticky mode '%s'", sticky.Mode)
+		}
+	}
+
+	s := &Split{
+		Target: target,
+		Sticky: sticky,
+	}
+	if err := s.SetWeight(weight); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Weight returns the percentage of traffic sent to the split target.
+func (s *Split) Weight() int {
+	return int(s.weight.Load())
+}
+
+// SetWeight atomically sets the percentage of traffic sent to the split target.
+func (s *Split) SetWeight(weight int) error {
+	if weight < 0 || weight > 100 {
+		return fmt.Errorf("split weight must be between 0 and 100, got %d", weight)
+	}
+	s.weight.Store(int32(weight))
+	return nil
+}
+
+// pick reports whether a request goes to the split target,
+// and returns a cookie to set on the response when cookie stickiness is used.
+// A cookie naming a side with no traffic left is ignored and replaced.
+func (s *Split) pick(req *http.Request, clientIP string) (bool, *http.Cookie) {
+	if s.Sticky == nil {
+		return s.roll(), nil
+	}
+
+	switch s.Sticky.Mode {
+	case StickyCookie:
+		if req != nil {
+			if c, err := req.Cookie(s.Sticky.Name); err == nil {
+				weight := s.Weight()
+				switch {
+				case c.Value == splitCanary && weight > 0:
+					return true, nil
+				case c.Value == splitPrimary && weight < 100:
+					return false, nil
+				}
+			}
+		}
+		canary := s.roll()
+		value := splitPrimary
+		if canary {
+			value = splitCanary
+		}
+		return canary, &http.Cookie{
+			Name:     s.Sticky.Name,
+			Value:    value,
+			Path:     "/",
+			HttpOnly: true,
+		}
+	case StickyHeader:
+		if req != nil {
+			if v := req.Header.Get(s.Sticky.Name); v != "" {
+				return s.bucket(v), nil
+			}
+		}
+	case StickyIP:
+		if clientIP != "" {
+			return s.bucket(clientIP), nil
+		}
+	}
+
+	return s.roll(), nil
+}
+
+// roll randomly picks the split target with the configured weight.
+func (s *Split) roll() bool {
+	return rand.IntN(100) < s.Weight()
+}
+
+// bucket deterministically picks the split target for key.
+func (s *Split) bucket(key string) bool {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32()%100) < s.Weight()
+}
@@ -0,0 +1,61 @@
+package config
+
+import "time"
+
+// Timeouts represents connection timeouts. A zero timeout inherits
+// the global timeout, or the default one, and a negative timeout disables it.
+type Timeouts struct {
+	// ClientHello bounds reading the ClientHello, it is only read from the global timeouts.
+	ClientHello time.Duration `yaml:"client_hello,omitempty"`
+	// Handshake bounds the TLS handshake of terminated connections.
+	Handshake time.Duration `yaml:"handshake,omitempty"`
+	// HeaderRead bounds reading the headers of a request.
+	HeaderRead time.Duration `yaml:"header_read,omitempty"`
+	// BodyRead bounds reading the body of a request, until it is sent to the backend.
+	BodyRead time.Duration `yaml:"body_read,omitempty"`
+	// Idle bounds waiting for the next request on a keep-alive connection.
+	Idle time.Duration `yaml:"idle,omitempty"`
+	// Dial bounds connecting to a backend.
+	Dial time.Duration `yaml:"dial,omitempty"`
+	// ResponseHeader bounds waiting for the response headers of a backend.
+	ResponseHeader time.Duration `yaml:"response_header,omitempty"`
+	// StreamIdle closes a stream after no bytes are copied in either direction.
+	StreamIdle time.Duration `yaml:"stream_idle,omitempty"`
+	// Write bounds each write to a terminated client, so a client that stops reading is disconnected.
+	Write time.Duration `yaml:"write,omitempty"`
+	// MaxLifetime closes a connection after it has been open this long.
+	MaxLifetime time.Duration `yaml:"max_lifetime,omitempty"`
+}
+
+// DefaultTimeouts are the timeouts inherited by the global timeouts.
+var DefaultTimeouts = Timeouts{
+	ClientHello:    10 * time.Second,
+	Handshake:      10 * time.Second,
+	HeaderRead:     30 * time.Second,
+	BodyRead:       time.Minute,
+	Idle:           2 * time.Minute,
+	Dial:           10 * time.Second,
+	ResponseHeader: time.Minute,
+	StreamIdle:     10 * time.Minute,
+	Write:          30 * time.Second,
+}
+
+// inherit returns t with its zero timeouts set from parent.
+func (t Timeouts) inherit(parent Timeouts) Timeouts {
+	inherit := func(d *time.Duration, p time.Duration) {
+		if *d == 0 {
+			*d = p
+		}
+	}
+	inherit(&t.ClientHello, parent.ClientHello)
+	inherit(&t.Handshake, parent.Handshake)
+	inherit(&t.HeaderRead, parent.HeaderRead)
+	inherit(&t.BodyRead, parent.BodyRead)
+	inherit(&t.Idle, parent.Idle)
+	inherit(&t.Dial, parent.Dial)
+	inherit(&t.ResponseHeader, parent.ResponseHeader)
+	inherit(&t.StreamIdle, parent.StreamIdle)
+	inherit(&t.Write, parent.Write)
+	inherit(&t.MaxLifetime, parent.MaxLifetime)
+	return t
+}
@@ -0,0 +1,115 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+
+	"github.com/Dyastin-0/tcprp/core/waf"
+)
+
+// WAF modes. Matches of a rule in log mode are logged without blocking the request.
+const (
+	WAFModeBlock = "block"
+	WAFModeLog   = "log"
+)
+
+// WAFConfig represents the rule engine inspecting requests before they are sent to a backend.
+// Signatures names the built-in signature lists to match, sqli and xss,
+// and Methods, if set, is the allowlist of request methods.
+type WAFConfig struct {
+	Mode       string           `yaml:"mode,omitempty"`
+	Methods    []string         `yaml:"methods,omitempty"`
+	Signatures []string         `yaml:"signatures,omitempty"`
+	Rules      []*WAFRuleConfig `yaml:"rules,omitempty"`
+}
+
+// WAFRuleConfig represents a rule matching requests whose path matches the Path regex,
+// and whose Header matches the Pattern regex. Without a Header, Pattern matches the path,
+// the query and the Cookie, Referer and User-Agent headers.
+// Mode overrides the mode of the engine for the rule.
+type WAFRuleConfig struct {
+	ID      string `yaml:"id"`
+	Path    string `yaml:"path,omitempty"`
+	Header  string `yaml:"header,omitempty"`
+	Pattern string `yaml:"pattern,omitempty"`
+	Mode    string `yaml:"mode,omitempty"`
+}
+
+// NewWAF returns a new rule engine from conf.
+func NewWAF(conf *WAFConfig) (*waf.Engine, error) {
+	logOnly, err := wafLogOnly(conf.Mode, false)
+	if err != nil {
+		return nil, err
+	}
+
+	var rules []*waf.Rule
+	for _, name := range conf.Signatures {
+		signatures, ok := waf.Signatures(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown signatures '%s'", name)
+		}
+		for _, rule := range signatures {
+			rule.LogOnly = logOnly
+		}
+		rules = append(rules, signatures...)
+	}
+
+	for _, ruleConf := range conf.Rules {
+		rule, err := newWAFRule(ruleConf, logOnly)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rule '%s': %w", ruleConf.ID, err)
+		}
+		rules = append(rules, rule)
+	}
+
+	if slices.Contains(conf.Methods, "") {
+		return nil, fmt.Errorf("empty method")
+	}
+
+	return waf.NewEngine(rules, conf.Methods, logOnly), nil
+}
+
+// newWAFRule returns a new rule from conf, in log mode if conf has no mode and logOnly is set.
+func newWAFRule(conf *WAFRuleConfig, logOnly bool) (*waf.Rule, error) {
+	if conf.ID == "" {
+		return nil, fmt.Errorf("empty id")
+	}
+	if conf.Path == "" && conf.Pattern == "" {
+		return nil, fmt.Errorf("rule requires a path or a pattern")
+	}
+	if conf.Header != "" && conf.Pattern == "" {
+		return nil, fmt.Errorf("header requires a pattern")
+	}
+
+	rule := &waf.Rule{ID: conf.ID, Header: conf.Header}
+
+	var err error
+	if rule.LogOnly, err = wafLogOnly(conf.Mode, logOnly); err != nil {
+		return nil, err
+	}
+	if conf.Path != "" {
+		if rule.Path, err = regexp.Compile(conf.Path); err != nil {
+			return nil, err
+		}
+	}
+	if conf.Pattern != "" {
+		if rule.Pattern, err = regexp.Compile(conf.Pattern); err != nil {
+			return nil, err
+		}
+	}
+	return rule, nil
+}
+
+// wafLogOnly reports whether mode is the log mode, or returns inherited if mode is empty.
+func wafLogOnly(mode string, inherited bool) (bool, error) {
+	switch mode {
+	case "":
+		return inherited, nil
+	case WAFModeBlock:
+		return false, nil
+	case WAFModeLog:
+		return true, nil
+	}
+	return false, fmt.Errorf("unknown mode '%s'", mode)
+}
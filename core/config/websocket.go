@@ -0,0 +1,101 @@
+package config
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// WebSocketConfig represents the WebSocket mode of a proxy or route, which parses the frames
+// of upgraded connections instead of streaming them. Origins and Subprotocols, if set,
+// restrict the Origin and Sec-WebSocket-Protocol of upgrade requests. An origin may start
+// its host with *. to allow its subdomains. MaxMessageSize bounds the payload of messages,
+// as sent on the wire. IdleTimeout closes sockets after a peer neither sends nor is relayed
+// a frame, and defaults to the stream idle timeout of the domain.
+type WebSocketConfig struct {
+	Origins        []string      `yaml:"origins,omitempty"`
+	Subprotocols   []string      `yaml:"subprotocols,omitempty"`
+	MaxMessageSize int64         `yaml:"max_message_size,omitempty"`
+	PingInterval   time.Duration `yaml:"ping_interval,omitempty"`
+	IdleTimeout    time.Duration `yaml:"idle_timeout,omitempty"`
+}
+
+// WebSocket holds the WebSocket mode of a proxy or route.
+type WebSocket struct {
+	MaxMessageSize int64
+	PingInterval   time.Duration
+	IdleTimeout    time.Duration
+	origins        []string
+	subprotocols   []string
+}
+
+// NewWebSocket returns a new WebSocket from conf, with IdleTimeout defaulting to idleTimeout.
+func NewWebSocket(conf *WebSocketConfig, idleTimeout time.Duration) (*WebSocket, error) {
+	if conf.MaxMessageSize < 0 || conf.PingInterval < 0 || conf.IdleTimeout < 0 {
+		return nil, fmt.Errorf("websocket limits must not be negative")
+	}
+	for _, origin := range conf.Origins {
+		if !strings.Contains(origin, "://") {
+			return nil, fmt.Errorf("invalid origin '%s'", origin)
+		}
+	}
+
+	ws := &WebSocket{
+		MaxMessageSize: conf.MaxMessageSize,
+		PingInterval:   conf.PingInterval,
+		IdleTimeout:    conf.IdleTimeout,
+		origins:        conf.Origins,
+		subprotocols:   conf.Subprotocols,
+	}
+	if ws.IdleTimeout == 0 {
+		ws.IdleTimeout = max(idleTimeout, 0)
+	}
+	return ws, nil
+}
+
+// Handshake checks the upgrade request req against the restrictions of ws, returning
+// the status and message of the error response if it is rejected, or 0 otherwise.
+// The subprotocols offered by req are narrowed to the allowed ones.
+func (ws *WebSocket) Handshake(req *http.Request) (int, string) {
+	if len(ws.origins) > 0 && !ws.allowsOrigin(req.Header.Get("Origin")) {
+		return http.StatusForbidden, "Origin not allowed"
+	}
+
+	if len(ws.subprotocols) > 0 {
+		var offered []string
+		for _, value := range req.Header.Values("Sec-WebSocket-Protocol") {
+			for _, protocol := range strings.Split(value, ",") {
+				if protocol = strings.TrimSpace(protocol); slices.Contains(ws.subprotocols, protocol) {
+					offered = append(offered, protocol)
+				}
+			}
+		}
+		if len(offered) == 0 {
+			return http.StatusForbidden, "Subprotocol not allowed"
+		}
+		req.Header.Set("Sec-WebSocket-Protocol", strings.Join(offered, ", "))
+	}
+
+	return 0, ""
+}
+
+// allowsOrigin reports whether origin is one of the allowed origins.
+func (ws *WebSocket) allowsOrigin(origin string) bool {
+	if origin == "" {
+		return false
+	}
+	origin = strings.ToLower(origin)
+	scheme, host, _ := strings.Cut(origin, "://")
+
+	return slices.ContainsFunc(ws.origins, func(allowed string) bool {
+		allowed = strings.ToLower(allowed)
+		if allowed == origin {
+			return true
+		}
+		allowedScheme, allowedHost, _ := strings.Cut(allowed, "://")
+		suffix, ok := strings.CutPrefix(allowedHost, "*")
+		return ok && scheme == allowedScheme && strings.HasPrefix(suffix, ".") && strings.HasSuffix(host, suffix)
+	})
+}
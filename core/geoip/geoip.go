@@ -0,0 +1,97 @@
+// Package geoip implements client IP lookups in MaxMind databases.
+package geoip
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// Info holds what is known about the location and network of an IP.
+type Info struct {
+	// Country is the ISO 3166-1 alpha-2 code of the country.
+	Country string
+	// ASN is the autonomous system number.
+	ASN uint
+	// ASOrg is the organization of the autonomous system.
+	ASOrg string
+}
+
+// record is the subset of the GeoLite2 and GeoIP2 Country, City and ASN records used by Info.
+type record struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	ASN   uint   `maxminddb:"autonomous_system_number"`
+	ASOrg string `maxminddb:"autonomous_system_organization"`
+}
+
+// DB looks up IPs in one or more mmdb databases, such as a country and an ASN database.
+type DB struct {
+	readers []*maxminddb.Reader
+}
+
+// Open opens the databases at paths. They are read into memory,
+// so a DB stays usable while its files are replaced.
+func Open(paths ...string) (*DB, error) {
+	db := &DB{}
+
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read geoip database: %w", err)
+		}
+
+		reader, err := maxminddb.FromBytes(data)
+		if err != nil {
+			return nil, fmt.Errorf("invalid geoip database '%s': %w", path, err)
+		}
+
+		db.readers = append(db.readers, reader)
+	}
+
+	return db, nil
+}
+
+// Close closes the databases. Lookups afterwards know nothing.
+func (d *DB) Close() error {
+	var errs []error
+	for _, reader := range d.readers {
+		errs = append(errs, reader.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// Lookup returns the Info of ip, merged from every database in order.
+// Unknown fields are left empty, and a nil DB knows nothing.
+func (d *DB) Lookup(ip string) Info {
+	var info Info
+	if d == nil {
+		return info
+	}
+
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return info
+	}
+
+	for _, reader := range d.readers {
+		var rec record
+		if err := reader.Lookup(addr, &rec); err != nil {
+			continue
+		}
+
+		if info.Country == "" {
+			info.Country = rec.Country.ISOCode
+		}
+		if info.ASN == 0 {
+			info.ASN = rec.ASN
+			info.ASOrg = rec.ASOrg
+		}
+	}
+
+	return info
+}
@@ -0,0 +1,36 @@
+package geoip
+
+import (
+	"testing"
+
+	"github.com/Dyastin-0/tcprp/core/geoip/geoiptest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLookup(t *testing.T) {
+	countries := geoiptest.Write(t, map[string]geoiptest.Record{
+		"8.8.8.0/24":   {Country: "US"},
+		"1.1.0.0/16":   {Country: "AU"},
+		"10.0.0.0/8":   {},
+		"81.2.69.0/24": {Country: "GB"},
+	})
+	asns := geoiptest.Write(t, map[string]geoiptest.Record{
+		"8.8.8.0/24": {ASN: 15169, ASOrg: "Google LLC - a long organization name"},
+	})
+
+	db, err := Open(countries, asns)
+	require.NoError(t, err)
+
+	require.Equal(t, Info{Country: "US", ASN: 15169, ASOrg: "Google LLC - a long organization name"}, db.Lookup("8.8.8.8"))
+	require.Equal(t, Info{Country: "AU"}, db.Lookup("1.1.1.1"))
+	require.Equal(t, Info{Country: "GB"}, db.Lookup("81.2.69.160"))
+	require.Equal(t, Info{}, db.Lookup("9.9.9.9"))
+	require.Equal(t, Info{}, db.Lookup("::1"))
+	require.Equal(t, Info{}, db.Lookup("invalid"))
+
+	var none *DB
+	require.Equal(t, Info{}, none.Lookup("8.8.8.8"))
+
+	_, err = Open(t.TempDir())
+	require.Error(t, err)
+}
@@ -0,0 +1,167 @@
+// Package geoiptest writes small mmdb databases for tests.
+package geoiptest
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// Record is the data of a network in a test database.
+type Record struct {
+	Country string
+	ASN     uint32
+	ASOrg   string
+}
+
+// recordSize is the size in bits of the search tree records.
+const recordSize = 24
+
+// Write writes an IPv4 database of records keyed by CIDR to a temporary file and returns its path.
+func Write(t testing.TB, records map[string]Record) string {
+	t.Helper()
+
+	// The search tree, each node holding the records of its 0 and 1 branches:
+	// a node index, a data offset marked by dataBit, or empty.
+	const empty, dataBit = -1, 1 << 30
+	nodes := [][2]int{{empty, empty}}
+
+	var data bytes.Buffer
+
+	cidrs := make([]string, 0, len(records))
+	for cidr := range records {
+		cidrs = append(cidrs, cidr)
+	}
+	slices.Sort(cidrs)
+
+	for _, cidr := range cidrs {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil || !prefix.Addr().Is4() || prefix.Bits() == 0 {
+			t.Fatalf("invalid test cidr '%s'", cidr)
+		}
+
+		offset := data.Len()
+		encodeRecord(&data, records[cidr])
+
+		ip := prefix.Masked().Addr().As4()
+		node := 0
+		for i := range prefix.Bits() {
+			bit := ip[i/8] >> (7 - i%8) & 1
+			if i == prefix.Bits()-1 {
+				nodes[node][bit] = dataBit | offset
+				break
+			}
+			if nodes[node][bit] == empty {
+				nodes = append(nodes, [2]int{empty, empty})
+				nodes[node][bit] = len(nodes) - 1
+			} else if nodes[node][bit]&dataBit != 0 {
+				t.Fatalf("overlapping test cidr '%s'", cidr)
+			}
+			node = nodes[node][bit]
+		}
+	}
+
+	var db bytes.Buffer
+	for _, node := range nodes {
+		for _, rec := range node {
+			var value int
+			switch {
+			case rec == empty:
+				value = len(nodes)
+			case rec&dataBit != 0:
+				value = len(nodes) + 16 + rec&^dataBit
+			default:
+				value = rec
+			}
+			db.Write([]byte{byte(value >> 16), byte(value >> 8), byte(value)})
+		}
+	}
+	db.Write(make([]byte, 16))
+	db.Write(data.Bytes())
+
+	db.WriteString("\xab\xcd\xefMaxMind.com")
+	writeMap(&db, 6)
+	writeString(&db, "node_count")
+	writeUint(&db, 6, uint64(len(nodes)))
+	writeString(&db, "record_size")
+	writeUint(&db, 5, recordSize)
+	writeString(&db, "ip_version")
+	writeUint(&db, 5, 4)
+	writeString(&db, "database_type")
+	writeString(&db, "tcprp-test")
+	writeString(&db, "binary_format_major_version")
+	writeUint(&db, 5, 2)
+	writeString(&db, "binary_format_minor_version")
+	writeUint(&db, 5, 0)
+
+	path := filepath.Join(t.TempDir(), "test.mmdb")
+	if err := os.WriteFile(path, db.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// encodeRecord encodes rec as a GeoLite2 style map.
+func encodeRecord(buf *bytes.Buffer, rec Record) {
+	n := 0
+	if rec.Country != "" {
+		n++
+	}
+	if rec.ASN != 0 {
+		n += 2
+	}
+
+	writeMap(buf, n)
+	if rec.Country != "" {
+		writeString(buf, "country")
+		writeMap(buf, 1)
+		writeString(buf, "iso_code")
+		writeString(buf, rec.Country)
+	}
+	if rec.ASN != 0 {
+		writeString(buf, "autonomous_system_number")
+		writeUint(buf, 6, uint64(rec.ASN))
+		writeString(buf, "autonomous_system_organization")
+		writeString(buf, rec.ASOrg)
+	}
+}
+
+// writeControl writes the control bytes of a value of typ and size, size being below 285.
+func writeControl(buf *bytes.Buffer, typ, size int) {
+	sizeBits, extra := size, -1
+	if size >= 29 {
+		sizeBits, extra = 29, size-29
+	}
+
+	if typ > 7 {
+		buf.WriteByte(byte(sizeBits))
+		buf.WriteByte(byte(typ - 7))
+	} else {
+		buf.WriteByte(byte(typ<<5 | sizeBits))
+	}
+
+	if extra >= 0 {
+		buf.WriteByte(byte(extra))
+	}
+}
+
+func writeString(buf *bytes.Buffer, s string) {
+	writeControl(buf, 2, len(s))
+	buf.WriteString(s)
+}
+
+func writeMap(buf *bytes.Buffer, n int) {
+	writeControl(buf, 7, n)
+}
+
+// writeUint writes v as an unsigned integer of typ, 5 for uint16 and 6 for uint32.
+func writeUint(buf *bytes.Buffer, typ int, v uint64) {
+	b := binary.BigEndian.AppendUint64(nil, v)
+	b = bytes.TrimLeft(b, "\x00")
+	writeControl(buf, typ, len(b))
+	buf.Write(b)
+}
@@ -0,0 +1,156 @@
+package limiter
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+// BandwidthLimit is a rate in bytes per second, with a burst in bytes.
+// A zero rate is unlimited, and a zero burst defaults to the rate.
+type BandwidthLimit struct {
+	Rate  int
+	Burst int
+}
+
+// Bandwidth throttles one direction of streams per connection, per key and in total.
+type Bandwidth struct {
+	perConn BandwidthLimit
+	perKey  BandwidthLimit
+	total   *rate.Limiter
+
+	mu   sync.Mutex
+	keys map[string]*keyBucket
+}
+
+// keyBucket is a bucket shared by the connections of a key.
+type keyBucket struct {
+	limiter *rate.Limiter
+	refs    int
+}
+
+// NewBandwidth returns a new Bandwidth, or nil if every limit is unlimited.
+func NewBandwidth(perConn, perKey, total BandwidthLimit) *Bandwidth {
+	if perConn.Rate <= 0 && perKey.Rate <= 0 && total.Rate <= 0 {
+		return nil
+	}
+
+	return &Bandwidth{
+		perConn: perConn,
+		perKey:  perKey,
+		total:   total.limiter(),
+		keys:    make(map[string]*keyBucket),
+	}
+}
+
+// limiter returns a rate.Limiter for the limit, or nil if it is unlimited.
+func (b BandwidthLimit) limiter() *rate.Limiter {
+	if b.Rate <= 0 {
+		return nil
+	}
+	burst := b.Burst
+	if burst <= 0 {
+		burst = b.Rate
+	}
+	return rate.NewLimiter(rate.Limit(b.Rate), burst)
+}
+
+// Throttle wraps rwc so reads from it are throttled by the buckets of the connection,
+// of key and of the total. The key's bucket is released when rwc is closed.
+// It returns rwc unchanged if b is nil.
+func (b *Bandwidth) Throttle(rwc io.ReadWriteCloser, key string) io.ReadWriteCloser {
+	if b == nil {
+		return rwc
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t := &throttledReadWriteCloser{
+		ReadWriteCloser: rwc,
+		ctx:             ctx,
+		cancel:          cancel,
+	}
+
+	for _, l := range []*rate.Limiter{b.perConn.limiter(), b.acquire(key), b.total} {
+		if l != nil {
+			t.limiters = append(t.limiters, l)
+		}
+	}
+
+	t.release = func() { b.release(key) }
+	return t
+}
+
+// acquire returns the bucket of key, or nil if keys are unlimited.
+func (b *Bandwidth) acquire(key string) *rate.Limiter {
+	if b.perKey.Rate <= 0 {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	kb, ok := b.keys[key]
+	if !ok {
+		kb = &keyBucket{limiter: b.perKey.limiter()}
+		b.keys[key] = kb
+	}
+	kb.refs++
+	return kb.limiter
+}
+
+// release drops a reference to the bucket of key, removing it once unused.
+func (b *Bandwidth) release(key string) {
+	if b.perKey.Rate <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	kb, ok := b.keys[key]
+	if !ok {
+		return
+	}
+	kb.refs--
+	if kb.refs <= 0 {
+		delete(b.keys, key)
+	}
+}
+
+// throttledReadWriteCloser waits for tokens from every limiter after each read.
+type throttledReadWriteCloser struct {
+	io.ReadWriteCloser
+	limiters []*rate.Limiter
+	ctx      context.Context
+	cancel   context.CancelFunc
+	release  func()
+	once     sync.Once
+}
+
+func (t *throttledReadWriteCloser) Read(p []byte) (int, error) {
+	for _, l := range t.limiters {
+		if burst := l.Burst(); len(p) > burst {
+			p = p[:burst]
+		}
+	}
+
+	n, err := t.ReadWriteCloser.Read(p)
+	if n > 0 {
+		for _, l := range t.limiters {
+			if werr := l.WaitN(t.ctx, n); werr != nil {
+				return n, werr
+			}
+		}
+	}
+	return n, err
+}
+
+func (t *throttledReadWriteCloser) Close() error {
+	t.once.Do(func() {
+		t.cancel()
+		t.release()
+	})
+	return t.ReadWriteCloser.Close()
+}
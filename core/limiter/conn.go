@@ -0,0 +1,172 @@
+package limiter
+
+import (
+	"container/list"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Modes applied by a ConnLimiter when a cap is reached.
+const (
+	// ModeReject rejects the new connection.
+	ModeReject = "reject"
+	// ModeQueue waits for a slot up to the queue timeout, then rejects.
+	ModeQueue = "queue"
+	// ModeShed closes the oldest connection of the same key, and rejects if it has none.
+	ModeShed = "shed"
+)
+
+// ConnLimiter bounds the number of concurrent connections,
+// in total and per key such as a client IP.
+type ConnLimiter struct {
+	max          int
+	maxPerKey    int
+	mode         string
+	queueTimeout time.Duration
+
+	mu     sync.Mutex
+	active *list.List
+	perKey map[string]int
+	freed  chan struct{}
+
+	rejected atomic.Uint64
+}
+
+// slot is a connection holding a slot of a ConnLimiter.
+type slot struct {
+	key    string
+	closer io.Closer
+	elem   *list.Element
+}
+
+// NewConnLimiter returns a new ConnLimiter allowing max connections in total
+// and maxPerKey connections per key. A zero cap is unlimited.
+func NewConnLimiter(max, maxPerKey int, mode string, queueTimeout time.Duration) (*ConnLimiter, error) {
+	switch mode {
+	case "":
+		mode = ModeReject
+	case ModeReject, ModeShed:
+	case ModeQueue:
+		if queueTimeout <= 0 {
+			return nil, fmt.Errorf("queue mode requires a queue timeout")
+		}
+	default:
+		return nil, fmt.Errorf("unknown connection limit mode '%s'", mode)
+	}
+
+	return &ConnLimiter{
+		max:          max,
+		maxPerKey:    maxPerKey,
+		mode:         mode,
+		queueTimeout: queueTimeout,
+		active:       list.New(),
+		perKey:       make(map[string]int),
+		freed:        make(chan struct{}),
+	}, nil
+}
+
+// Acquire reserves a slot for a connection from key, closing closer if the slot is later shed.
+// It returns a func releasing the slot, and false if the connection is rejected.
+func (l *ConnLimiter) Acquire(key string, closer io.Closer) (func(), bool) {
+	var deadline <-chan time.Time
+
+	for {
+		l.mu.Lock()
+
+		if !l.full(key) || (l.mode == ModeShed && l.shed(key)) {
+			s := &slot{key: key, closer: closer}
+			s.elem = l.active.PushBack(s)
+			l.perKey[key]++
+			l.mu.Unlock()
+			return func() { l.release(s) }, true
+		}
+
+		if l.mode != ModeQueue {
+			l.mu.Unlock()
+			l.rejected.Add(1)
+			return nil, false
+		}
+
+		freed := l.freed
+		l.mu.Unlock()
+
+		if deadline == nil {
+			deadline = time.After(l.queueTimeout)
+		}
+
+		select {
+		case <-freed:
+		case <-deadline:
+			l.rejected.Add(1)
+			return nil, false
+		}
+	}
+}
+
+// Active returns the number of connections holding a slot.
+func (l *ConnLimiter) Active() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.active.Len()
+}
+
+// Rejected returns the number of rejected connections.
+func (l *ConnLimiter) Rejected() uint64 {
+	return l.rejected.Load()
+}
+
+// full reports whether a connection from key would exceed a cap.
+func (l *ConnLimiter) full(key string) bool {
+	return (l.max > 0 && l.active.Len() >= l.max) ||
+		(l.maxPerKey > 0 && l.perKey[key] >= l.maxPerKey)
+}
+
+// shed closes the oldest connection of key, so a key can never take the slots of others,
+// and reports whether a slot was freed.
+func (l *ConnLimiter) shed(key string) bool {
+	if l.perKey[key] == 0 {
+		return false
+	}
+
+	var oldest *slot
+	for e := l.active.Front(); e != nil; e = e.Next() {
+		if s := e.Value.(*slot); s.key == key {
+			oldest = s
+			break
+		}
+	}
+
+	l.remove(oldest)
+	if oldest.closer != nil {
+		go oldest.closer.Close()
+	}
+	return !l.full(key)
+}
+
+// release frees the slot of s if it was not already shed.
+func (l *ConnLimiter) release(s *slot) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if s.elem == nil {
+		return
+	}
+	l.remove(s)
+
+	close(l.freed)
+	l.freed = make(chan struct{})
+}
+
+// remove frees the slot of s, l.mu must be held.
+func (l *ConnLimiter) remove(s *slot) {
+	l.active.Remove(s.elem)
+	s.elem = nil
+
+	l.perKey[s.key]--
+	if l.perKey[s.key] <= 0 {
+		delete(l.perKey, s.key)
+	}
+}
@@ -0,0 +1,118 @@
+package limiter
+
+import (
+	"cmp"
+	"slices"
+	"sync/atomic"
+	"time"
+)
+
+// Eviction policies of a Limiter tracking its maximum number of clients.
+const (
+	// EvictOldest evicts the least recently seen clients to make room for new ones.
+	EvictOldest = "oldest"
+	// EvictReject denies new clients until stale ones are cleaned up.
+	EvictReject = "reject"
+)
+
+// evictFraction is the fraction of the tracked clients evicted at once when the cap is reached.
+const evictFraction = 10
+
+// WithJanitor removes clients unseen for maxAge every interval, until the limiter is stopped.
+func WithJanitor(interval, maxAge time.Duration) OptFunc {
+	return func(l *Limiter) {
+		l.janitorInterval = interval
+		l.maxAge = maxAge
+	}
+}
+
+// WithMaxClients caps the number of tracked clients, making room for new ones by eviction.
+func WithMaxClients(max int, eviction string) OptFunc {
+	return func(l *Limiter) {
+		l.maxClients = max
+		l.eviction = eviction
+	}
+}
+
+// janitor runs Cleanup every interval until stop is closed.
+func (l *Limiter) janitor(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			l.Cleanup(l.maxAge)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Stop stops the janitor of the limiter, if any. It is safe to call more than once.
+func (l *Limiter) Stop() {
+	l.stopOnce.Do(func() {
+		if l.stop != nil {
+			close(l.stop)
+		}
+	})
+}
+
+// Tracked returns the number of tracked clients.
+func (l *Limiter) Tracked() int {
+	return l.clients.Count()
+}
+
+// Evicted returns the number of clients evicted or rejected at the cap.
+func (l *Limiter) Evicted() uint64 {
+	return l.evicted.Load()
+}
+
+// makeRoom reports whether a new client can be tracked,
+// evicting the oldest clients if the cap is reached.
+// Clients cooling down are not evicted, so new clients cannot reset their cooldown.
+func (l *Limiter) makeRoom() bool {
+	if l.maxClients <= 0 || l.clients.Count() < l.maxClients {
+		return true
+	}
+
+	if l.eviction == EvictReject {
+		l.evicted.Add(1)
+		return false
+	}
+
+	// Another caller is already evicting, the cap may be briefly exceeded.
+	if !l.evicting.TryLock() {
+		return true
+	}
+	defer l.evicting.Unlock()
+
+	type entry struct {
+		key      string
+		lastSeen int64
+	}
+
+	now := time.Now().UnixNano()
+	entries := make([]entry, 0, l.maxClients)
+	for c := range l.clients.IterBuffered() {
+		if atomic.LoadInt64(&c.Val.cooldown) > now {
+			continue
+		}
+		entries = append(entries, entry{c.Key, atomic.LoadInt64(&c.Val.lastSeen)})
+	}
+	if len(entries) == 0 {
+		l.evicted.Add(1)
+		return false
+	}
+	slices.SortFunc(entries, func(a, b entry) int {
+		return cmp.Compare(a.lastSeen, b.lastSeen)
+	})
+
+	n := min(max(len(entries)/evictFraction, 1), len(entries))
+	for _, e := range entries[:n] {
+		l.clients.Remove(e.key)
+	}
+	l.evicted.Add(uint64(n))
+
+	return true
+}
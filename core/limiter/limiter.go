@@ -2,7 +2,10 @@
 package limiter
 
 import (
+	"context"
+	"math"
 	"net"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -17,6 +20,34 @@ type Limiter struct {
 	cooldown time.Duration
 
 	clients *cmap.ConcurrentMap[string, *client]
+
+	// store shares buckets between instances, keyed under scope.
+	// Buckets are kept in clients while it is nil or unreachable.
+	store     Store
+	scope     string
+	storeDown atomic.Int64
+
+	janitorInterval time.Duration
+	maxAge          time.Duration
+	maxClients      int
+	eviction        string
+	evicting        sync.Mutex
+	evicted         atomic.Uint64
+	stop            chan struct{}
+	stopOnce        sync.Once
+}
+
+// Result describes a rate limit decision for a key.
+type Result struct {
+	Allowed bool
+	// Limit is the burst size of the bucket.
+	Limit int
+	// Remaining is the number of tokens left in the bucket.
+	Remaining int
+	// RetryAfter is the time until the key is allowed again, zero if allowed.
+	RetryAfter time.Duration
+	// Reset is the time until the bucket is full again.
+	Reset time.Duration
 }
 
 type client struct {
@@ -50,6 +81,14 @@ func New(opts ...OptFunc) *Limiter {
 		WithDefaultRPS(limiter)
 	}
 
+	if limiter.janitorInterval > 0 {
+		if limiter.maxAge <= 0 {
+			limiter.maxAge = limiter.janitorInterval
+		}
+		limiter.stop = make(chan struct{})
+		go limiter.janitor(limiter.janitorInterval, limiter.stop)
+	}
+
 	return limiter
 }
 
@@ -59,7 +98,7 @@ func (l *Limiter) Allow(conn net.Conn) bool {
 		return true
 	}
 
-	ip := getIP(conn)
+	ip := ClientIP(conn)
 	if ip == "" {
 		return false
 	}
@@ -67,6 +106,14 @@ func (l *Limiter) Allow(conn net.Conn) bool {
 	return l.allow(ip)
 }
 
+// AllowKey checks if the key, such as a TLS fingerprint, should be allowed.
+func (l *Limiter) AllowKey(key string) bool {
+	if l.rate == 0 || l.burst == 0 {
+		return true
+	}
+	return l.allow(key)
+}
+
 // AllowIP checks if the IP should be allowed (useful for testing).
 func (l *Limiter) AllowIP(ip string) bool {
 	if l.rate == 0 || l.burst == 0 {
@@ -75,45 +122,116 @@ func (l *Limiter) AllowIP(ip string) bool {
 	return l.allow(ip)
 }
 
-func (l *Limiter) allow(ip string) bool {
+// Take takes a token for key and returns the decision with the state of its bucket.
+func (l *Limiter) Take(key string) Result {
+	if l.rate == 0 || l.burst == 0 {
+		return Result{Allowed: true}
+	}
+	return l.take(key)
+}
+
+// refill returns the time to refill n tokens.
+func (l *Limiter) refill(n float64) time.Duration {
+	if n <= 0 {
+		return 0
+	}
+	return time.Duration(n / float64(l.rate) * float64(time.Second))
+}
+
+func (l *Limiter) allow(key string) bool {
+	return l.take(key).Allowed
+}
+
+// take takes a token for key from the store, or from the local bucket
+// if there is no store or it is unreachable.
+func (l *Limiter) take(key string) Result {
 	now := time.Now()
 	nowNano := now.UnixNano()
 
-	c, exists := l.clients.Get(ip)
+	c, exists := l.clients.Get(key)
 	if !exists {
+		if !l.makeRoom() {
+			return Result{Limit: l.burst, RetryAfter: l.janitorInterval}
+		}
 		c = &client{
 			limiter:  rate.NewLimiter(l.rate, l.burst),
 			lastSeen: nowNano,
 			cooldown: 0,
 		}
-		l.clients.Set(ip, c)
+		l.clients.Set(key, c)
 	}
 
+	// Denied clients are seen too, so they are not the first evicted to make room.
+	atomic.StoreInt64(&c.lastSeen, nowNano)
+
 	cooldownUntil := atomic.LoadInt64(&c.cooldown)
 	if cooldownUntil > 0 && nowNano < cooldownUntil {
-		return false
+		return Result{
+			Limit:      l.burst,
+			RetryAfter: time.Duration(cooldownUntil - nowNano),
+			Reset:      time.Duration(cooldownUntil - nowNano),
+		}
 	}
 
-	if !c.limiter.Allow() {
-		atomic.StoreInt64(&c.cooldown, now.Add(l.cooldown).UnixNano())
-		return false
+	res, ok := l.takeStore(key, now)
+	if !ok {
+		res = l.takeLocal(c, now)
 	}
 
-	atomic.StoreInt64(&c.lastSeen, nowNano)
-	return true
+	if !res.Allowed {
+		if l.cooldown > 0 {
+			atomic.StoreInt64(&c.cooldown, now.Add(l.cooldown).UnixNano())
+			res.RetryAfter = max(res.RetryAfter, l.cooldown)
+		}
+	}
+	return res
+}
+
+// takeStore takes a token for key from the store, and reports false if it could not.
+// An unreachable store is skipped for storeRetry.
+func (l *Limiter) takeStore(key string, now time.Time) (Result, bool) {
+	if l.store == nil || now.UnixNano() < l.storeDown.Load() {
+		return Result{}, false
+	}
+
+	res, err := l.store.Take(context.Background(), l.scope+":"+key, l.rate, l.burst)
+	if err != nil {
+		l.storeDown.Store(now.Add(storeRetry).UnixNano())
+		return Result{}, false
+	}
+	return res, true
+}
+
+// takeLocal takes a token from the local bucket of c.
+func (l *Limiter) takeLocal(c *client, now time.Time) Result {
+	allowed := c.limiter.AllowN(now, 1)
+	tokens := max(c.limiter.TokensAt(now), 0)
+
+	res := Result{
+		Allowed:   allowed,
+		Limit:     l.burst,
+		Remaining: int(math.Floor(tokens)),
+		Reset:     l.refill(float64(l.burst) - tokens),
+	}
+	if !allowed {
+		res.RetryAfter = l.refill(1 - tokens)
+	}
+	return res
 }
 
-// Cleanup removes stale entries.
+// Cleanup removes entries unseen for maxAge, unless they are cooling down.
 func (l *Limiter) Cleanup(maxAge time.Duration) {
-	cutoff := time.Now().Add(-maxAge)
+	now := time.Now().UnixNano()
+	cutoff := now - int64(maxAge)
 	for c := range l.clients.IterBuffered() {
-		if time.Unix(0, c.Val.lastSeen).Before(cutoff) {
+		if atomic.LoadInt64(&c.Val.lastSeen) < cutoff && atomic.LoadInt64(&c.Val.cooldown) <= now {
 			l.clients.Remove(c.Key)
 		}
 	}
 }
 
-func getIP(conn net.Conn) string {
+// ClientIP returns the remote IP address of conn.
+func ClientIP(conn net.Conn) string {
 	if tcpConn, ok := conn.(*net.TCPConn); ok {
 		if addr, ok := tcpConn.RemoteAddr().(*net.TCPAddr); ok {
 			return addr.IP.String()
@@ -1,10 +1,14 @@
 package limiter
 
 import (
+	"bytes"
+	"fmt"
+	"io"
 	"net"
 	"testing"
 	"time"
 
+	"github.com/alicebob/miniredis/v2"
 	"github.com/stretchr/testify/require"
 )
 
@@ -51,3 +55,279 @@ func TestConcurrentAccess(t *testing.T) {
 		<-done
 	}
 }
+
+type closeRecorder struct {
+	closed chan struct{}
+}
+
+func (c *closeRecorder) Close() error {
+	close(c.closed)
+	return nil
+}
+
+func TestConnLimiter(t *testing.T) {
+	t.Run("reject", func(t *testing.T) {
+		l, err := NewConnLimiter(2, 1, ModeReject, 0)
+		require.NoError(t, err)
+
+		release, ok := l.Acquire("a", nil)
+		require.True(t, ok)
+
+		_, ok = l.Acquire("a", nil)
+		require.False(t, ok, "per key cap")
+
+		_, ok = l.Acquire("b", nil)
+		require.True(t, ok)
+
+		_, ok = l.Acquire("c", nil)
+		require.False(t, ok, "total cap")
+		require.Equal(t, uint64(2), l.Rejected())
+
+		release()
+		release()
+		require.Equal(t, 1, l.Active())
+
+		_, ok = l.Acquire("c", nil)
+		require.True(t, ok)
+	})
+
+	t.Run("queue", func(t *testing.T) {
+		l, err := NewConnLimiter(1, 0, ModeQueue, 100*time.Millisecond)
+		require.NoError(t, err)
+
+		release, ok := l.Acquire("a", nil)
+		require.True(t, ok)
+
+		start := time.Now()
+		_, ok = l.Acquire("b", nil)
+		require.False(t, ok)
+		require.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+
+		time.AfterFunc(20*time.Millisecond, release)
+		_, ok = l.Acquire("b", nil)
+		require.True(t, ok)
+		require.Equal(t, uint64(1), l.Rejected())
+	})
+
+	t.Run("shed", func(t *testing.T) {
+		l, err := NewConnLimiter(2, 0, ModeShed, 0)
+		require.NoError(t, err)
+
+		other := &closeRecorder{closed: make(chan struct{})}
+		_, ok := l.Acquire("b", other)
+		require.True(t, ok)
+		oldest := &closeRecorder{closed: make(chan struct{})}
+		releaseOldest, ok := l.Acquire("a", oldest)
+		require.True(t, ok)
+
+		// A key without connections cannot shed those of others.
+		_, ok = l.Acquire("c", nil)
+		require.False(t, ok)
+		require.Equal(t, uint64(1), l.Rejected())
+
+		_, ok = l.Acquire("a", nil)
+		require.True(t, ok)
+
+		select {
+		case <-oldest.closed:
+		case <-time.After(time.Second):
+			t.Fatal("oldest connection was not closed")
+		}
+		select {
+		case <-other.closed:
+			t.Fatal("connection of another key was shed")
+		default:
+		}
+
+		releaseOldest()
+		require.Equal(t, 2, l.Active())
+	})
+
+	t.Run("shed per key", func(t *testing.T) {
+		l, err := NewConnLimiter(0, 1, ModeShed, 0)
+		require.NoError(t, err)
+
+		other := &closeRecorder{closed: make(chan struct{})}
+		_, ok := l.Acquire("b", other)
+		require.True(t, ok)
+
+		own := &closeRecorder{closed: make(chan struct{})}
+		_, ok = l.Acquire("a", own)
+		require.True(t, ok)
+		_, ok = l.Acquire("a", nil)
+		require.True(t, ok)
+
+		<-own.closed
+		select {
+		case <-other.closed:
+			t.Fatal("connection of another key was shed")
+		default:
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		_, err := NewConnLimiter(1, 0, "drop", 0)
+		require.Error(t, err)
+		_, err = NewConnLimiter(1, 0, ModeQueue, 0)
+		require.Error(t, err)
+	})
+}
+
+func TestTake(t *testing.T) {
+	limiter := New(WithRPS(1), WithBurst(2), WithoutCooldown)
+
+	res := limiter.Take("key")
+	require.True(t, res.Allowed)
+	require.Equal(t, 2, res.Limit)
+	require.Equal(t, 1, res.Remaining)
+	require.InDelta(t, time.Second, res.Reset, float64(50*time.Millisecond))
+
+	res = limiter.Take("key")
+	require.True(t, res.Allowed)
+	require.Equal(t, 0, res.Remaining)
+
+	res = limiter.Take("key")
+	require.False(t, res.Allowed)
+	require.Greater(t, res.RetryAfter, 900*time.Millisecond)
+	require.LessOrEqual(t, res.RetryAfter, time.Second)
+
+	cooldown := New(WithRPS(1), WithBurst(1), WithCooldown(time.Minute))
+	require.True(t, cooldown.Take("key").Allowed)
+	res = cooldown.Take("key")
+	require.False(t, res.Allowed)
+	require.Greater(t, res.RetryAfter, 59*time.Second)
+}
+
+type nopReadWriteCloser struct {
+	io.Reader
+}
+
+func (nopReadWriteCloser) Write(p []byte) (int, error) { return len(p), nil }
+func (nopReadWriteCloser) Close() error                { return nil }
+
+func TestBandwidth(t *testing.T) {
+	require.Nil(t, NewBandwidth(BandwidthLimit{}, BandwidthLimit{}, BandwidthLimit{}))
+
+	b := NewBandwidth(BandwidthLimit{}, BandwidthLimit{Rate: 10000, Burst: 1000}, BandwidthLimit{})
+
+	first := b.Throttle(nopReadWriteCloser{bytes.NewReader(make([]byte, 2000))}, "a")
+	second := b.Throttle(nopReadWriteCloser{bytes.NewReader(make([]byte, 2000))}, "a")
+	require.Len(t, b.keys, 1)
+
+	start := time.Now()
+	for _, rwc := range []io.ReadWriteCloser{first, second} {
+		n, err := io.Copy(io.Discard, rwc)
+		require.NoError(t, err)
+		require.Equal(t, int64(2000), n)
+	}
+	// The key's burst is spent at once, then 3000 bytes are refilled at 10000 bytes per second.
+	require.GreaterOrEqual(t, time.Since(start), 250*time.Millisecond)
+
+	first.Close()
+	first.Close()
+	require.Len(t, b.keys, 1)
+	second.Close()
+	require.Empty(t, b.keys)
+}
+
+func TestRedisStore(t *testing.T) {
+	server := miniredis.RunT(t)
+
+	store, err := NewRedisStore("redis://"+server.Addr(), "tcprp:", 100*time.Millisecond)
+	require.NoError(t, err)
+	t.Cleanup(func() { store.Close() })
+
+	// Two replicas share the buckets of the same scope.
+	first := New(WithRPS(1), WithBurst(3), WithoutCooldown, WithStore(store, "global"))
+	second := New(WithRPS(1), WithBurst(3), WithoutCooldown, WithStore(store, "global"))
+	other := New(WithRPS(1), WithBurst(3), WithoutCooldown, WithStore(store, "app.com"))
+
+	res := first.Take("10.0.0.1")
+	require.True(t, res.Allowed)
+	require.Equal(t, 2, res.Remaining)
+	require.True(t, second.Take("10.0.0.1").Allowed)
+	require.True(t, first.Take("10.0.0.1").Allowed)
+
+	res = second.Take("10.0.0.1")
+	require.False(t, res.Allowed)
+	require.Equal(t, 0, res.Remaining)
+	require.Greater(t, res.RetryAfter, time.Duration(0))
+	require.LessOrEqual(t, res.RetryAfter, time.Second)
+
+	require.True(t, other.Take("10.0.0.1").Allowed)
+	require.True(t, first.Take("10.0.0.2").Allowed)
+	require.True(t, server.Exists("tcprp:global:10.0.0.1"))
+
+	// The local buckets are used while the store is unreachable.
+	server.Close()
+	for range 3 {
+		require.True(t, first.Take("10.0.0.1").Allowed)
+	}
+	require.False(t, first.Take("10.0.0.1").Allowed)
+}
+
+func TestJanitor(t *testing.T) {
+	limiter := New(WithRPS(1000), WithBurst(10), WithJanitor(20*time.Millisecond, 50*time.Millisecond))
+	defer limiter.Stop()
+
+	require.True(t, limiter.AllowIP("10.0.0.1"))
+	require.Equal(t, 1, limiter.Tracked())
+
+	require.Eventually(t, func() bool { return limiter.Tracked() == 0 }, time.Second, 10*time.Millisecond)
+
+	limiter.Stop()
+	limiter.Stop()
+}
+
+func TestCleanupKeepsCooldown(t *testing.T) {
+	limiter := New(WithRPS(1), WithBurst(1), WithCooldown(time.Minute))
+
+	require.True(t, limiter.AllowIP("10.0.0.1"))
+	require.False(t, limiter.AllowIP("10.0.0.1"))
+
+	limiter.Cleanup(0)
+	require.Equal(t, 1, limiter.Tracked())
+	require.False(t, limiter.AllowIP("10.0.0.1"))
+}
+
+func TestMaxClients(t *testing.T) {
+	t.Run("oldest", func(t *testing.T) {
+		limiter := New(WithRPS(1000), WithBurst(10), WithMaxClients(10, EvictOldest))
+
+		for i := range 10 {
+			require.True(t, limiter.AllowIP(fmt.Sprintf("10.0.0.%d", i)))
+			time.Sleep(time.Millisecond)
+		}
+		require.True(t, limiter.AllowIP("10.0.1.1"))
+		require.Equal(t, 10, limiter.Tracked())
+		require.Equal(t, uint64(1), limiter.Evicted())
+
+		_, ok := limiter.clients.Get("10.0.0.0")
+		require.False(t, ok, "the least recently seen client is evicted")
+	})
+
+	t.Run("cooldown", func(t *testing.T) {
+		limiter := New(WithRPS(1), WithBurst(1), WithCooldown(time.Minute), WithMaxClients(4, EvictOldest))
+
+		require.True(t, limiter.AllowIP("10.0.0.1"))
+		require.False(t, limiter.AllowIP("10.0.0.1"))
+		for i := range 20 {
+			time.Sleep(time.Millisecond)
+			limiter.AllowIP(fmt.Sprintf("10.0.1.%d", i))
+		}
+
+		_, ok := limiter.clients.Get("10.0.0.1")
+		require.True(t, ok, "clients cooling down are not evicted")
+		require.False(t, limiter.AllowIP("10.0.0.1"))
+	})
+
+	t.Run("reject", func(t *testing.T) {
+		limiter := New(WithRPS(1000), WithBurst(10), WithMaxClients(2, EvictReject))
+
+		require.True(t, limiter.AllowIP("10.0.0.1"))
+		require.True(t, limiter.AllowIP("10.0.0.2"))
+		require.False(t, limiter.AllowIP("10.0.0.3"))
+		require.True(t, limiter.AllowIP("10.0.0.1"))
+		require.Equal(t, 2, limiter.Tracked())
+	})
+}
@@ -26,6 +26,22 @@ func WithCooldown(cd time.Duration) OptFunc {
 	}
 }
 
+// WithStore shares the buckets of the limiter through store, under scope.
+// Limiters sharing a store must have distinct scopes. A nil store is ignored.
+func WithStore(store Store, scope string) OptFunc {
+	return func(l *Limiter) {
+		if store != nil {
+			l.store = store
+			l.scope = scope
+		}
+	}
+}
+
+// WithoutCooldown denies a client only while its bucket is empty.
+func WithoutCooldown(l *Limiter) {
+	l.cooldown = -1
+}
+
 func WithDefaultRPS(l *Limiter) {
 	l.rate = rate.Limit(10)
 }
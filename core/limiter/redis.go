@@ -0,0 +1,93 @@
+package limiter
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/time/rate"
+)
+
+// gcra implements the generic cell rate algorithm on the theoretical arrival time stored at KEYS[1].
+// ARGV are the emission interval and the burst, times are in microseconds of the server's clock
+// so that instances with skewed clocks agree. It returns allowed, remaining, retry after and reset.
+var gcra = redis.NewScript(`
+local interval = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+
+local time = redis.call("TIME")
+local now = tonumber(time[1]) * 1000000 + tonumber(time[2])
+
+local tat = tonumber(redis.call("GET", KEYS[1]))
+if not tat or tat < now then
+	tat = now
+end
+
+local tolerance = interval * burst
+local new_tat = tat + interval
+local allow_at = new_tat - tolerance
+
+if allow_at > now then
+	return {0, 0, allow_at - now, tat - now}
+end
+
+redis.call("SET", KEYS[1], new_tat, "PX", math.ceil((new_tat - now) / 1000))
+return {1, math.floor((now + tolerance - new_tat) / interval), 0, new_tat - now}
+`)
+
+// RedisStore is a Store keeping buckets in Redis, or any server speaking its protocol.
+type RedisStore struct {
+	client  redis.UniversalClient
+	prefix  string
+	timeout time.Duration
+}
+
+// NewRedisStore returns a new RedisStore connecting to the redis:// or rediss:// url.
+// Keys are prefixed with prefix, and calls give up after timeout.
+func NewRedisStore(url, prefix string, timeout time.Duration) (*RedisStore, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("invalid redis url: %w", err)
+	}
+
+	opts.DialTimeout = timeout
+	opts.ReadTimeout = timeout
+	opts.WriteTimeout = timeout
+	opts.MaxRetries = -1
+
+	return &RedisStore{
+		client:  redis.NewClient(opts),
+		prefix:  prefix,
+		timeout: timeout,
+	}, nil
+}
+
+// Take implements Store.
+func (s *RedisStore) Take(ctx context.Context, key string, limit rate.Limit, burst int) (Result, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	interval := int64(float64(time.Second/time.Microsecond) / float64(limit))
+
+	vals, err := gcra.Run(ctx, s.client, []string{s.prefix + key}, max(interval, 1), burst).Int64Slice()
+	if err != nil {
+		return Result{}, err
+	}
+	if len(vals) != 4 {
+		return Result{}, fmt.Errorf("unexpected gcra reply %v", vals)
+	}
+
+	return Result{
+		Allowed:    vals[0] == 1,
+		Limit:      burst,
+		Remaining:  int(vals[1]),
+		RetryAfter: time.Duration(vals[2]) * time.Microsecond,
+		Reset:      time.Duration(vals[3]) * time.Microsecond,
+	}, nil
+}
+
+// Close closes the connections to Redis.
+func (s *RedisStore) Close() error {
+	return s.client.Close()
+}
@@ -0,0 +1,18 @@
+package limiter
+
+import (
+	"context"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// storeRetry is how long a Limiter uses its local buckets after its store fails.
+const storeRetry = 5 * time.Second
+
+// Store keeps token buckets shared by multiple limiters, such as those of tcprp replicas.
+// Limiters keep their buckets in process by default, and fall back to them when their store fails.
+type Store interface {
+	// Take takes a token for key from a bucket refilled at limit tokens per second up to burst.
+	Take(ctx context.Context, key string, limit rate.Limit, burst int) (Result, error)
+}
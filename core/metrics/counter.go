@@ -0,0 +1,47 @@
+package metrics
+
+import "sync"
+
+// OtherLabel is the label counting occurrences past a Counter's label limit.
+const OtherLabel = "other"
+
+// DefaultLabelLimit is the default number of distinct labels tracked by a Counter.
+const DefaultLabelLimit = 64
+
+// Counter counts occurrences per label, bounding the number of distinct labels.
+type Counter struct {
+	mu     sync.Mutex
+	limit  int
+	counts map[string]uint64
+}
+
+// NewCounter returns a new Counter tracking up to limit distinct labels.
+func NewCounter(limit int) *Counter {
+	return &Counter{
+		limit:  limit,
+		counts: make(map[string]uint64),
+	}
+}
+
+// Inc increments the count of label, or of OtherLabel if the label limit is reached.
+func (c *Counter) Inc(label string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.counts[label]; !ok && len(c.counts) >= c.limit {
+		label = OtherLabel
+	}
+	c.counts[label]++
+}
+
+// Snapshot returns a copy of the counts per label.
+func (c *Counter) Snapshot() map[string]uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	snapshot := make(map[string]uint64, len(c.counts))
+	for label, count := range c.counts {
+		snapshot[label] = count
+	}
+	return snapshot
+}
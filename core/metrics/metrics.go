@@ -58,6 +58,12 @@ type Metrics struct {
 	ActiveConnections int32
 	// RTT represent the single roundtrip latency.
 	RTT uint32
+	// Fingerprints counts connections per JA4 TLS fingerprint.
+	Fingerprints *Counter
+	// WebSocketIngressMessages counts the WebSocket messages received from clients.
+	WebSocketIngressMessages uint64
+	// WebSocketEgressMessages counts the WebSocket messages sent to clients.
+	WebSocketEgressMessages uint64
 	// Track last reported values for delta calculation.
 	lastIngressBytes uint64
 	lastEgressBytes  uint64
@@ -66,7 +72,8 @@ type Metrics struct {
 // New creates a new Metrics instance.
 func New() *Metrics {
 	return &Metrics{
-		StartTime: time.Now(),
+		StartTime:    time.Now(),
+		Fingerprints: NewCounter(DefaultLabelLimit),
 	}
 }
 
@@ -80,6 +87,16 @@ func (m *Metrics) AddIngressBytes(bytes uint64) {
 	atomic.AddUint64(&m.IngressBytes, bytes)
 }
 
+// IncrementWebSocketIngressMessages atomically increments the WebSocket ingress message counter.
+func (m *Metrics) IncrementWebSocketIngressMessages() {
+	atomic.AddUint64(&m.WebSocketIngressMessages, 1)
+}
+
+// IncrementWebSocketEgressMessages atomically increments the WebSocket egress message counter.
+func (m *Metrics) IncrementWebSocketEgressMessages() {
+	atomic.AddUint64(&m.WebSocketEgressMessages, 1)
+}
+
 // IncrementConnections atomically increments the connection counter.
 func (m *Metrics) IncrementConnections() {
 	atomic.AddUint64(&m.ConnectionCount, 1)
@@ -101,6 +118,16 @@ func (m *Metrics) GetEgressBytes() uint64 {
 	return atomic.LoadUint64(&m.EgressBytes)
 }
 
+// GetWebSocketIngressMessages returns the current WebSocket ingress message count.
+func (m *Metrics) GetWebSocketIngressMessages() uint64 {
+	return atomic.LoadUint64(&m.WebSocketIngressMessages)
+}
+
+// GetWebSocketEgressMessages returns the current WebSocket egress message count.
+func (m *Metrics) GetWebSocketEgressMessages() uint64 {
+	return atomic.LoadUint64(&m.WebSocketEgressMessages)
+}
+
 // GetConnectionCount returns the total connection count.
 func (m *Metrics) GetConnectionCount() uint64 {
 	return atomic.LoadUint64(&m.ConnectionCount)
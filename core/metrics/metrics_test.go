@@ -7,12 +7,18 @@ import (
 	"github.com/stretchr/testify/require"
 )
 
+type nopCloser struct {
+	*bytes.Buffer
+}
+
+func (nopCloser) Close() error { return nil }
+
 func TestMetricsReadWriter(t *testing.T) {
 	data := []byte("hello world")
 	buf := bytes.NewBuffer(data)
 
 	m := New()
-	mrw := NewMetricsReadWriter(buf, m)
+	mrw := NewMetricsReadWriteCloser(nopCloser{buf}, m)
 
 	readBuf := make([]byte, len(data))
 	n, err := mrw.Read(readBuf)
@@ -26,3 +32,15 @@ func TestMetricsReadWriter(t *testing.T) {
 	require.Equal(t, len(writeData), n)
 	require.Equal(t, uint64(n), m.GetEgressBytes())
 }
+
+func TestCounter(t *testing.T) {
+	c := NewCounter(2)
+
+	c.Inc("a")
+	c.Inc("b")
+	c.Inc("a")
+	c.Inc("c")
+	c.Inc("d")
+
+	require.Equal(t, map[string]uint64{"a": 2, "b": 1, OtherLabel: 2}, c.Snapshot())
+}
@@ -0,0 +1,13 @@
+package proxy
+
+import (
+	"io"
+
+	"github.com/Dyastin-0/tcprp/core/config"
+)
+
+// withBandwidth throttles reads from the client src and the target dst
+// by the upload and download caps of proxy.
+func withBandwidth(src, dst io.ReadWriteCloser, proxy *config.Proxy, clientIP string) (io.ReadWriteCloser, io.ReadWriteCloser) {
+	return proxy.Upload.Throttle(src, clientIP), proxy.Download.Throttle(dst, clientIP)
+}
@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/Dyastin-0/tcprp/core/config"
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// encoder is a compressing writer reusable through Reset.
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(w io.Writer)
+}
+
+// encoders pools the encoders of each encoding.
+var encoders = map[string]*sync.Pool{
+	config.EncodingGzip: {New: func() any {
+		return gzip.NewWriter(nil)
+	}},
+	config.EncodingBrotli: {New: func() any {
+		return brotli.NewWriterLevel(nil, brotli.DefaultCompression)
+	}},
+	config.EncodingZstd: {New: func() any {
+		enc, _ := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		return enc
+	}},
+}
+
+// compress compresses the body of resp to req with the encoding negotiated by c, if resp is compressible.
+// Responses of unknown length, such as event streams, are flushed after every read from the backend.
+func compress(req *http.Request, resp *http.Response, c *config.Compression) {
+	if !c.Compressible(req, resp) {
+		return
+	}
+	addVary(resp.Header, "Accept-Encoding")
+
+	encoding := c.Negotiate(req.Header.Get("Accept-Encoding"))
+	if encoding == "" {
+		return
+	}
+
+	resp.Header.Set("Content-Encoding", encoding)
+	resp.Header.Del("Content-Length")
+	// The compressed body differs byte for byte, so a strong ETag becomes weak.
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		resp.Header.Set("ETag", "W/"+etag)
+	}
+
+	flush := resp.ContentLength < 0
+	resp.ContentLength = -1
+	resp.TransferEncoding = []string{"chunked"}
+
+	body := resp.Body
+	pr, pw := io.Pipe()
+	resp.Body = pr
+
+	go func() {
+		pool := encoders[encoding]
+		enc := pool.Get().(encoder)
+		enc.Reset(pw)
+
+		err := copyEncoded(enc, body, flush)
+		if closeErr := enc.Close(); err == nil {
+			err = closeErr
+		}
+		enc.Reset(nil)
+		pool.Put(enc)
+
+		body.Close()
+		pw.CloseWithError(err)
+	}()
+}
+
+// copyEncoded copies src to enc, flushing enc after every read if flush is set.
+func copyEncoded(enc encoder, src io.Reader, flush bool) error {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			if _, werr := enc.Write(buf[:n]); werr != nil {
+				return werr
+			}
+			if flush {
+				if ferr := enc.Flush(); ferr != nil {
+					return ferr
+				}
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// addVary adds name to the Vary header of h unless it is already listed.
+func addVary(h http.Header, name string) {
+	for _, value := range h.Values("Vary") {
+		for _, v := range strings.Split(value, ",") {
+			if v = strings.TrimSpace(v); v == "*" || strings.EqualFold(v, name) {
+				return
+			}
+		}
+	}
+	h.Add("Vary", name)
+}
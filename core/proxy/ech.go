@@ -0,0 +1,48 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/Dyastin-0/tcprp/core/config"
+	"github.com/Dyastin-0/tcprp/core/limiter"
+)
+
+// ech terminates a connection whose ClientHello is encrypted for the public name of outer,
+// and serves it with the proxy of the inner SNI if the server accepts ECH.
+func (p *Proxy) ech(conn net.Conn, outer *config.Proxy, fp Fingerprint) error {
+	tlsConfig := p.TLSConfig.Clone()
+	tlsConfig.EncryptedClientHelloKeys = outer.ECHKeys
+
+	tlsConn, err := p.terminate(conn, outer, tlsConfig)
+	if err != nil {
+		return err
+	}
+
+	state := tlsConn.ConnectionState()
+	sni := state.ServerName
+	proxy := outer
+
+	if state.ECHAccepted {
+		proxy = p.Config.GetProxy(sni)
+		if proxy == nil || !proxy.Terminate {
+			tlsConn.Close()
+			return fmt.Errorf("no terminating proxy found for inner SNI: %s", sni)
+		}
+	}
+
+	// The policies of the outer proxy were applied before the handshake,
+	// so they are only applied again for a different inner proxy.
+	if proxy != outer {
+		release, err := p.admit(tlsConn, proxy, sni, fp, true)
+		if err != nil {
+			return err
+		}
+		defer release()
+	}
+
+	if proxy.Proto == ProtoHTTP {
+		return p.http(tlsConn, proxy, sni, fp)
+	}
+	return p.stream(tlsConn, proxy, proxy.StreamTarget(limiter.ClientIP(conn)))
+}
@@ -0,0 +1,157 @@
+package proxy
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Fingerprint represents the TLS fingerprints of a ClientHello.
+type Fingerprint struct {
+	// JA3 is the MD5 hash of the JA3 string.
+	JA3 string
+	// JA4 is the JA4 fingerprint.
+	JA4 string
+}
+
+// Fingerprint returns the JA3 and JA4 fingerprints of m.
+func (m *ClientHelloMsg) Fingerprint() Fingerprint {
+	sum := md5.Sum([]byte(m.JA3()))
+	return Fingerprint{
+		JA3: hex.EncodeToString(sum[:]),
+		JA4: m.JA4(),
+	}
+}
+
+// JA3 returns the JA3 string of m, with GREASE values removed.
+// https://github.com/salesforce/ja3
+func (m *ClientHelloMsg) JA3() string {
+	exts := make([]uint16, 0, len(m.Extensions))
+	for _, ext := range m.Extensions {
+		exts = append(exts, ext.Type)
+	}
+
+	points := make([]string, len(m.SupportedPoints))
+	for i, p := range m.SupportedPoints {
+		points[i] = strconv.Itoa(int(p))
+	}
+
+	return strings.Join([]string{
+		strconv.Itoa(int(m.Vers)),
+		joinUint16(m.CipherSuites, "-", false),
+		joinUint16(exts, "-", false),
+		joinUint16(m.SupportedCurves, "-", false),
+		strings.Join(points, "-"),
+	}, ",")
+}
+
+// JA4 returns the JA4 fingerprint of m.
+// https://github.com/FoxIO-LLC/ja4/blob/main/technical_details/JA4.md
+func (m *ClientHelloMsg) JA4() string {
+	var vers string
+	switch m.MaxVersion() {
+	case tls.VersionTLS13:
+		vers = "13"
+	case tls.VersionTLS12:
+		vers = "12"
+	case tls.VersionTLS11:
+		vers = "11"
+	case tls.VersionTLS10:
+		vers = "10"
+	case 0x0300:
+		vers = "s3"
+	default:
+		vers = "00"
+	}
+
+	sni := "i"
+	if m.ServerName != "" {
+		sni = "d"
+	}
+
+	alpn := "00"
+	if len(m.ALPNProtocols) > 0 && m.ALPNProtocols[0] != "" {
+		proto := m.ALPNProtocols[0]
+		if !isAlphanumeric(proto[0]) || !isAlphanumeric(proto[len(proto)-1]) {
+			proto = hex.EncodeToString([]byte(proto))
+		}
+		alpn = string(proto[0]) + string(proto[len(proto)-1])
+	}
+
+	ciphers := withoutGREASE(m.CipherSuites)
+	slices.Sort(ciphers)
+
+	var exts []uint16
+	numExts := 0
+	for _, ext := range m.Extensions {
+		if isGREASE(ext.Type) {
+			continue
+		}
+		numExts++
+		if ext.Type != extensionServerName && ext.Type != extensionALPN {
+			exts = append(exts, ext.Type)
+		}
+	}
+	slices.Sort(exts)
+
+	extsHash := joinUint16(exts, ",", true)
+	if sigs := joinUint16(m.SignatureAlgorithms, ",", true); sigs != "" {
+		extsHash += "_" + sigs
+	}
+
+	return fmt.Sprintf("t%s%s%02d%02d%s_%s_%s",
+		vers, sni, min(len(ciphers), 99), min(numExts, 99), alpn,
+		truncatedHash(joinUint16(ciphers, ",", true)),
+		truncatedHash(extsHash),
+	)
+}
+
+// isAlphanumeric reports whether c is an ASCII letter or digit.
+func isAlphanumeric(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9'
+}
+
+// joinUint16 joins the non-GREASE values of list with sep, in decimal or four digit hex.
+func joinUint16(list []uint16, sep string, hex bool) string {
+	var b strings.Builder
+	for _, v := range list {
+		if isGREASE(v) {
+			continue
+		}
+		if b.Len() > 0 {
+			b.WriteString(sep)
+		}
+		if hex {
+			fmt.Fprintf(&b, "%04x", v)
+		} else {
+			b.WriteString(strconv.Itoa(int(v)))
+		}
+	}
+	return b.String()
+}
+
+// withoutGREASE returns a copy of list without GREASE values.
+func withoutGREASE(list []uint16) []uint16 {
+	out := make([]uint16, 0, len(list))
+	for _, v := range list {
+		if !isGREASE(v) {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// truncatedHash returns the first 12 hex characters of the SHA-256 of s,
+// or zeros if s is empty.
+func truncatedHash(s string) string {
+	if s == "" {
+		return "000000000000"
+	}
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])[:12]
+}
@@ -0,0 +1,140 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/Dyastin-0/tcprp/core/config"
+)
+
+// headerSlack is read past the header limit before failing, like net/http,
+// since the buffered reader reads ahead of the headers.
+const headerSlack = 4096
+
+// drainTimeout and maxDrainBytes bound draining a client after rejecting its request.
+const (
+	drainTimeout  = time.Second
+	maxDrainBytes = 256 << 10
+)
+
+// errHeaderTooLarge is returned by a countingReader reading past its limit.
+var errHeaderTooLarge = errors.New("request header too large")
+
+// errURITooLong is returned by readRequest if the request line alone exceeds the header limit.
+var errURITooLong = errors.New("request uri too long")
+
+// errBodyTooLarge is returned by a bodyLimitReader reading past its limit.
+var errBodyTooLarge = errors.New("request body too large")
+
+// countingReader counts the bytes read from a connection,
+// and fails reads past limit unless it is negative.
+type countingReader struct {
+	r     io.Reader
+	n     int64
+	limit int64
+	// lineEnded reports whether the end of a line was read while limit was set.
+	lineEnded bool
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	if cr.limit >= 0 {
+		if cr.n >= cr.limit {
+			return 0, errHeaderTooLarge
+		}
+		if remaining := cr.limit - cr.n; int64(len(p)) > remaining {
+			p = p[:remaining]
+		}
+	}
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	if cr.limit >= 0 && !cr.lineEnded {
+		cr.lineEnded = bytes.IndexByte(p[:n], '\n') >= 0
+	}
+	return n, err
+}
+
+// readRequest reads the next request on s, failing with errHeaderTooLarge
+// if its headers exceed the largest header limit of the proxy, or errURITooLong
+// if its request line alone does, and returns it with the size of its request line and headers.
+func (s *session) readRequest() (*http.Request, int64, error) {
+	start := s.counter.n - int64(s.bufrd.Buffered())
+	s.counter.limit = start + s.proxy.MaxHeaderBytes() + headerSlack
+	defer func() { s.counter.limit = -1 }()
+
+	buffered, _ := s.bufrd.Peek(s.bufrd.Buffered())
+	s.counter.lineEnded = bytes.IndexByte(buffered, '\n') >= 0
+
+	req, err := http.ReadRequest(s.bufrd)
+	if err != nil {
+		if errors.Is(err, errHeaderTooLarge) && !s.counter.lineEnded {
+			return nil, 0, errURITooLong
+		}
+		return nil, 0, err
+	}
+	return req, s.counter.n - int64(s.bufrd.Buffered()) - start, nil
+}
+
+// bodyLimitReader fails reads of a request body past its limit.
+type bodyLimitReader struct {
+	io.ReadCloser
+	remaining int64
+	exceeded  bool
+}
+
+func (br *bodyLimitReader) Read(p []byte) (int, error) {
+	if br.remaining < 0 {
+		br.exceeded = true
+		return 0, errBodyTooLarge
+	}
+	if int64(len(p)) > br.remaining+1 {
+		p = p[:br.remaining+1]
+	}
+	n, err := br.ReadCloser.Read(p)
+	br.remaining -= int64(n)
+	if br.remaining < 0 {
+		br.exceeded = true
+		return 0, errBodyTooLarge
+	}
+	return n, err
+}
+
+// tooLarge reports whether the body read past its limit. A nil bodyLimitReader never does.
+func (br *bodyLimitReader) tooLarge() bool {
+	return br != nil && br.exceeded
+}
+
+// checkLimits returns the status and message of the error response to req, whose request line
+// and headers are headerSize bytes, if it exceeds limits, or 0 otherwise.
+func checkLimits(req *http.Request, headerSize int64, limits config.RequestLimits) (int, string) {
+	switch {
+	case limits.MaxHeaderBytes > 0 && headerSize > limits.MaxHeaderBytes:
+		return http.StatusRequestHeaderFieldsTooLarge, "Request header fields too large"
+	case limits.MaxURILength > 0 && len(req.RequestURI) > limits.MaxURILength:
+		return http.StatusRequestURITooLong, "Request URI too long"
+	case limits.MaxBodyBytes > 0 && req.ContentLength > limits.MaxBodyBytes:
+		return http.StatusRequestEntityTooLarge, "Request body too large"
+	}
+	return 0, ""
+}
+
+// limitBody wraps the body of req, if its length is unknown, to fail once it exceeds maxBytes.
+// It returns nil if the body is not wrapped. The body is read while it is sent to the backend,
+// so a chunked body is found too large only after the backend received maxBytes of it.
+func limitBody(req *http.Request, maxBytes int64) *bodyLimitReader {
+	if maxBytes <= 0 || req.ContentLength >= 0 || req.Body == nil || req.Body == http.NoBody {
+		return nil
+	}
+	body := &bodyLimitReader{ReadCloser: req.Body, remaining: maxBytes}
+	req.Body = body
+	return body
+}
+
+// drain discards what the client still sends on s, so a client rejected before its request
+// was fully read gets the error response instead of a reset when the connection is closed.
+func (s *session) drain() {
+	setReadDeadline(s.conn, drainTimeout)
+	io.CopyN(io.Discard, s.conn, maxDrainBytes)
+}
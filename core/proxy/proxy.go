@@ -2,21 +2,35 @@ package proxy
 
 import (
 	"bufio"
+	"bytes"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"net"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/Dyastin-0/tcprp/core/cache"
 	"github.com/Dyastin-0/tcprp/core/config"
+	"github.com/Dyastin-0/tcprp/core/limiter"
 )
 
 // Proxy handles connection routing.
 type Proxy struct {
 	Config    *config.Config
 	TLSConfig *tls.Config
+	// AccessLog receives a record for every HTTP request, disabled if nil.
+	AccessLog *slog.Logger
+
+	mu sync.Mutex
+	// done is closed by Shutdown.
+	done         chan struct{}
+	shuttingDown bool
+	websockets   sync.WaitGroup
 }
 
 func New() *Proxy {
@@ -26,153 +40,613 @@ func New() *Proxy {
 }
 
 func (p *Proxy) Handler(conn net.Conn) error {
+	if !p.Config.Access.Allowed(limiter.ClientIP(conn)) {
+		reset(conn)
+		return fmt.Errorf("access denied for %s", limiter.ClientIP(conn))
+	}
+
 	if p.Config.GlobalLimiter != nil && !p.Config.GlobalLimiter.Allow(conn) {
 		conn.Close()
 		return fmt.Errorf("global rate limit exceeded")
 	}
 
+	if p.Config.GlobalConnLimiter != nil {
+		release, ok := p.Config.GlobalConnLimiter.Acquire(limiter.ClientIP(conn), conn)
+		if !ok {
+			conn.Close()
+			return fmt.Errorf("global connection limit exceeded")
+		}
+		defer release()
+	}
+
+	setReadDeadline(conn, p.Config.Timeouts.ClientHello)
+
 	conn, err := TLS(conn)
 	if err != nil {
+		conn.Close()
 		return err
 	}
 
-	sni := conn.(*TLSConn).Host()
+	conn.SetReadDeadline(time.Time{})
+
+	tlsConn := conn.(*TLSConn)
+	hello := tlsConn.ClientHelloMsg
+	sni := hello.ServerName
 	proxy := p.Config.GetProxy(sni)
 	if proxy == nil {
 		conn.Close()
 		return fmt.Errorf("no proxy found for SNI: %s", sni)
 	}
 
-	fmt.Printf("SNI: %s\n", sni)
+	fp := hello.Fingerprint()
+	p.logConnection(conn, hello, fp)
+
+	release, err := p.admit(conn, proxy, sni, fp, false)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	if hello.ECH {
+		if len(proxy.ECHKeys) > 0 {
+			return p.ech(conn, proxy, fp)
+		}
+		if p.Config.ECHPolicy == config.ECHReject {
+			conn.Close()
+			return fmt.Errorf("encrypted client hello rejected for SNI: %s", sni)
+		}
+	}
+
+	if target := proxy.MatchALPN(hello.ALPNProtocols); target != "" {
+		return p.stream(conn, proxy, target)
+	}
 
 	if proxy.Terminate {
-		conn = tls.Server(conn, p.TLSConfig)
+		conn, err = p.terminate(conn, proxy, p.TLSConfig)
+		if err != nil {
+			return err
+		}
 		if proxy.Proto == ProtoHTTP {
-			return p.http(conn, proxy)
+			return p.http(conn, proxy, sni, fp)
+		}
+	}
+
+	return p.stream(conn, proxy, proxy.StreamTarget(limiter.ClientIP(conn)))
+}
+
+// admit applies the connection policies of proxy to conn, whose ClientHello has fingerprint fp:
+// its access list, fingerprint rules, connection limit and maximum lifetime.
+// It returns a function releasing conn from them, or an error once conn is closed.
+// A denied access is answered with an alert unless the handshake is complete.
+func (p *Proxy) admit(conn net.Conn, proxy *config.Proxy, sni string, fp Fingerprint, handshaked bool) (func(), error) {
+	clientIP := limiter.ClientIP(conn)
+
+	if !proxy.Access.Allowed(clientIP) {
+		if !handshaked {
+			writeAlert(conn, alertAccessDenied)
 		}
+		conn.Close()
+		return nil, fmt.Errorf("access denied for %s to SNI: %s", clientIP, sni)
+	}
+
+	if proxy.Metrics != nil {
+		proxy.Metrics.Fingerprints.Inc(fp.JA4)
+	}
+
+	if !proxy.AllowFingerprint(fp.JA3, fp.JA4) {
+		conn.Close()
+		return nil, fmt.Errorf("tls fingerprint not allowed: %s", fp.JA4)
+	}
+
+	releaseConn := func() {}
+	if proxy.ConnLimiter != nil {
+		var ok bool
+		releaseConn, ok = proxy.ConnLimiter.Acquire(clientIP, conn)
+		if !ok {
+			conn.Close()
+			return nil, fmt.Errorf("connection limit exceeded for SNI: %s", sni)
+		}
+	}
+
+	stopTimer := func() bool { return false }
+	if lifetime := proxy.Timeouts.MaxLifetime; lifetime > 0 {
+		stopTimer = time.AfterFunc(lifetime, func() { conn.Close() }).Stop
 	}
 
-	return p.stream(conn, proxy)
+	return func() {
+		stopTimer()
+		releaseConn()
+	}, nil
 }
 
-func (p *Proxy) http(conn net.Conn, proxy *config.Proxy) error {
+func (p *Proxy) http(conn net.Conn, proxy *config.Proxy, sni string, fp Fingerprint) error {
 	defer conn.Close()
 
+	s := &session{
+		conn:     withWriteTimeout(conn, proxy.Timeouts.Write),
+		counter:  &countingReader{r: conn, limit: -1},
+		proxy:    proxy,
+		sni:      sni,
+		clientIP: limiter.ClientIP(conn),
+		fp:       fp,
+	}
+	s.bufrd = bufio.NewReader(s.counter)
+	s.geo = proxy.GeoIP.Lookup(s.clientIP)
+	s.vars = config.HeaderVars{
+		SNI:               s.sni,
+		ClientIP:          s.clientIP,
+		ClientCertSubject: clientCertSubject(conn),
+		Country:           s.geo.Country,
+		ASN:               s.geo.ASN,
+	}
+
 	if proxy.Limiter != nil && !proxy.Limiter.Allow(conn) {
-		p.writeError(conn, http.StatusTooManyRequests, "Rate limit exceeded")
+		p.writeError(s, nil, http.StatusTooManyRequests, "Rate limit exceeded")
 		return nil
 	}
 
-	bufrd := bufio.NewReader(conn)
+	for first := true; ; first = false {
+		if !first {
+			setReadDeadline(conn, proxy.Timeouts.Idle)
+			if _, err := s.bufrd.Peek(1); err != nil {
+				if err == io.EOF || isTimeout(err) {
+					return nil
+				}
+				return err
+			}
+		}
+
+		// No route is matched until the request is read.
+		s.vars.Route, s.routeHeaders = "", nil
+
+		setReadDeadline(conn, proxy.Timeouts.HeaderRead)
 
-	for {
-		req, err := http.ReadRequest(bufrd)
+		req, headerSize, err := s.readRequest()
 
-		conn.SetReadDeadline(time.Time{})
+		// The body is read while the request is sent to the backend.
+		setReadDeadline(conn, proxy.Timeouts.BodyRead)
 
 		if err != nil {
 			if err == io.EOF || isTimeout(err) {
 				return nil
 			}
+			if errors.Is(err, errHeaderTooLarge) {
+				p.writeError(s, nil, http.StatusRequestHeaderFieldsTooLarge, "Request header fields too large")
+				s.drain()
+				return nil
+			}
+			if errors.Is(err, errURITooLong) {
+				p.writeError(s, nil, http.StatusRequestURITooLong, "Request URI too long")
+				s.drain()
+				return nil
+			}
 			return err
 		}
 
-		route := proxy.MatchRoute(req.URL.Path)
+		keepAlive, err := p.serveRequest(s, req, headerSize)
+		if err != nil || !keepAlive {
+			return err
+		}
+	}
+}
+
+// serveRequest serves a single request on s, whose request line and headers are headerSize bytes,
+// and reports whether the connection can be reused.
+func (p *Proxy) serveRequest(s *session, req *http.Request, headerSize int64) (bool, error) {
+	proxy := s.proxy
+
+	rec := &accessRecord{
+		start:     time.Now(),
+		requestID: newRequestID(),
+		sni:       s.sni,
+		clientIP:  s.clientIP,
+		geo:       s.geo,
+		ja4:       s.fp.JA4,
+		method:    req.Method,
+		path:      req.URL.Path,
+	}
+	defer p.logAccess(rec)
+
+	req.Header.Set(RequestIDHeader, rec.requestID)
+	if proxy.GeoIP != nil {
+		setGeoHeaders(req.Header, s.geo)
+	}
+
+	route := proxy.MatchRequest(req, s.clientIP)
+	rec.route = route.Pattern
+	rec.target = route.Target
 
-		if route.Limiter != nil && !route.Limiter.Allow(conn) {
-			p.writeError(conn, http.StatusTooManyRequests, "Rate limit exceeded")
-			return nil
+	s.vars.Route = route.Pattern
+	s.routeHeaders = route.Headers
+	vars := s.vars
+
+	if !route.Access.Allowed(s.clientIP) {
+		rec.status = http.StatusForbidden
+		p.writeError(s, req, rec.status, "Access denied")
+		return false, nil
+	}
+
+	if status, message := checkLimits(req, headerSize, route.Limits); status != 0 {
+		rec.status = status
+		p.writeError(s, req, rec.status, message)
+		s.drain()
+		return false, nil
+	}
+	body := limitBody(req, route.Limits.MaxBodyBytes)
+
+	if route.WAF != nil {
+		verdict := route.WAF.Inspect(req)
+		rec.waf = verdict.Matches
+		if verdict.Status != 0 {
+			rec.status = verdict.Status
+			p.writeError(s, req, rec.status, "Request blocked")
+			s.drain()
+			return false, nil
 		}
+	}
 
-		isWebSocket := strings.EqualFold(req.Header.Get("Upgrade"), "websocket") &&
-			strings.Contains(strings.ToLower(req.Header.Get("Connection")), "upgrade")
+	// The limiter of the proxy, inherited by unmatched routes, was already taken for the connection.
+	routeLimiter := route.Limiter
+	if routeLimiter == proxy.Limiter {
+		routeLimiter = nil
+	}
+	rateLimited := func(limit limiter.Result) {
+		rec.status = http.StatusTooManyRequests
+		header := make(http.Header)
+		setRateLimitHeaders(header, limit)
+		p.writeErrorHeader(s, req, rec.status, "Rate limit exceeded", header)
+	}
 
-		req.URL.Path = route.RewrittenPath
-		if req.URL.RawPath != "" {
-			req.URL.RawPath = route.RewrittenPath
+	// Limits keyed on a JWT claim are taken once the token is verified, if it is verified at all.
+	verifiesJWT := proxy.Auth.VerifiesJWT() || route.Auth.VerifiesJWT()
+	limit := takeRequestLimits(req, s.clientIP, proxy.RequestLimiter, route.RequestLimiter, routeLimiter, verifiesJWT)
+	if !limit.Allowed {
+		rateLimited(limit)
+		return false, nil
+	}
+
+	var claims map[string]any
+	for _, auth := range []*config.Auth{proxy.Auth, route.Auth} {
+		res := auth.Authenticate(req)
+		if res.Status != 0 {
+			rec.status = res.Status
+			header := make(http.Header)
+			for _, challenge := range res.Challenges {
+				header.Add("WWW-Authenticate", challenge)
+			}
+			p.writeErrorHeader(s, req, rec.status, http.StatusText(rec.status), header)
+			return false, nil
 		}
+		if res.Claims != nil {
+			claims = res.Claims
+		}
+	}
 
-		backend, err := net.Dial("tcp", route.Target)
-		if err != nil {
-			p.writeError(conn, http.StatusBadGateway, "Failed to connect to backend")
-			return err
+	if verifiesJWT {
+		limit = takeClaimLimits(req, s.clientIP, claims, limit, proxy.RequestLimiter, route.RequestLimiter)
+		if !limit.Allowed {
+			rateLimited(limit)
+			return false, nil
 		}
+	}
 
-		if err = req.Write(backend); err != nil {
-			backend.Close()
-			p.writeError(conn, http.StatusBadGateway, "Failed to send request")
-			return err
+	for _, authRequest := range []*config.AuthRequest{proxy.AuthRequest, route.AuthRequest} {
+		if status, header := authRequest.Check(req, s.clientIP); status != http.StatusOK {
+			rec.status = status
+			p.writeErrorHeader(s, req, rec.status, http.StatusText(rec.status), header.Clone())
+			return false, nil
 		}
+	}
 
-		backendReader := bufio.NewReader(backend)
-		resp, err := http.ReadResponse(backendReader, req)
-		if err != nil {
-			backend.Close()
-			p.writeError(conn, http.StatusBadGateway, "Failed to read response")
-			return err
+	if route.ConnLimiter != nil {
+		release, ok := route.ConnLimiter.Acquire(s.clientIP, s.conn)
+		if !ok {
+			rec.status = http.StatusServiceUnavailable
+			p.writeError(s, req, rec.status, "Too many connections")
+			return false, nil
 		}
+		defer release()
+	}
+
+	// The upgrade is detected before the header rules, which must not strip it.
+	isWebSocket := strings.EqualFold(req.Header.Get("Upgrade"), "websocket") &&
+		strings.Contains(strings.ToLower(req.Header.Get("Connection")), "upgrade")
+
+	proxy.Headers.ApplyRequest(req.Header, vars)
+	route.Headers.ApplyRequest(req.Header, vars)
+	if isWebSocket {
+		req.Header.Set("Upgrade", "websocket")
+		req.Header.Set("Connection", "Upgrade")
+	}
+
+	static := proxy.Maintenance.Response(req)
+	if static == nil {
+		static = route.Response(req, s.sni)
+	}
+	if static != nil {
+		rec.target = ""
+		rec.status = static.StatusCode
+
+		static.Header.Set(RequestIDHeader, rec.requestID)
+		setRateLimitHeaders(static.Header, limit)
+		proxy.Headers.ApplyResponse(static.Header, vars)
+		route.Headers.ApplyResponse(static.Header, vars)
+
+		if err := p.respond(s.conn, req, static); err != nil {
+			return false, err
+		}
+		return !req.Close, nil
+	}
 
-		if err := resp.Write(conn); err != nil {
+	if isWebSocket && route.WebSocket != nil {
+		if status, message := route.WebSocket.Handshake(req); status != 0 {
+			rec.status = status
+			p.writeError(s, req, rec.status, message)
+			return false, nil
+		}
+	}
+
+	var cacheKey string
+	var cached *cache.Entry
+	if route.Cache != nil && !isWebSocket {
+		// The responses of the routes and split targets serving the same URI are kept apart.
+		cacheKey = cache.Key(req, route.Pattern+" "+route.Target)
+
+		entry, fresh := route.Cache.Lookup(cacheKey, req)
+		if fresh {
+			resp := entry.Response(req)
+			rec.target = ""
+			rec.status = resp.StatusCode
+
+			resp.Header.Set(CacheStatusHeader, "HIT")
+			resp.Header.Set(RequestIDHeader, rec.requestID)
+			setRateLimitHeaders(resp.Header, limit)
+			proxy.Headers.ApplyResponse(resp.Header, vars)
+			route.Headers.ApplyResponse(resp.Header, vars)
+			if route.Cookie != nil {
+				resp.Header.Add("Set-Cookie", route.Cookie.String())
+			}
+			if route.Compression != nil {
+				compress(req, resp, route.Compression)
+			}
+
+			if err := p.respond(s.conn, req, resp); err != nil {
+				return false, err
+			}
+			return !req.Close, nil
+		}
+
+		// A stale entry is revalidated with its validators, unless the client sent its own.
+		if entry != nil && cache.Conditional(req, entry) {
+			cached = entry
+		}
+	}
+
+	route.Rewrite(req)
+
+	backend, err := dial(route.Target, proxy.Timeouts.Dial)
+	if err != nil {
+		rec.status = http.StatusBadGateway
+		p.writeError(s, req, rec.status, "Failed to connect to backend")
+		return false, err
+	}
+
+	if err = req.Write(backend); err != nil {
+		// Closing the backend aborts the request it was sent so far.
+		backend.Close()
+		if body.tooLarge() {
+			rec.status = http.StatusRequestEntityTooLarge
+			p.writeError(s, req, rec.status, "Request body too large")
+			s.drain()
+			return false, nil
+		}
+		rec.status = http.StatusBadGateway
+		p.writeError(s, req, rec.status, "Failed to send request")
+		return false, err
+	}
+	s.conn.SetReadDeadline(time.Time{})
+
+	setReadDeadline(backend, proxy.Timeouts.ResponseHeader)
+
+	backendReader := bufio.NewReader(backend)
+	resp, err := http.ReadResponse(backendReader, req)
+	backend.SetReadDeadline(time.Time{})
+	if err != nil {
+		backend.Close()
+		rec.status = http.StatusBadGateway
+		p.writeError(s, req, rec.status, "Failed to read response")
+		return false, err
+	}
+	if route.Cache != nil {
+		// Responses to requests let through by an auth check may be personalised.
+		authenticated := proxy.Auth != nil || route.Auth != nil || proxy.AuthRequest != nil || route.AuthRequest != nil
+		switch {
+		case cached != nil && resp.StatusCode == http.StatusNotModified:
 			resp.Body.Close()
-			backend.Close()
-			return err
+			req.Header.Del("If-None-Match")
+			req.Header.Del("If-Modified-Since")
+			resp = route.Cache.Revalidate(cached, resp).Response(req)
+			resp.Header.Set(CacheStatusHeader, "REVALIDATED")
+		case cacheKey != "" && route.Cache.Store(cacheKey, req, resp, authenticated):
+			resp.Header.Set(CacheStatusHeader, "STORED")
+		default:
+			resp.Header.Set(CacheStatusHeader, "MISS")
 		}
+	}
+	rec.status = resp.StatusCode
+
+	resp.Header.Set(RequestIDHeader, rec.requestID)
+	setRateLimitHeaders(resp.Header, limit)
+	proxy.Headers.ApplyResponse(resp.Header, vars)
+	route.Headers.ApplyResponse(resp.Header, vars)
+
+	if route.Cookie != nil {
+		resp.Header.Add("Set-Cookie", route.Cookie.String())
+	}
+	if route.Compression != nil && !isWebSocket {
+		compress(req, resp, route.Compression)
+	}
+
+	// The backend is closed as soon as the client cannot be written to,
+	// so closing the body does not drain what the client will never read.
+	if err := resp.Write(&abortWriter{w: s.conn, abort: backend}); err != nil {
 		resp.Body.Close()
+		backend.Close()
+		return false, err
+	}
+	resp.Body.Close()
 
-		if isWebSocket && resp.StatusCode == http.StatusSwitchingProtocols {
-			clientConn := &BuffConn{Conn: conn, r: bufrd}
-			backendConn := &BuffConn{Conn: backend, r: backendReader}
+	if isWebSocket && resp.StatusCode == http.StatusSwitchingProtocols {
+		clientConn := &BuffConn{Conn: s.conn, r: s.bufrd}
+		backendConn := &BuffConn{Conn: backend, r: backendReader}
 
-			var rw io.ReadWriteCloser = clientConn
+		if route.WebSocket != nil {
+			src, dst := withBandwidth(clientConn, backendConn, proxy, s.clientIP)
 			if proxy.Metrics != nil {
-				rw = proxy.Metrics.NewProxyReadWriteCloser(clientConn)
+				src = proxy.Metrics.NewProxyReadWriteCloser(src)
 			}
+			return false, p.websocket(route.WebSocket, src, dst, proxy.Metrics)
+		}
 
-			return Stream(rw, backendConn)
+		src, dst := withIdleTimeout(clientConn, backendConn, proxy.Timeouts.StreamIdle)
+		src, dst = withBandwidth(src, dst, proxy, s.clientIP)
+		if proxy.Metrics != nil {
+			src = proxy.Metrics.NewProxyReadWriteCloser(src)
 		}
 
-		backend.Close()
+		return false, Stream(src, dst)
+	}
 
-		if strings.EqualFold(req.Header.Get("Connection"), "close") ||
-			strings.EqualFold(resp.Header.Get("Connection"), "close") {
-			return nil
-		}
+	backend.Close()
+
+	if strings.EqualFold(req.Header.Get("Connection"), "close") ||
+		strings.EqualFold(resp.Header.Get("Connection"), "close") {
+		return false, nil
 	}
+
+	return true, nil
 }
 
-func (p *Proxy) stream(conn net.Conn, proxy *config.Proxy) error {
+func (p *Proxy) stream(conn net.Conn, proxy *config.Proxy, target string) error {
 	defer conn.Close()
 
 	if proxy.Limiter != nil && !proxy.Limiter.Allow(conn) {
 		return nil
 	}
 
-	backend, err := net.Dial("tcp", proxy.Target)
+	if proxy.Maintenance.Enabled() {
+		return nil
+	}
+
+	backend, err := dial(target, proxy.Timeouts.Dial)
 	if err != nil {
 		return err
 	}
 	defer backend.Close()
 
-	var rw io.ReadWriteCloser = conn
+	src, dst := withIdleTimeout(conn, backend, proxy.Timeouts.StreamIdle)
+	src, dst = withBandwidth(src, dst, proxy, limiter.ClientIP(conn))
 	if proxy.Metrics != nil {
-		rw = proxy.Metrics.NewProxyReadWriteCloser(conn)
+		src = proxy.Metrics.NewProxyReadWriteCloser(src)
+	}
+
+	return Stream(src, dst)
+}
+
+// terminate performs the TLS handshake of conn within the proxy's handshake timeout.
+func (p *Proxy) terminate(conn net.Conn, proxy *config.Proxy, tlsConfig *tls.Config) (*tls.Conn, error) {
+	tlsConn := tls.Server(conn, tlsConfig)
+
+	setDeadline(conn, proxy.Timeouts.Handshake)
+	if err := tlsConn.Handshake(); err != nil {
+		tlsConn.Close()
+		return nil, err
 	}
+	conn.SetDeadline(time.Time{})
 
-	return Stream(rw, backend)
+	return tlsConn, nil
 }
 
-func (p *Proxy) writeError(conn net.Conn, statusCode int, message string) {
+// respond writes a response served by the proxy itself and closes its body,
+// draining the request body so the connection can be reused.
+func (p *Proxy) respond(conn net.Conn, req *http.Request, resp *http.Response) error {
+	// Closing the body also stops the encoder of a compressed body the client did not read.
+	defer resp.Body.Close()
+
+	io.Copy(io.Discard, req.Body)
+	req.Body.Close()
+	return resp.Write(conn)
+}
+
+// writeError writes an error response for req, rendered from the proxy's error pages if configured.
+// req may be nil if the error occurs before a request is read.
+func (p *Proxy) writeError(s *session, req *http.Request, statusCode int, message string) {
+	p.writeErrorHeader(s, req, statusCode, message, nil)
+}
+
+// writeErrorHeader is writeError with additional response headers.
+func (p *Proxy) writeErrorHeader(s *session, req *http.Request, statusCode int, message string, header http.Header) {
+	requestID, accept := "", ""
+	if req != nil {
+		requestID = req.Header.Get(RequestIDHeader)
+		accept = req.Header.Get("Accept")
+	}
+	if requestID == "" {
+		requestID = newRequestID()
+	}
+
+	contentType, body := "text/plain", []byte(message)
+	if s.proxy.ErrorPages != nil {
+		ct, b, ok := s.proxy.ErrorPages.Render(accept, config.ErrorData{
+			Status:     statusCode,
+			StatusText: http.StatusText(statusCode),
+			Message:    message,
+			RequestID:  requestID,
+		})
+		if ok {
+			contentType, body = ct, b
+		}
+	}
+
+	if header == nil {
+		header = make(http.Header)
+	}
+	s.proxy.Headers.ApplyResponse(header, s.vars)
+	s.routeHeaders.ApplyResponse(header, s.vars)
+
 	resp := &http.Response{
-		StatusCode: statusCode,
-		ProtoMajor: 1,
-		ProtoMinor: 1,
-		Header:     make(http.Header),
-		Body:       io.NopCloser(strings.NewReader(message)),
-	}
-	resp.Header.Set("Content-Type", "text/plain")
-	resp.Header.Set("Content-Length", fmt.Sprintf("%d", len(message)))
+		StatusCode:    statusCode,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+	}
+	resp.Header.Set("Content-Type", contentType)
 	resp.Header.Set("Connection", "close")
-	resp.Write(conn)
+	resp.Header.Set(RequestIDHeader, requestID)
+	resp.Write(s.conn)
+}
+
+// clientCertSubject returns the subject of the client certificate presented on conn, if any.
+func clientCertSubject(conn net.Conn) string {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return ""
+	}
+	certs := tlsConn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return ""
+	}
+	return certs[0].Subject.String()
+}
+
+// reset closes conn with a TCP reset instead of an orderly shutdown, if it is a TCP connection.
+func reset(conn net.Conn) {
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		tcpConn.SetLinger(0)
+	}
+	conn.Close()
 }
 
 func isTimeout(err error) bool {
@@ -2,19 +2,37 @@ package proxy
 
 import (
 	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ecdh"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
 	"io"
+	"log/slog"
 	"math/big"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
+	"github.com/Dyastin-0/tcprp/core/config"
+	"github.com/Dyastin-0/tcprp/core/geoip/geoiptest"
+	"github.com/andybalholm/brotli"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/klauspost/compress/zstd"
 	"github.com/stretchr/testify/require"
 )
 
@@ -48,6 +66,59 @@ func generateTestCert() (tls.Certificate, error) {
 	}, nil
 }
 
+// startTestProxy starts a proxy listening on :8085 with config
+// and returns it with an http client for app.com.
+func startTestProxy(t *testing.T, config string) (*Proxy, *http.Client) {
+	t.Helper()
+
+	cert, err := generateTestCert()
+	require.NoError(t, err)
+
+	proxy := New()
+	proxy.TLSConfig = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}
+
+	err = proxy.Config.LoadBytes([]byte(config))
+	require.NoError(t, err)
+
+	proxyLn, err := net.Listen("tcp", ":8085")
+	require.NoError(t, err)
+	t.Cleanup(func() { proxyLn.Close() })
+
+	go func() {
+		for {
+			conn, er := proxyLn.Accept()
+			if er != nil {
+				return
+			}
+			go proxy.Handler(conn)
+		}
+	}()
+
+	transport := &http.Transport{
+		TLSClientConfig: &tls.Config{
+			ServerName:         "app.com",
+			InsecureSkipVerify: true,
+		},
+	}
+	t.Cleanup(transport.CloseIdleConnections)
+
+	return proxy, &http.Client{Transport: transport}
+}
+
+// startTestBackend starts an http backend on addr.
+func startTestBackend(t *testing.T, addr string, handler http.HandlerFunc) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", addr)
+	require.NoError(t, err)
+
+	backend := &http.Server{Handler: handler}
+	go backend.Serve(ln)
+	t.Cleanup(func() { backend.Close() })
+}
+
 // TestTLSPassthrough tests TLS passthrough mode.
 func TestTLSPassthrough(t *testing.T) {
 	cert, err := generateTestCert()
@@ -397,6 +468,11 @@ proxies:
     terminate: true
     proto: http
     target: "localhost:8086"
+    headers:
+      request:
+        remove:
+          - Upgrade
+          - Connection
 `
 	err = proxy.Config.LoadBytes([]byte(config))
 	require.NoError(t, err)
@@ -497,3 +573,1678 @@ proxies:
 	require.NoError(t, err)
 	require.Equal(t, "test message", string(buf[:n]))
 }
+
+// TestHeaderRules tests request and response header manipulation.
+func TestHeaderRules(t *testing.T) {
+	_, client := startTestProxy(t, `
+proxies:
+  "app.com":
+    terminate: true
+    proto: http
+    target: "localhost:8086"
+    headers:
+      request:
+        set:
+          X-Forwarded-Host: "{sni}"
+      response:
+        set:
+          Strict-Transport-Security: "max-age=63072000"
+        add:
+          Link:
+            - "</app.css>; rel=preload"
+            - "</app.js>; rel=preload"
+        remove:
+          - Server
+    routes:
+      - pattern: "/api/*"
+        target: "localhost:8086"
+        headers:
+          request:
+            set:
+              X-Route: "{route}"
+            remove:
+              - X-Secret
+      - pattern: "/down/*"
+        target: "localhost:8099"
+        headers:
+          response:
+            add:
+              Access-Control-Allow-Origin: "*"
+`)
+
+	startTestBackend(t, ":8086", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", "backend")
+		w.Header().Set("Link", "</backend.css>; rel=preload")
+		w.Write([]byte(r.Header.Get("X-Forwarded-Host") + " " + r.Header.Get("X-Route") + " " + r.Header.Get("X-Secret")))
+	})
+
+	req, err := http.NewRequest(http.MethodGet, "https://localhost:8085/api/users", nil)
+	require.NoError(t, err)
+	req.Header.Set("X-Secret", "secret")
+
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	require.Equal(t, "app.com /api/* ", string(body))
+	require.Equal(t, "max-age=63072000", resp.Header.Get("Strict-Transport-Security"))
+	require.Equal(t, []string{"</backend.css>; rel=preload", "</app.css>; rel=preload", "</app.js>; rel=preload"}, resp.Header.Values("Link"))
+	require.Empty(t, resp.Header.Get("Server"))
+
+	// Error responses of the proxy get the response headers too.
+	resp, err = client.Get("https://localhost:8085/down/users")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusBadGateway, resp.StatusCode)
+	require.Equal(t, "max-age=63072000", resp.Header.Get("Strict-Transport-Security"))
+	require.Equal(t, "*", resp.Header.Get("Access-Control-Allow-Origin"))
+}
+
+// TestStaticActions tests responses served without a backend.
+func TestStaticActions(t *testing.T) {
+	proxy, client := startTestProxy(t, `
+proxies:
+  "app.com":
+    terminate: true
+    proto: http
+    target: "localhost:8086"
+    maintenance:
+      body: "<html>down</html>"
+      retry_after: 120
+    routes:
+      - pattern: "/old/*"
+        redirect:
+          to: "https://new.app.com{uri}"
+          status: 308
+      - pattern: "/dir/*"
+        redirect:
+          to: "{path}/"
+      - pattern: "/www/*"
+        redirect:
+          to: "https://{host}{uri}"
+      - pattern: "/health"
+        respond:
+          status: 200
+          body: "ok"
+`)
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+
+	startTestBackend(t, ":8086", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("backend"))
+	})
+
+	resp, err := client.Get("https://localhost:8085/old/page?id=1")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusPermanentRedirect, resp.StatusCode)
+	require.Equal(t, "https://new.app.com/old/page?id=1", resp.Header.Get("Location"))
+
+	// Neither the Host header nor the path can redirect to another host.
+	resp, err = client.Get("https://localhost:8085//dir/evil.com")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusFound, resp.StatusCode)
+	require.Equal(t, "/dir/evil.com/", resp.Header.Get("Location"))
+
+	req, err := http.NewRequest(http.MethodGet, "https://localhost:8085/www/page", nil)
+	require.NoError(t, err)
+	req.Host = "evil.com"
+	resp, err = client.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, "https://app.com/www/page", resp.Header.Get("Location"))
+
+	resp, err = client.Get("https://localhost:8085/health")
+	require.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "ok", string(body))
+
+	require.NoError(t, proxy.Config.SetMaintenance("app.com", true))
+
+	resp, err = client.Get("https://localhost:8085/")
+	require.NoError(t, err)
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	require.Equal(t, "120", resp.Header.Get("Retry-After"))
+	require.Equal(t, "<html>down</html>", string(body))
+
+	require.NoError(t, proxy.Config.SetMaintenance("app.com", false))
+
+	resp, err = client.Get("https://localhost:8085/")
+	require.NoError(t, err)
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.Equal(t, "backend", string(body))
+}
+
+// TestErrorPages tests error pages negotiated by the Accept header.
+func TestErrorPages(t *testing.T) {
+	_, client := startTestProxy(t, `
+proxies:
+  "app.com":
+    terminate: true
+    proto: http
+    target: "localhost:8099"
+    error_pages:
+      5xx:
+        html: "<h1>{{.Status}} {{.StatusText}}</h1><p>{{.RequestID}}</p>"
+        json: '{"error": {{json .Message}}, "request_id": {{json .RequestID}}}'
+`)
+
+	req, err := http.NewRequest(http.MethodGet, "https://localhost:8085/", nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept", "text/html,application/json;q=0.9")
+
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	requestID := resp.Header.Get(RequestIDHeader)
+	require.NotEmpty(t, requestID)
+	require.Equal(t, http.StatusBadGateway, resp.StatusCode)
+	require.Equal(t, "text/html; charset=utf-8", resp.Header.Get("Content-Type"))
+	require.Equal(t, "<h1>502 Bad Gateway</h1><p>"+requestID+"</p>", string(body))
+
+	req.Header.Set("Accept", "application/json")
+
+	resp, err = client.Do(req)
+	require.NoError(t, err)
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	requestID = resp.Header.Get(RequestIDHeader)
+	require.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	require.JSONEq(t, `{"error": "Failed to connect to backend", "request_id": "`+requestID+`"}`, string(body))
+}
+
+// TestALPNRouting tests passthrough routing by SNI and ALPN.
+func TestALPNRouting(t *testing.T) {
+	cert, err := generateTestCert()
+	require.NoError(t, err)
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"h2", "acme-tls/1"},
+	}
+
+	startTestTLSBackend := func(addr, banner string) {
+		ln, err := tls.Listen("tcp", addr, tlsConfig)
+		require.NoError(t, err)
+		t.Cleanup(func() { ln.Close() })
+
+		go func() {
+			for {
+				conn, er := ln.Accept()
+				if er != nil {
+					return
+				}
+				conn.Write([]byte(banner))
+				conn.Close()
+			}
+		}()
+	}
+
+	startTestTLSBackend(":8086", "default")
+	startTestTLSBackend(":8087", "acme")
+
+	startTestProxy(t, `
+proxies:
+  "app.com":
+    target: "localhost:8086"
+    alpn:
+      - protocols: ["acme-tls/1"]
+        target: "localhost:8087"
+`)
+
+	dial := func(protos ...string) string {
+		conn, err := tls.Dial("tcp", "localhost:8085", &tls.Config{
+			ServerName:         "app.com",
+			NextProtos:         protos,
+			InsecureSkipVerify: true,
+		})
+		require.NoError(t, err)
+		defer conn.Close()
+
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		banner, err := io.ReadAll(conn)
+		require.NoError(t, err)
+		return string(banner)
+	}
+
+	require.Equal(t, "acme", dial("acme-tls/1"))
+	require.Equal(t, "default", dial("h2", "http/1.1"))
+	require.Equal(t, "default", dial())
+}
+
+// TestFingerprintRules tests denying connections by TLS fingerprint.
+func TestFingerprintRules(t *testing.T) {
+	denied := &tls.Config{
+		ServerName:         "app.com",
+		MaxVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: true,
+	}
+
+	hello, err := readClientHello(bytes.NewReader(clientHello(t, denied)))
+	require.NoError(t, err)
+
+	proxy, client := startTestProxy(t, `
+proxies:
+  "app.com":
+    terminate: true
+    proto: http
+    target: "localhost:8086"
+    fingerprints:
+      - ja4: "`+hello.Fingerprint().JA4+`"
+        action: deny
+`)
+
+	startTestBackend(t, ":8086", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("backend"))
+	})
+
+	_, err = tls.Dial("tcp", "localhost:8085", denied)
+	require.Error(t, err)
+
+	resp, err := client.Get("https://localhost:8085/")
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	snapshot := proxy.Config.GetProxy("app.com").Metrics.Fingerprints.Snapshot()
+	require.Equal(t, uint64(1), snapshot[hello.Fingerprint().JA4])
+}
+
+// generateTestECHKey returns a marshalled X25519 ECHConfig for publicName and its private key.
+func generateTestECHKey(t *testing.T, publicName string) ([]byte, []byte) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	var contents []byte
+	contents = append(contents, 1)                             // config_id
+	contents = binary.BigEndian.AppendUint16(contents, 0x0020) // DHKEM(X25519, HKDF-SHA256)
+	contents = binary.BigEndian.AppendUint16(contents, uint16(len(key.PublicKey().Bytes())))
+	contents = append(contents, key.PublicKey().Bytes()...)
+	contents = binary.BigEndian.AppendUint16(contents, 4)
+	contents = binary.BigEndian.AppendUint16(contents, 0x0001) // HKDF-SHA256
+	contents = binary.BigEndian.AppendUint16(contents, 0x0001) // AES-128-GCM
+	contents = append(contents, 0)                             // maximum_name_length
+	contents = append(contents, byte(len(publicName)))
+	contents = append(contents, publicName...)
+	contents = binary.BigEndian.AppendUint16(contents, 0) // extensions
+
+	var config []byte
+	config = binary.BigEndian.AppendUint16(config, 0xfe0d)
+	config = binary.BigEndian.AppendUint16(config, uint16(len(contents)))
+	config = append(config, contents...)
+
+	return config, key.Bytes()
+}
+
+// TestECH tests routing on the inner SNI of an encrypted ClientHello.
+func TestECH(t *testing.T) {
+	echConfig, echKey := generateTestECHKey(t, "app.com")
+
+	proxy, client := startTestProxy(t, `
+proxies:
+  "app.com":
+    terminate: true
+    proto: http
+    target: "localhost:8086"
+    max_conns:
+      per_ip: 2
+    ech_keys:
+      - config: "`+base64.StdEncoding.EncodeToString(echConfig)+`"
+        private_key: "`+base64.StdEncoding.EncodeToString(echKey)+`"
+  "test.com":
+    terminate: true
+    proto: http
+    target: "localhost:8087"
+`)
+
+	startTestBackend(t, ":8086", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("public"))
+	})
+	startTestBackend(t, ":8087", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("inner"))
+	})
+
+	echConfigList := binary.BigEndian.AppendUint16(nil, uint16(len(echConfig)))
+	echConfigList = append(echConfigList, echConfig...)
+
+	transport := client.Transport.(*http.Transport)
+	transport.TLSClientConfig.ServerName = "test.com"
+	transport.TLSClientConfig.EncryptedClientHelloConfigList = echConfigList
+
+	resp, err := client.Get("https://localhost:8085/")
+	require.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	require.True(t, resp.TLS.ECHAccepted)
+	require.Equal(t, "inner", string(body))
+
+	// The connection policies of the inner proxy apply too.
+	require.Len(t, proxy.Config.GetProxy("test.com").Metrics.Fingerprints.Snapshot(), 1)
+
+	// An inner SNI served by the outer proxy counts once against its connection cap,
+	// leaving room for this second connection while the first one is still open.
+	public := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+		ServerName:                     "app.com",
+		InsecureSkipVerify:             true,
+		EncryptedClientHelloConfigList: echConfigList,
+	}}}
+	defer public.CloseIdleConnections()
+
+	resp, err = public.Get("https://localhost:8085/")
+	require.NoError(t, err)
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	require.True(t, resp.TLS.ECHAccepted)
+	require.Equal(t, "public", string(body))
+}
+
+// TestTimeouts tests that idle clients are disconnected.
+func TestTimeouts(t *testing.T) {
+	startTestProxy(t, `
+timeouts:
+  client_hello: 200ms
+proxies:
+  "app.com":
+    terminate: true
+    proto: http
+    target: "localhost:8086"
+    timeouts:
+      header_read: 200ms
+      body_read: 200ms
+      response_header: 200ms
+      write: 200ms
+`)
+
+	unread := make(chan struct{})
+	startTestBackend(t, ":8086", func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/stalled":
+			time.Sleep(time.Second)
+		case "/unread":
+			defer close(unread)
+			chunk := make([]byte, 64<<10)
+			for {
+				if _, err := w.Write(chunk); err != nil {
+					return
+				}
+			}
+		}
+		w.Write([]byte("backend"))
+	})
+
+	conn, err := net.Dial("tcp", "localhost:8085")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	require.ErrorIs(t, err, io.EOF)
+
+	tlsConn, err := tls.Dial("tcp", "localhost:8085", &tls.Config{
+		ServerName:         "app.com",
+		InsecureSkipVerify: true,
+	})
+	require.NoError(t, err)
+	defer tlsConn.Close()
+
+	_, err = tlsConn.Write([]byte("GET / HTTP/1.1\r\nHost: app.com\r\n"))
+	require.NoError(t, err)
+
+	tlsConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = tlsConn.Read(make([]byte, 1))
+	require.Error(t, err)
+	require.False(t, isTimeout(err))
+
+	// A client sending its body too slowly is disconnected too.
+	slowBody, err := tls.Dial("tcp", "localhost:8085", &tls.Config{
+		ServerName:         "app.com",
+		InsecureSkipVerify: true,
+	})
+	require.NoError(t, err)
+	defer slowBody.Close()
+
+	_, err = slowBody.Write([]byte("POST / HTTP/1.1\r\nHost: app.com\r\nContent-Length: 10\r\n\r\nab"))
+	require.NoError(t, err)
+
+	slowBody.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = io.ReadAll(slowBody)
+	require.False(t, isTimeout(err))
+
+	// A backend not answering in time gets a 502.
+	stalled, err := tls.Dial("tcp", "localhost:8085", &tls.Config{
+		ServerName:         "app.com",
+		InsecureSkipVerify: true,
+	})
+	require.NoError(t, err)
+	defer stalled.Close()
+
+	_, err = stalled.Write([]byte("GET /stalled HTTP/1.1\r\nHost: app.com\r\n\r\n"))
+	require.NoError(t, err)
+
+	stalled.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	resp, err := http.ReadResponse(bufio.NewReader(stalled), nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusBadGateway, resp.StatusCode)
+
+	// A client that stops reading is disconnected, releasing the backend.
+	reader, err := tls.Dial("tcp", "localhost:8085", &tls.Config{
+		ServerName:         "app.com",
+		InsecureSkipVerify: true,
+	})
+	require.NoError(t, err)
+	defer reader.Close()
+
+	_, err = reader.Write([]byte("GET /unread HTTP/1.1\r\nHost: app.com\r\n\r\n"))
+	require.NoError(t, err)
+
+	select {
+	case <-unread:
+	case <-time.After(5 * time.Second):
+		t.Fatal("backend was not released")
+	}
+}
+
+// TestConnLimits tests concurrent connection caps per proxy and per route.
+func TestConnLimits(t *testing.T) {
+	proxy, client := startTestProxy(t, `
+proxies:
+  "app.com":
+    terminate: true
+    proto: http
+    target: "localhost:8086"
+    max_conns:
+      max: 2
+    routes:
+      - pattern: "/slow"
+        target: "localhost:8086"
+        max_conns:
+          per_ip: 1
+`)
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+	startTestBackend(t, ":8086", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			started <- struct{}{}
+			<-release
+		}
+		w.Write([]byte("backend"))
+	})
+
+	done := make(chan error)
+	go func() {
+		resp, err := client.Get("https://localhost:8085/slow")
+		if err == nil {
+			resp.Body.Close()
+		}
+		done <- err
+	}()
+	<-started
+
+	resp, err := client.Get("https://localhost:8085/slow")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+
+	p := proxy.Config.GetProxy("app.com")
+	require.Eventually(t, func() bool { return p.ConnLimiter.Active() == 1 }, time.Second, 10*time.Millisecond,
+		"the rejected request releases its slot")
+
+	held, err := tls.Dial("tcp", "localhost:8085", &tls.Config{ServerName: "app.com", InsecureSkipVerify: true})
+	require.NoError(t, err)
+	defer held.Close()
+
+	// Both slots are now held, by the slow request and the idle connection above.
+	conn, err := tls.Dial("tcp", "localhost:8085", &tls.Config{ServerName: "app.com", InsecureSkipVerify: true})
+	if err == nil {
+		_, err = conn.Read(make([]byte, 1))
+		conn.Close()
+	}
+	require.Error(t, err)
+
+	close(release)
+	require.NoError(t, <-done)
+
+	require.Equal(t, uint64(1), p.ConnLimiter.Rejected())
+	require.Equal(t, uint64(1), p.Routes[0].ConnLimiter.Rejected())
+}
+
+// TestRequestLimits tests per-request rate limits and their response headers.
+func TestRequestLimits(t *testing.T) {
+	_, client := startTestProxy(t, `
+proxies:
+  "app.com":
+    terminate: true
+    proto: http
+    target: "localhost:8086"
+    routes:
+      - pattern: "/api/*"
+        target: "localhost:8086"
+        request_limit:
+          key: "header:X-Tenant"
+          rate: 1
+          burst: 2
+          methods:
+            delete:
+              rate: 1
+              burst: 1
+`)
+
+	startTestBackend(t, ":8086", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("backend"))
+	})
+
+	do := func(method, tenant string) *http.Response {
+		req, err := http.NewRequest(method, "https://localhost:8085/api/items", nil)
+		require.NoError(t, err)
+		req.Header.Set("X-Tenant", tenant)
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp
+	}
+
+	resp := do(http.MethodGet, "acme")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "2", resp.Header.Get("RateLimit-Limit"))
+	require.Equal(t, "1", resp.Header.Get("RateLimit-Remaining"))
+
+	resp = do(http.MethodGet, "acme")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "0", resp.Header.Get("RateLimit-Remaining"))
+
+	resp = do(http.MethodGet, "acme")
+	require.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	require.Equal(t, "1", resp.Header.Get("Retry-After"))
+	require.Equal(t, "0", resp.Header.Get("RateLimit-Remaining"))
+
+	resp = do(http.MethodGet, "other")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = do(http.MethodDelete, "acme")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "1", resp.Header.Get("RateLimit-Limit"))
+
+	resp = do(http.MethodDelete, "acme")
+	require.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+}
+
+// TestRequestLimitCharges tests that a request is only charged up to the limit denying it,
+// and that the proxy rate limit is not charged per request on unmatched routes.
+func TestRequestLimitCharges(t *testing.T) {
+	_, client := startTestProxy(t, `
+proxies:
+  "app.com":
+    terminate: true
+    proto: http
+    target: "localhost:8086"
+    rate_limit:
+      rate: 1
+      burst: 2
+    request_limit:
+      key: "header:X-Tenant"
+      rate: 1
+      burst: 2
+    routes:
+      - pattern: "/api/*"
+        target: "localhost:8086"
+        request_limit:
+          rate: 1
+          burst: 3
+`)
+
+	startTestBackend(t, ":8086", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("backend"))
+	})
+
+	get := func(path, tenant string) int {
+		req, err := http.NewRequest(http.MethodGet, "https://localhost:8085"+path, nil)
+		require.NoError(t, err)
+		req.Header.Set("X-Tenant", tenant)
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	require.Equal(t, http.StatusOK, get("/api/items", "acme"))
+	require.Equal(t, http.StatusOK, get("/api/items", "acme"))
+	require.Equal(t, http.StatusTooManyRequests, get("/api/items", "acme"))
+
+	// The request denied by the proxy limit did not take from the route limit.
+	require.Equal(t, http.StatusOK, get("/api/items", "other"))
+
+	// The keep-alive connection took from the proxy rate limit once.
+	for _, tenant := range []string{"a", "b", "c", "d"} {
+		require.Equal(t, http.StatusOK, get("/", tenant))
+	}
+}
+
+// TestClaimRequestLimit tests request limits keyed on the claim of a verified JWT.
+func TestClaimRequestLimit(t *testing.T) {
+	_, client := startTestProxy(t, `
+proxies:
+  "app.com":
+    terminate: true
+    proto: http
+    target: "localhost:8086"
+    auth:
+      jwt:
+        secret: "jwt-secret"
+    request_limit:
+      key: "jwt:sub"
+      rate: 1
+      burst: 1
+`)
+
+	startTestBackend(t, ":8086", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("backend"))
+	})
+
+	get := func(secret, sub string) int {
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+			"sub": sub,
+			"exp": time.Now().Add(time.Minute).Unix(),
+		}).SignedString([]byte(secret))
+		require.NoError(t, err)
+
+		req, err := http.NewRequest(http.MethodGet, "https://localhost:8085/", nil)
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// A forged token does not take from the bucket of the claim it names.
+	require.Equal(t, http.StatusUnauthorized, get("forged", "alice"))
+	require.Equal(t, http.StatusOK, get("jwt-secret", "alice"))
+	require.Equal(t, http.StatusTooManyRequests, get("jwt-secret", "alice"))
+	require.Equal(t, http.StatusOK, get("jwt-secret", "bob"))
+}
+
+// TestBandwidth tests bandwidth caps on a streamed connection.
+func TestBandwidth(t *testing.T) {
+	startTestProxy(t, `
+proxies:
+  "app.com":
+    terminate: true
+    target: "localhost:8086"
+    bandwidth:
+      per_conn:
+        download: 20000
+        burst: 10000
+`)
+
+	backendLn, err := net.Listen("tcp", ":8086")
+	require.NoError(t, err)
+	t.Cleanup(func() { backendLn.Close() })
+
+	go func() {
+		conn, err := backendLn.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write(make([]byte, 30000))
+	}()
+
+	conn, err := tls.Dial("tcp", "localhost:8085", &tls.Config{ServerName: "app.com", InsecureSkipVerify: true})
+	require.NoError(t, err)
+	defer conn.Close()
+
+	start := time.Now()
+	n, err := io.Copy(io.Discard, conn)
+	require.NoError(t, err)
+	require.Equal(t, int64(30000), n)
+	require.GreaterOrEqual(t, time.Since(start), 900*time.Millisecond)
+}
+
+// TestAccessControl tests that denied clients are refused at the global, proxy and route levels.
+func TestAccessControl(t *testing.T) {
+	clientConfig := &tls.Config{ServerName: "app.com", InsecureSkipVerify: true}
+
+	t.Run("global", func(t *testing.T) {
+		startTestProxy(t, `
+access:
+  deny: ["127.0.0.0/8", "::1"]
+proxies:
+  "app.com":
+    target: "localhost:8086"
+`)
+
+		_, err := tls.Dial("tcp", "localhost:8085", clientConfig)
+		require.ErrorIs(t, err, syscall.ECONNRESET)
+	})
+
+	t.Run("proxy", func(t *testing.T) {
+		startTestProxy(t, `
+proxies:
+  "app.com":
+    target: "localhost:8086"
+    access:
+      allow: ["10.0.0.0/8"]
+`)
+
+		_, err := tls.Dial("tcp", "localhost:8085", clientConfig)
+		require.ErrorContains(t, err, "access denied")
+	})
+
+	t.Run("route", func(t *testing.T) {
+		_, client := startTestProxy(t, `
+proxies:
+  "app.com":
+    terminate: true
+    proto: http
+    target: "localhost:8086"
+    routes:
+      - pattern: "/admin/*"
+        target: "localhost:8086"
+        access:
+          deny: ["127.0.0.0/8", "::1"]
+`)
+		startTestBackend(t, ":8086", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("backend"))
+		})
+
+		resp, err := client.Get("https://localhost:8085/admin/users")
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+		resp, err = client.Get("https://localhost:8085/")
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	})
+}
+
+func TestGeoIP(t *testing.T) {
+	db := geoiptest.Write(t, map[string]geoiptest.Record{
+		"127.0.0.0/8": {Country: "NL", ASN: 64512},
+	})
+
+	t.Run("headers", func(t *testing.T) {
+		_, client := startTestProxy(t, `
+geoip:
+  databases: ["`+db+`"]
+proxies:
+  "app.com":
+    terminate: true
+    proto: http
+    target: "localhost:8086"
+    headers:
+      request:
+        set:
+          X-Geo: "{country}/{asn}"
+    routes:
+      - pattern: "/"
+        target: "localhost:8087"
+        geo:
+          countries: ["DE"]
+`)
+		startTestBackend(t, ":8086", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(r.Header.Get("X-Client-Country") + " " + r.Header.Get("X-Client-ASN") + " " + r.Header.Get("X-Geo")))
+		})
+
+		req, err := http.NewRequest(http.MethodGet, "https://127.0.0.1:8085/", nil)
+		require.NoError(t, err)
+		req.Header.Set("X-Client-ASN", "1")
+
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.NoError(t, err)
+		require.Equal(t, "NL 64512 NL/64512", string(body))
+	})
+
+	t.Run("access", func(t *testing.T) {
+		startTestProxy(t, `
+geoip:
+  databases: ["`+db+`"]
+proxies:
+  "app.com":
+    target: "localhost:8086"
+    access:
+      deny_countries: ["NL"]
+`)
+
+		_, err := tls.Dial("tcp", "127.0.0.1:8085", &tls.Config{ServerName: "app.com", InsecureSkipVerify: true})
+		require.ErrorContains(t, err, "access denied")
+	})
+}
+
+func TestAuth(t *testing.T) {
+	_, client := startTestProxy(t, `
+proxies:
+  "app.com":
+    terminate: true
+    proto: http
+    target: "localhost:8086"
+    auth:
+      api_key:
+        keys: ["key-1"]
+    routes:
+      - pattern: "/admin/*"
+        target: "localhost:8099"
+        auth:
+          realm: "admin"
+          jwt:
+            secret: "jwt-secret"
+`)
+	startTestBackend(t, ":8086", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("backend"))
+	})
+
+	get := func(path, key string) *http.Response {
+		req, err := http.NewRequest(http.MethodGet, "https://localhost:8085"+path, nil)
+		require.NoError(t, err)
+		if key != "" {
+			req.Header.Set("X-Api-Key", key)
+		}
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp
+	}
+
+	require.Equal(t, http.StatusUnauthorized, get("/", "").StatusCode)
+	require.Equal(t, http.StatusUnauthorized, get("/", "wrong").StatusCode)
+	require.Equal(t, http.StatusOK, get("/", "key-1").StatusCode)
+
+	// The backend of the route is down, so a 401 shows it was never dialed.
+	resp := get("/admin/users", "key-1")
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	require.Equal(t, `Bearer realm="admin"`, resp.Header.Get("WWW-Authenticate"))
+}
+
+func TestAuthRequest(t *testing.T) {
+	service := &http.Server{Addr: ":8087", Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Forwarded-Uri") == "/admin" || r.Header.Get("Cookie") != "session=ok" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Header().Set("X-User", "alice")
+	})}
+	go service.ListenAndServe()
+	t.Cleanup(func() { service.Close() })
+
+	_, client := startTestProxy(t, `
+proxies:
+  "app.com":
+    terminate: true
+    proto: http
+    target: "localhost:8086"
+    auth_request:
+      url: "http://localhost:8087/verify"
+      response_headers: ["X-User"]
+    routes:
+      - pattern: "/admin"
+        target: "localhost:8099"
+`)
+	startTestBackend(t, ":8086", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("X-User")))
+	})
+
+	get := func(path, cookie string) (*http.Response, string) {
+		req, err := http.NewRequest(http.MethodGet, "https://localhost:8085"+path, nil)
+		require.NoError(t, err)
+		req.Header.Set("Cookie", cookie)
+		req.Header.Set("X-User", "spoofed")
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.NoError(t, err)
+		return resp, string(body)
+	}
+
+	require.Eventually(t, func() bool {
+		resp, _ := get("/", "session=ok")
+		return resp.StatusCode == http.StatusOK
+	}, time.Second, 10*time.Millisecond)
+
+	resp, body := get("/", "session=ok")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "alice", body)
+
+	resp, _ = get("/", "session=expired")
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	// The backend of the route is down, so a 403 shows it was never dialed.
+	resp, _ = get("/admin", "session=ok")
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+}
+
+func TestCache(t *testing.T) {
+	_, client := startTestProxy(t, `
+cache_stores:
+  memory:
+    max_size: 1048576
+proxies:
+  "app.com":
+    terminate: true
+    proto: http
+    target: "localhost:8086"
+    cache:
+      store: memory
+`)
+
+	var calls, revalidations atomic.Int32
+	ln, err := net.Listen("tcp", ":8086")
+	require.NoError(t, err)
+	backend := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		switch r.URL.Path {
+		case "/app.js":
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Write([]byte("asset"))
+		case "/index.html":
+			w.Header().Set("Cache-Control", "no-cache")
+			w.Header().Set("ETag", `"v1"`)
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				revalidations.Add(1)
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Write([]byte("index"))
+		}
+	})}
+	go backend.Serve(ln)
+	t.Cleanup(func() { backend.Close() })
+
+	get := func(path string) (*http.Response, string) {
+		resp, err := client.Get("https://localhost:8085" + path)
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.NoError(t, err)
+		return resp, string(body)
+	}
+
+	resp, body := get("/app.js")
+	require.Equal(t, "STORED", resp.Header.Get("X-Cache"))
+	require.Equal(t, "asset", body)
+
+	resp, body = get("/index.html")
+	require.Equal(t, "STORED", resp.Header.Get("X-Cache"))
+	require.Equal(t, "index", body)
+
+	resp, body = get("/index.html")
+	require.Equal(t, "REVALIDATED", resp.Header.Get("X-Cache"))
+	require.Equal(t, "index", body)
+	require.EqualValues(t, 1, revalidations.Load())
+
+	// Hits are served with the backend down.
+	backend.Close()
+	resp, body = get("/app.js")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "HIT", resp.Header.Get("X-Cache"))
+	require.Equal(t, "asset", body)
+	require.EqualValues(t, 3, calls.Load())
+}
+
+// TestCacheIsolation tests that cached responses are not served across split targets,
+// and that responses to authenticated requests are not stored unless they are shared.
+func TestCacheIsolation(t *testing.T) {
+	proxy, client := startTestProxy(t, `
+cache_stores:
+  memory:
+    max_size: 1048576
+proxies:
+  "app.com":
+    terminate: true
+    proto: http
+    target: "localhost:8086"
+    cache:
+      store: memory
+    routes:
+      - pattern: "/api/*"
+        target: "localhost:8086"
+        split:
+          target: "localhost:8087"
+          weight: 0
+      - pattern: "/account/*"
+        target: "localhost:8086"
+        auth:
+          api_key:
+            keys: ["key-1"]
+`)
+
+	startTestBackend(t, ":8086", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/account/shared" {
+			w.Header().Set("Cache-Control", "public, max-age=60")
+		} else {
+			w.Header().Set("Cache-Control", "max-age=60")
+		}
+		w.Write([]byte("primary"))
+	})
+	startTestBackend(t, ":8087", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("canary"))
+	})
+
+	get := func(path string) (string, string) {
+		req, err := http.NewRequest(http.MethodGet, "https://localhost:8085"+path, nil)
+		require.NoError(t, err)
+		req.Header.Set("X-API-Key", "key-1")
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.NoError(t, err)
+		return resp.Header.Get("X-Cache"), string(body)
+	}
+
+	status, body := get("/api/items")
+	require.Equal(t, "STORED", status)
+	require.Equal(t, "primary", body)
+
+	require.NoError(t, proxy.Config.SetSplitWeight("app.com", "/api/*", 100))
+	status, body = get("/api/items")
+	require.Equal(t, "STORED", status)
+	require.Equal(t, "canary", body)
+
+	status, body = get("/api/items")
+	require.Equal(t, "HIT", status)
+	require.Equal(t, "canary", body)
+
+	status, _ = get("/account/me")
+	require.Equal(t, "MISS", status)
+	status, _ = get("/account/me")
+	require.Equal(t, "MISS", status)
+
+	status, _ = get("/account/shared")
+	require.Equal(t, "STORED", status)
+	status, _ = get("/account/shared")
+	require.Equal(t, "HIT", status)
+}
+
+// closeTracker is a response body recording whether it was closed.
+type closeTracker struct {
+	io.Reader
+	closed chan struct{}
+}
+
+func (c *closeTracker) Close() error {
+	close(c.closed)
+	return nil
+}
+
+// TestRespondClosesBody tests that a compressed response the client does not read is closed.
+func TestRespondClosesBody(t *testing.T) {
+	compression, err := config.NewCompression(&config.CompressConfig{})
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	body := &closeTracker{Reader: strings.NewReader(strings.Repeat("<p>compressible</p>", 1000)), closed: make(chan struct{})}
+	resp := &http.Response{
+		StatusCode:    http.StatusOK,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"text/html"}},
+		Body:          body,
+		ContentLength: -1,
+	}
+	compress(req, resp, compression)
+
+	client, server := net.Pipe()
+	client.Close()
+	require.Error(t, New().respond(server, req, resp))
+
+	select {
+	case <-body.closed:
+	case <-time.After(time.Second):
+		t.Fatal("response body not closed")
+	}
+}
+
+func TestCompression(t *testing.T) {
+	_, client := startTestProxy(t, `
+proxies:
+  "app.com":
+    terminate: true
+    proto: http
+    target: "localhost:8086"
+    routes:
+      - pattern: "/assets/*"
+        target: "localhost:8086"
+        compress:
+          min_size: 64
+`)
+
+	page := strings.Repeat("<p>compressible</p>", 100)
+	events := make(chan struct{})
+	startTestBackend(t, ":8086", func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/assets/app.js":
+			w.Header().Set("Content-Type", "application/javascript")
+			w.Header().Set("ETag", `"v1"`)
+			w.Write([]byte(page))
+		case "/assets/small.js":
+			w.Header().Set("Content-Type", "application/javascript")
+			w.Write([]byte("small"))
+		case "/assets/app.js.gz":
+			w.Header().Set("Content-Type", "application/javascript")
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Write([]byte(page))
+		case "/assets/events":
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Write([]byte("data: first\n\n"))
+			w.(http.Flusher).Flush()
+			<-events
+		default:
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte(page))
+		}
+	})
+
+	get := func(path, acceptEncoding string) *http.Response {
+		req, err := http.NewRequest(http.MethodGet, "https://localhost:8085"+path, nil)
+		require.NoError(t, err)
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	decoders := map[string]func(io.Reader) io.Reader{
+		"br": func(r io.Reader) io.Reader { return brotli.NewReader(r) },
+		"zstd": func(r io.Reader) io.Reader {
+			dec, err := zstd.NewReader(r)
+			require.NoError(t, err)
+			return dec
+		},
+		"gzip": func(r io.Reader) io.Reader {
+			dec, err := gzip.NewReader(r)
+			require.NoError(t, err)
+			return dec
+		},
+	}
+	for encoding, decode := range decoders {
+		resp := get("/assets/app.js", encoding)
+		require.Equal(t, encoding, resp.Header.Get("Content-Encoding"))
+		require.Equal(t, "Accept-Encoding", resp.Header.Get("Vary"))
+		require.Equal(t, `W/"v1"`, resp.Header.Get("ETag"))
+		require.EqualValues(t, -1, resp.ContentLength)
+
+		body, err := io.ReadAll(decode(resp.Body))
+		require.NoError(t, err)
+		require.Equal(t, page, string(body))
+	}
+
+	resp := get("/assets/app.js", "identity")
+	require.Empty(t, resp.Header.Get("Content-Encoding"))
+	require.Equal(t, "Accept-Encoding", resp.Header.Get("Vary"))
+
+	require.Empty(t, get("/assets/small.js", "gzip").Header.Get("Content-Encoding"))
+	require.Empty(t, get("/index.html", "gzip").Header.Get("Content-Encoding"))
+
+	resp = get("/assets/app.js.gz", "br")
+	require.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, page, string(body))
+
+	// Event streams are flushed as they are read, before the backend finishes.
+	resp = get("/assets/events", "gzip")
+	require.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+	dec, err := gzip.NewReader(resp.Body)
+	require.NoError(t, err)
+	line, err := bufio.NewReader(dec).ReadString('\n')
+	require.NoError(t, err)
+	require.Equal(t, "data: first\n", line)
+	close(events)
+}
+
+func TestRequestSizeLimits(t *testing.T) {
+	_, client := startTestProxy(t, `
+proxies:
+  "app.com":
+    terminate: true
+    proto: http
+    target: "localhost:8086"
+    max_header_bytes: 4096
+    max_uri_length: 256
+    max_body_bytes: 64
+    routes:
+      - pattern: "/upload/*"
+        target: "localhost:8086"
+        max_body_bytes: 1024
+        max_header_bytes: 16384
+      - pattern: "/closed/*"
+        target: "localhost:8099"
+`)
+
+	startTestBackend(t, ":8086", func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(strconv.Itoa(len(body))))
+	})
+
+	// unknownLength hides the length of a body, so it is sent chunked.
+	type unknownLength struct{ io.Reader }
+
+	send := func(method, path string, body io.Reader, header http.Header) (int, string) {
+		req, err := http.NewRequest(method, "https://localhost:8085"+path, body)
+		require.NoError(t, err)
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, string(b)
+	}
+	big := func(n int) http.Header {
+		return http.Header{"X-Big": {strings.Repeat("a", n)}}
+	}
+
+	status, _ := send(http.MethodGet, "/", nil, nil)
+	require.Equal(t, http.StatusOK, status)
+
+	status, _ = send(http.MethodGet, "/?q="+strings.Repeat("a", 300), nil, nil)
+	require.Equal(t, http.StatusRequestURITooLong, status)
+
+	// A request line past the largest header limit is still answered with 414.
+	conn, err := tls.Dial("tcp", "localhost:8085", &tls.Config{ServerName: "app.com", InsecureSkipVerify: true})
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = io.WriteString(conn, "GET /?q="+strings.Repeat("a", 32<<10)+" HTTP/1.1\r\nHost: app.com\r\n\r\n")
+	require.NoError(t, err)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusRequestURITooLong, resp.StatusCode)
+
+	status, _ = send(http.MethodGet, "/", nil, big(8192))
+	require.Equal(t, http.StatusRequestHeaderFieldsTooLarge, status)
+
+	// Headers past the largest limit of any route are rejected while they are read.
+	status, _ = send(http.MethodGet, "/upload/file", nil, big(64<<10))
+	require.Equal(t, http.StatusRequestHeaderFieldsTooLarge, status)
+
+	status, body := send(http.MethodPost, "/upload/file", strings.NewReader("data"), big(8192))
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, "4", body)
+
+	status, _ = send(http.MethodPost, "/", strings.NewReader(strings.Repeat("a", 100)), nil)
+	require.Equal(t, http.StatusRequestEntityTooLarge, status)
+
+	status, body = send(http.MethodPost, "/upload/file", strings.NewReader(strings.Repeat("a", 100)), nil)
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, "100", body)
+
+	// Oversized requests are rejected before the backend is dialed.
+	status, _ = send(http.MethodPost, "/closed/file", strings.NewReader(strings.Repeat("a", 100)), nil)
+	require.Equal(t, http.StatusRequestEntityTooLarge, status)
+
+	status, body = send(http.MethodPost, "/upload/file", unknownLength{strings.NewReader(strings.Repeat("a", 1024))}, nil)
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, "1024", body)
+
+	status, _ = send(http.MethodPost, "/upload/file", unknownLength{strings.NewReader(strings.Repeat("a", 2048))}, nil)
+	require.Equal(t, http.StatusRequestEntityTooLarge, status)
+}
+
+// logBuffer is a buffer safe for concurrent writes of log records.
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// records returns the JSON records written to b.
+func (b *logBuffer) records(t *testing.T) []map[string]any {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var records []map[string]any
+	dec := json.NewDecoder(bytes.NewReader(b.buf.Bytes()))
+	for dec.More() {
+		var record map[string]any
+		require.NoError(t, dec.Decode(&record))
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestWAF(t *testing.T) {
+	proxy, client := startTestProxy(t, `
+proxies:
+  "app.com":
+    terminate: true
+    proto: http
+    target: "localhost:8086"
+    waf:
+      signatures: [sqli, xss]
+      methods: [GET, POST]
+      rules:
+        - id: admin
+          path: "^/admin"
+    routes:
+      - pattern: "/report/*"
+        target: "localhost:8086"
+        waf:
+          mode: log
+          signatures: [sqli]
+`)
+
+	accessLog := &logBuffer{}
+	proxy.AccessLog = slog.New(slog.NewJSONHandler(accessLog, nil))
+
+	var hits atomic.Int32
+	startTestBackend(t, ":8086", func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Write([]byte("ok"))
+	})
+
+	send := func(method, target string) int {
+		req, err := http.NewRequest(method, "https://localhost:8085"+target, nil)
+		require.NoError(t, err)
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	require.Equal(t, http.StatusOK, send(http.MethodGet, "/search?q=rock+and+roll"))
+	require.Equal(t, http.StatusForbidden, send(http.MethodGet, "/items?id=1+UNION+SELECT+password+FROM+users"))
+	require.Equal(t, http.StatusForbidden, send(http.MethodGet, "/comments?q=%3Cscript%3Ealert(1)%3C/script%3E"))
+	require.Equal(t, http.StatusForbidden, send(http.MethodGet, "/admin"))
+	require.Equal(t, http.StatusForbidden, send(http.MethodDelete, "/items"))
+	require.EqualValues(t, 1, hits.Load())
+
+	// Log mode matches are logged, and the request is still served.
+	require.Equal(t, http.StatusOK, send(http.MethodDelete, "/report/daily?id=1+UNION+SELECT+1"))
+	require.EqualValues(t, 2, hits.Load())
+
+	// Records are written after their response.
+	matches := make(map[string]any)
+	require.Eventually(t, func() bool {
+		for _, record := range accessLog.records(t) {
+			if record["msg"] == "access" {
+				matches[record["method"].(string)+" "+record["path"].(string)] = record["waf"]
+			}
+		}
+		return len(matches) == 6
+	}, time.Second, 10*time.Millisecond)
+
+	require.Nil(t, matches["GET /search"])
+	require.Equal(t, []any{"xss-script", "xss-call"}, matches["GET /comments"])
+	require.Equal(t, []any{"sqli-union"}, matches["GET /items"])
+	require.Equal(t, []any{"admin"}, matches["GET /admin"])
+	require.Equal(t, []any{"method-not-allowed"}, matches["DELETE /items"])
+	require.Equal(t, []any{"sqli-union"}, matches["DELETE /report/daily"])
+}
+
+// writeTestFrame writes a final frame, masked as sent by a client if mask is set.
+func writeTestFrame(t *testing.T, w io.Writer, opcode byte, payload []byte, mask bool) {
+	t.Helper()
+
+	frame := []byte{0x80 | opcode}
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, byte(len(payload)))
+	default:
+		frame = append(frame, 126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	}
+	if mask {
+		key := []byte{1, 2, 3, 4}
+		frame[1] |= 0x80
+		frame = append(frame, key...)
+		for i, b := range payload {
+			frame = append(frame, b^key[i%4])
+		}
+	} else {
+		frame = append(frame, payload...)
+	}
+
+	_, err := w.Write(frame)
+	require.NoError(t, err)
+}
+
+// readTestFrame reads a frame and returns its header and unmasked payload.
+func readTestFrame(r *bufio.Reader) (*wsFrameHeader, []byte, error) {
+	h, err := readFrameHeader(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	payload := make([]byte, h.length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, nil, err
+	}
+	return h, h.unmask(payload), nil
+}
+
+func TestWebSocketMode(t *testing.T) {
+	proxy, _ := startTestProxy(t, `
+proxies:
+  "app.com":
+    terminate: true
+    proto: http
+    target: "localhost:8086"
+    websocket:
+      max_message_size: 64
+    routes:
+      - pattern: "/chat"
+        target: "localhost:8086"
+        websocket:
+          origins: ["https://app.com", "https://*.example.com"]
+          subprotocols: [chat.v2]
+      - pattern: "/ping"
+        target: "localhost:8086"
+        websocket:
+          ping_interval: 50ms
+      - pattern: "/idle"
+        target: "localhost:8086"
+        websocket:
+          idle_timeout: 200ms
+`)
+
+	protocols := make(chan string, 1)
+	startTestBackend(t, ":8086", func(w http.ResponseWriter, r *http.Request) {
+		conn, bufrw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		select {
+		case protocols <- r.Header.Get("Sec-WebSocket-Protocol"):
+		default:
+		}
+
+		bufrw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		bufrw.Flush()
+
+		if r.URL.Path == "/idle/push" {
+			go func() {
+				for range 6 {
+					time.Sleep(50 * time.Millisecond)
+					writeTestFrame(t, conn, 0x1, []byte("push"), false)
+				}
+			}()
+		}
+
+		// Echoes frames, answers pings and closes.
+		for {
+			h, payload, err := readTestFrame(bufrw.Reader)
+			if err != nil || !h.masked {
+				return
+			}
+			switch h.opcode {
+			case wsOpPing:
+				writeTestFrame(t, conn, wsOpPong, payload, false)
+			case wsOpPong:
+			case wsOpClose:
+				writeTestFrame(t, conn, wsOpClose, payload, false)
+				return
+			default:
+				frame := append([]byte{h.raw[0]}, byte(len(payload)))
+				conn.Write(append(frame, payload...))
+			}
+		}
+	})
+
+	var opened []net.Conn
+	dial := func(path string, header ...string) (*tls.Conn, *bufio.Reader, int) {
+		conn, err := tls.Dial("tcp", "localhost:8085", &tls.Config{ServerName: "app.com", InsecureSkipVerify: true})
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		opened = append(opened, conn)
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		req := "GET " + path + " HTTP/1.1\r\nHost: app.com\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+			"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n"
+		for i := 0; i+1 < len(header); i += 2 {
+			req += header[i] + ": " + header[i+1] + "\r\n"
+		}
+		_, err = conn.Write([]byte(req + "\r\n"))
+		require.NoError(t, err)
+
+		r := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(r, nil)
+		require.NoError(t, err)
+		return conn, r, resp.StatusCode
+	}
+	readClose := func(r *bufio.Reader) uint16 {
+		for {
+			h, payload, err := readTestFrame(r)
+			require.NoError(t, err)
+			if h.opcode == wsOpClose {
+				require.Len(t, payload, 2)
+				return binary.BigEndian.Uint16(payload)
+			}
+		}
+	}
+
+	_, _, status := dial("/chat", "Origin", "https://evil.com", "Sec-WebSocket-Protocol", "chat.v2")
+	require.Equal(t, http.StatusForbidden, status)
+	_, _, status = dial("/chat", "Origin", "https://a.example.com", "Sec-WebSocket-Protocol", "chat.v1")
+	require.Equal(t, http.StatusForbidden, status)
+	_, _, status = dial("/chat", "Sec-WebSocket-Protocol", "chat.v2")
+	require.Equal(t, http.StatusForbidden, status)
+
+	_, _, status = dial("/chat", "Origin", "https://a.example.com", "Sec-WebSocket-Protocol", "chat.v1, chat.v2")
+	require.Equal(t, http.StatusSwitchingProtocols, status)
+	require.Equal(t, "chat.v2", <-protocols)
+
+	// Messages are relayed and counted per direction, fragments as one message.
+	conn, r, status := dial("/")
+	require.Equal(t, http.StatusSwitchingProtocols, status)
+
+	writeTestFrame(t, conn, 0x1, []byte("hello"), true)
+	h, payload, err := readTestFrame(r)
+	require.NoError(t, err)
+	require.False(t, h.masked)
+	require.Equal(t, "hello", string(payload))
+
+	_, err = conn.Write([]byte{0x01, 0x83, 0, 0, 0, 0, 'a', 'b', 'c'})
+	require.NoError(t, err)
+	writeTestFrame(t, conn, wsOpContinuation, []byte("def"), true)
+	for _, want := range []string{"abc", "def"} {
+		_, payload, err = readTestFrame(r)
+		require.NoError(t, err)
+		require.Equal(t, want, string(payload))
+	}
+
+	m := proxy.Config.GetProxy("app.com").Metrics
+	require.EqualValues(t, 2, m.GetWebSocketIngressMessages())
+	require.EqualValues(t, 2, m.GetWebSocketEgressMessages())
+
+	// Messages larger than allowed close the socket.
+	writeTestFrame(t, conn, wsOpBinary, bytes.Repeat([]byte("a"), 65), true)
+	require.EqualValues(t, wsCloseMessageTooBig, readClose(r))
+
+	// Pings of the proxy are answered by both peers.
+	conn, r, status = dial("/ping")
+	require.Equal(t, http.StatusSwitchingProtocols, status)
+	h, payload, err = readTestFrame(r)
+	require.NoError(t, err)
+	require.EqualValues(t, wsOpPing, h.opcode)
+	require.Equal(t, wsPingPayload, payload)
+	writeTestFrame(t, conn, wsOpPong, payload, true)
+
+	writeTestFrame(t, conn, 0x1, []byte("still here"), true)
+	for {
+		h, payload, err = readTestFrame(r)
+		require.NoError(t, err)
+		if h.opcode != wsOpPing {
+			break
+		}
+	}
+	require.Equal(t, "still here", string(payload))
+
+	// Idle sockets are closed.
+	_, r, status = dial("/idle")
+	require.Equal(t, http.StatusSwitchingProtocols, status)
+	start := time.Now()
+	require.EqualValues(t, wsCloseGoingAway, readClose(r))
+	require.Greater(t, time.Since(start), 150*time.Millisecond)
+
+	// A socket where only the backend sends is not idle.
+	_, r, status = dial("/idle/push")
+	require.Equal(t, http.StatusSwitchingProtocols, status)
+	for range 6 {
+		h, payload, err = readTestFrame(r)
+		require.NoError(t, err)
+		require.EqualValues(t, 0x1, h.opcode)
+		require.Equal(t, "push", string(payload))
+	}
+	require.EqualValues(t, wsCloseGoingAway, readClose(r))
+
+	// Shutdown closes sockets with a close handshake.
+	for _, c := range opened {
+		c.Close()
+	}
+	conn, r, status = dial("/")
+	require.Equal(t, http.StatusSwitchingProtocols, status)
+	writeTestFrame(t, conn, 0x1, []byte("hello"), true)
+	_, _, err = readTestFrame(r)
+	require.NoError(t, err)
+
+	shutdown := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		shutdown <- proxy.Shutdown(ctx)
+	}()
+
+	require.EqualValues(t, wsCloseGoingAway, readClose(r))
+	writeTestFrame(t, conn, wsOpClose, binary.BigEndian.AppendUint16(nil, wsCloseGoingAway), true)
+	require.NoError(t, <-shutdown)
+
+	_, err = r.ReadByte()
+	require.ErrorIs(t, err, io.EOF)
+}
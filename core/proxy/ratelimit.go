@@ -0,0 +1,83 @@
+package proxy
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Dyastin-0/tcprp/core/config"
+	"github.com/Dyastin-0/tcprp/core/limiter"
+)
+
+// takeRequestLimits takes a token for req from the request limiters and the route's limiter,
+// in turn, stopping at the first denial so the limiters after it are not charged.
+// If deferClaims is set, the request limiters keyed on a JWT claim are left to takeClaimLimits.
+// It returns the denial, or the allowed result with the fewest remaining requests.
+func takeRequestLimits(req *http.Request, clientIP string, proxyLimit, routeLimit *config.RequestLimiter, routeLimiter *limiter.Limiter, deferClaims bool) limiter.Result {
+	var takes []func() limiter.Result
+	for _, l := range []*config.RequestLimiter{proxyLimit, routeLimit} {
+		if !deferClaims || !l.ClaimKeyed() {
+			takes = append(takes, func() limiter.Result { return l.Allow(req, clientIP, nil) })
+		}
+	}
+	if routeLimiter != nil {
+		takes = append(takes, func() limiter.Result { return routeLimiter.Take("ip:" + clientIP) })
+	}
+
+	return takeLimits(takes, limiter.Result{Allowed: true})
+}
+
+// takeClaimLimits takes a token for req from the request limiters keyed on a JWT claim,
+// read from claims, the verified claims of req. It returns the denial, or the allowed
+// result with the fewest remaining requests between them and res.
+func takeClaimLimits(req *http.Request, clientIP string, claims map[string]any, res limiter.Result, limits ...*config.RequestLimiter) limiter.Result {
+	if claims == nil {
+		// The request was not authenticated by a JWT, so it is limited by its IP.
+		claims = map[string]any{}
+	}
+
+	var takes []func() limiter.Result
+	for _, l := range limits {
+		if l.ClaimKeyed() {
+			takes = append(takes, func() limiter.Result { return l.Allow(req, clientIP, claims) })
+		}
+	}
+
+	return takeLimits(takes, res)
+}
+
+// takeLimits calls takes in turn, stopping at the first denial. It returns the denial,
+// or the allowed result with the fewest remaining requests between them and res.
+func takeLimits(takes []func() limiter.Result, res limiter.Result) limiter.Result {
+	for _, take := range takes {
+		r := take()
+		if !r.Allowed {
+			return r
+		}
+		if r.Limit > 0 && (res.Limit == 0 || r.Remaining < res.Remaining) {
+			res = r
+		}
+	}
+	return res
+}
+
+// setRateLimitHeaders sets the RateLimit headers of res, and Retry-After if it was denied.
+// https://datatracker.ietf.org/doc/draft-ietf-httpapi-ratelimit-headers/
+func setRateLimitHeaders(h http.Header, res limiter.Result) {
+	if res.Limit == 0 {
+		return
+	}
+
+	h.Set("RateLimit-Limit", strconv.Itoa(res.Limit))
+	h.Set("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+	h.Set("RateLimit-Reset", strconv.Itoa(seconds(res.Reset)))
+
+	if !res.Allowed {
+		h.Set("Retry-After", strconv.Itoa(max(seconds(res.RetryAfter), 1)))
+	}
+}
+
+// seconds returns d rounded up to whole seconds.
+func seconds(d time.Duration) int {
+	return int((d + time.Second - 1) / time.Second)
+}
@@ -0,0 +1,129 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Dyastin-0/tcprp/core/config"
+	"github.com/Dyastin-0/tcprp/core/geoip"
+	"github.com/Dyastin-0/tcprp/core/limiter"
+)
+
+// RequestIDHeader is the header carrying the ID of a request
+// to the backend and back to the client.
+const RequestIDHeader = "X-Request-Id"
+
+// CacheStatusHeader tells clients how a response was served by the route's cache:
+// HIT, REVALIDATED, STORED or MISS.
+const CacheStatusHeader = "X-Cache"
+
+// Headers carrying the country and ASN of the client to the backend,
+// when geoip databases are configured. Values sent by clients are removed.
+const (
+	ClientCountryHeader = "X-Client-Country"
+	ClientASNHeader     = "X-Client-ASN"
+)
+
+// session holds the state of a terminated HTTP connection.
+type session struct {
+	conn     net.Conn
+	bufrd    *bufio.Reader
+	counter  *countingReader
+	proxy    *config.Proxy
+	sni      string
+	clientIP string
+	geo      geoip.Info
+	fp       Fingerprint
+	// vars are the header placeholders of the current request.
+	vars config.HeaderVars
+	// routeHeaders are the header rules of the route matched by the current request, if any.
+	routeHeaders *config.HeaderRules
+}
+
+// accessRecord represents a single access log record.
+type accessRecord struct {
+	start     time.Time
+	requestID string
+	sni       string
+	clientIP  string
+	geo       geoip.Info
+	ja4       string
+	method    string
+	path      string
+	route     string
+	target    string
+	status    int
+	// waf holds the IDs of the waf rules the request matched.
+	waf []string
+}
+
+// logAccess writes rec to the access log.
+func (p *Proxy) logAccess(rec *accessRecord) {
+	if p.AccessLog == nil {
+		return
+	}
+
+	p.AccessLog.LogAttrs(context.Background(), slog.LevelInfo, "access",
+		slog.String("request_id", rec.requestID),
+		slog.String("sni", rec.sni),
+		slog.String("client_ip", rec.clientIP),
+		slog.String("country", rec.geo.Country),
+		slog.Uint64("asn", uint64(rec.geo.ASN)),
+		slog.String("ja4", rec.ja4),
+		slog.String("method", rec.method),
+		slog.String("path", rec.path),
+		slog.String("route", rec.route),
+		slog.String("target", rec.target),
+		slog.Int("status", rec.status),
+		slog.Any("waf", rec.waf),
+		slog.Duration("duration", time.Since(rec.start)),
+	)
+}
+
+// logConnection writes a record of a new TLS connection to the access log.
+func (p *Proxy) logConnection(conn net.Conn, hello *ClientHelloMsg, fp Fingerprint) {
+	if p.AccessLog == nil {
+		return
+	}
+
+	clientIP := limiter.ClientIP(conn)
+	geo := p.Config.GeoIP.Lookup(clientIP)
+
+	p.AccessLog.LogAttrs(context.Background(), slog.LevelInfo, "connection",
+		slog.String("sni", hello.ServerName),
+		slog.String("client_ip", clientIP),
+		slog.String("country", geo.Country),
+		slog.Uint64("asn", uint64(geo.ASN)),
+		slog.Any("alpn", hello.ALPNProtocols),
+		slog.String("ja3", fp.JA3),
+		slog.String("ja4", fp.JA4),
+	)
+}
+
+// setGeoHeaders sets the country and ASN headers of h from geo,
+// or removes them if the geoip databases do not know the client.
+func setGeoHeaders(h http.Header, geo geoip.Info) {
+	h.Del(ClientCountryHeader)
+	h.Del(ClientASNHeader)
+
+	if geo.Country != "" {
+		h.Set(ClientCountryHeader, geo.Country)
+	}
+	if geo.ASN != 0 {
+		h.Set(ClientASNHeader, strconv.FormatUint(uint64(geo.ASN), 10))
+	}
+}
+
+// newRequestID returns a new random request ID.
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,117 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"time"
+)
+
+// setDeadline sets the read and write deadline of conn to timeout from now,
+// or clears it if timeout is not positive.
+func setDeadline(conn net.Conn, timeout time.Duration) {
+	if timeout <= 0 {
+		conn.SetDeadline(time.Time{})
+		return
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+}
+
+// setReadDeadline sets the read deadline of conn to timeout from now,
+// or clears it if timeout is not positive.
+func setReadDeadline(conn net.Conn, timeout time.Duration) {
+	if timeout <= 0 {
+		conn.SetReadDeadline(time.Time{})
+		return
+	}
+	conn.SetReadDeadline(time.Now().Add(timeout))
+}
+
+// writeTimeoutConn sets the write deadline of a connection to timeout from now before every write.
+type writeTimeoutConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *writeTimeoutConn) Write(p []byte) (int, error) {
+	c.Conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Write(p)
+}
+
+// withWriteTimeout wraps conn so each write fails after timeout without progress.
+// It returns conn unchanged if timeout is not positive.
+func withWriteTimeout(conn net.Conn, timeout time.Duration) net.Conn {
+	if timeout <= 0 {
+		return conn
+	}
+	return &writeTimeoutConn{Conn: conn, timeout: timeout}
+}
+
+// abortWriter closes abort once a write to w fails.
+type abortWriter struct {
+	w     io.Writer
+	abort io.Closer
+}
+
+func (a *abortWriter) Write(p []byte) (int, error) {
+	n, err := a.w.Write(p)
+	if err != nil {
+		a.abort.Close()
+	}
+	return n, err
+}
+
+// dial connects to target, giving up after timeout if it is positive.
+func dial(target string, timeout time.Duration) (net.Conn, error) {
+	return net.DialTimeout("tcp", target, max(timeout, 0))
+}
+
+// idleTimer closes its closers after timeout without reads or writes.
+type idleTimer struct {
+	timeout time.Duration
+	timer   *time.Timer
+}
+
+// idleReadWriteCloser resets an idleTimer on every read and write.
+type idleReadWriteCloser struct {
+	io.ReadWriteCloser
+	t *idleTimer
+}
+
+func (rwc *idleReadWriteCloser) Read(p []byte) (int, error) {
+	n, err := rwc.ReadWriteCloser.Read(p)
+	if n > 0 {
+		rwc.t.timer.Reset(rwc.t.timeout)
+	}
+	return n, err
+}
+
+func (rwc *idleReadWriteCloser) Write(p []byte) (int, error) {
+	n, err := rwc.ReadWriteCloser.Write(p)
+	if n > 0 {
+		rwc.t.timer.Reset(rwc.t.timeout)
+	}
+	return n, err
+}
+
+func (rwc *idleReadWriteCloser) Close() error {
+	rwc.t.timer.Stop()
+	return rwc.ReadWriteCloser.Close()
+}
+
+// withIdleTimeout wraps src and dst so both are closed
+// after timeout without traffic in either direction.
+// It returns them unchanged if timeout is not positive.
+func withIdleTimeout(src, dst io.ReadWriteCloser, timeout time.Duration) (io.ReadWriteCloser, io.ReadWriteCloser) {
+	if timeout <= 0 {
+		return src, dst
+	}
+
+	t := &idleTimer{timeout: timeout}
+	t.timer = time.AfterFunc(timeout, func() {
+		src.Close()
+		dst.Close()
+	})
+
+	return &idleReadWriteCloser{ReadWriteCloser: src, t: t},
+		&idleReadWriteCloser{ReadWriteCloser: dst, t: t}
+}
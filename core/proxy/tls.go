@@ -20,12 +20,14 @@ type alert uint8
 const (
 	alertUnexpectedMessage alert = 10
 	alertRecordOverflow    alert = 22
+	alertAccessDenied      alert = 49
 	alertInternalError     alert = 80
 )
 
 var alertText = map[alert]string{
 	alertUnexpectedMessage: "unexpected message",
 	alertRecordOverflow:    "record overflow",
+	alertAccessDenied:      "access denied",
 	alertInternalError:     "internal error",
 }
 
@@ -45,22 +47,39 @@ func (e alert) Error() string {
 type recordType uint8
 
 const (
+	recordTypeAlert     recordType = 21
 	recordTypeHandshake recordType = 22
 )
 
+// alertLevelFatal is the level of alerts closing the connection.
+const alertLevelFatal = 2
+
+// writeAlert writes a fatal plaintext alert record, as sent before a handshake completes.
+func writeAlert(w io.Writer, a alert) error {
+	_, err := w.Write([]byte{byte(recordTypeAlert), 0x03, 0x03, 0x00, 0x02, alertLevelFatal, byte(a)})
+	return err
+}
+
 // TLS handshake message types.
 const (
 	typeClientHello uint8 = 1
 )
 
 // TLS extension numbers
-var (
-	extensionServerName      uint16 = 0
-	extensionStatusRequest   uint16 = 5
-	extensionSupportedCurves uint16 = 10
-	extensionSupportedPoints uint16 = 11
-	extensionSessionTicket   uint16 = 35
-	extensionNextProtoNeg    uint16 = 13172 // not IANA assigned
+const (
+	extensionServerName              uint16 = 0
+	extensionStatusRequest           uint16 = 5
+	extensionSupportedCurves         uint16 = 10
+	extensionSupportedPoints         uint16 = 11
+	extensionSignatureAlgorithms     uint16 = 13
+	extensionALPN                    uint16 = 16
+	extensionSessionTicket           uint16 = 35
+	extensionEarlyData               uint16 = 42
+	extensionSupportedVersions       uint16 = 43
+	extensionPSKModes                uint16 = 45
+	extensionSignatureAlgorithmsCert uint16 = 50
+	extensionKeyShare                uint16 = 51
+	extensionECH                     uint16 = 0xfe0d
 )
 
 // TLS CertificateStatusType (RFC 3546)
@@ -275,20 +294,85 @@ func readClientHello(rd io.Reader) (*ClientHelloMsg, error) {
 	return msg, nil
 }
 
+// Extension represents a raw ClientHello extension.
+type Extension struct {
+	Type uint16
+	Data []byte
+}
+
+// KeyShare represents a TLS 1.3 key share entry.
+type KeyShare struct {
+	Group uint16
+	Data  []byte
+}
+
 type ClientHelloMsg struct {
-	Raw                []byte
-	Vers               uint16
-	Random             []byte
-	SessionId          []byte
-	CipherSuites       []uint16
-	CompressionMethods []uint8
-	NextProtoNeg       bool
-	ServerName         string
-	OcspStapling       bool
-	SupportedCurves    []uint16
-	SupportedPoints    []uint8
-	TicketSupported    bool
-	SessionTicket      []uint8
+	Raw                     []byte
+	Vers                    uint16
+	Random                  []byte
+	SessionId               []byte
+	CipherSuites            []uint16
+	CompressionMethods      []uint8
+	ServerName              string
+	OcspStapling            bool
+	SupportedCurves         []uint16
+	SupportedPoints         []uint8
+	TicketSupported         bool
+	SessionTicket           []uint8
+	ALPNProtocols           []string
+	SupportedVersions       []uint16
+	SignatureAlgorithms     []uint16
+	SignatureAlgorithmsCert []uint16
+	KeyShares               []KeyShare
+	PSKModes                []uint8
+	EarlyData               bool
+	// ECH reports whether the client sent an encrypted_client_hello extension,
+	// in which case ServerName is the public name of the outer ClientHello.
+	ECH bool
+	// Extensions holds every extension in the order the client sent them.
+	Extensions []Extension
+}
+
+// MaxVersion returns the highest TLS version the client supports,
+// ignoring GREASE values and draft versions.
+func (m *ClientHelloMsg) MaxVersion() uint16 {
+	if len(m.SupportedVersions) == 0 {
+		return m.Vers
+	}
+	var vers uint16
+	for _, v := range m.SupportedVersions {
+		// Draft versions of TLS 1.3 are 0x7fxx, above every final version.
+		if !isGREASE(v) && v>>8 != 0x7f && v > vers {
+			vers = v
+		}
+	}
+	return vers
+}
+
+// isGREASE reports whether v is a GREASE value (RFC 8701).
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// readUint16List reads a list of uint16 prefixed by a lenBytes long length
+// that must span data exactly.
+func readUint16List(data []byte, lenBytes int) ([]uint16, bool) {
+	if len(data) < lenBytes {
+		return nil, false
+	}
+	l := 0
+	for i := 0; i < lenBytes; i++ {
+		l = l<<8 | int(data[i])
+	}
+	data = data[lenBytes:]
+	if l%2 == 1 || len(data) != l {
+		return nil, false
+	}
+	list := make([]uint16, l/2)
+	for i := range list {
+		list[i] = uint16(data[2*i])<<8 | uint16(data[2*i+1])
+	}
+	return list, true
 }
 
 func (m *ClientHelloMsg) unmarshal(data []byte) bool {
@@ -330,11 +414,12 @@ func (m *ClientHelloMsg) unmarshal(data []byte) bool {
 
 	data = data[1+compressionMethodsLen:]
 
-	m.NextProtoNeg = false
 	m.ServerName = ""
 	m.OcspStapling = false
 	m.TicketSupported = false
 	m.SessionTicket = nil
+	m.ALPNProtocols = nil
+	m.Extensions = nil
 
 	if len(data) == 0 {
 		// ClientHello is optionally followed by extension data
@@ -350,6 +435,8 @@ func (m *ClientHelloMsg) unmarshal(data []byte) bool {
 		return false
 	}
 
+	seen := make(map[uint16]bool)
+
 	for len(data) != 0 {
 		if len(data) < 4 {
 			return false
@@ -361,13 +448,22 @@ func (m *ClientHelloMsg) unmarshal(data []byte) bool {
 			return false
 		}
 
+		// https://tools.ietf.org/html/rfc8446#section-4.2
+		if seen[extension] {
+			return false
+		}
+		seen[extension] = true
+
+		m.Extensions = append(m.Extensions, Extension{Type: extension, Data: data[:length]})
+
+		var ok bool
 		switch extension {
 		case extensionServerName:
 			if length < 2 {
 				return false
 			}
 			numNames := int(data[0])<<8 | int(data[1])
-			d := data[2:]
+			d := data[2:length]
 			for i := 0; i < numNames; i++ {
 				if len(d) < 3 {
 					return false
@@ -384,29 +480,13 @@ func (m *ClientHelloMsg) unmarshal(data []byte) bool {
 				}
 				d = d[nameLen:]
 			}
-		case extensionNextProtoNeg:
-			if length > 0 {
-				return false
-			}
-			m.NextProtoNeg = true
 		case extensionStatusRequest:
 			m.OcspStapling = length > 0 && data[0] == statusTypeOCSP
 		case extensionSupportedCurves:
 			// http://tools.ietf.org/html/rfc4492#section-5.5.1
-			if length < 2 {
-				return false
-			}
-			l := int(data[0])<<8 | int(data[1])
-			if l%2 == 1 || length != l+2 {
+			if m.SupportedCurves, ok = readUint16List(data[:length], 2); !ok {
 				return false
 			}
-			numCurves := l / 2
-			m.SupportedCurves = make([]uint16, numCurves)
-			d := data[2:]
-			for i := 0; i < numCurves; i++ {
-				m.SupportedCurves[i] = uint16(d[0])<<8 | uint16(d[1])
-				d = d[2:]
-			}
 		case extensionSupportedPoints:
 			// http://tools.ietf.org/html/rfc4492#section-5.5.2
 			if length < 1 {
@@ -418,10 +498,82 @@ func (m *ClientHelloMsg) unmarshal(data []byte) bool {
 			}
 			m.SupportedPoints = make([]uint8, l)
 			copy(m.SupportedPoints, data[1:])
+		case extensionSignatureAlgorithms:
+			// https://tools.ietf.org/html/rfc8446#section-4.2.3
+			if m.SignatureAlgorithms, ok = readUint16List(data[:length], 2); !ok {
+				return false
+			}
+		case extensionSignatureAlgorithmsCert:
+			// https://tools.ietf.org/html/rfc8446#section-4.2.3
+			if m.SignatureAlgorithmsCert, ok = readUint16List(data[:length], 2); !ok {
+				return false
+			}
+		case extensionALPN:
+			// https://tools.ietf.org/html/rfc7301#section-3.1
+			if length < 2 {
+				return false
+			}
+			l := int(data[0])<<8 | int(data[1])
+			if length != l+2 {
+				return false
+			}
+			d := data[2:length]
+			for len(d) != 0 {
+				protoLen := int(d[0])
+				d = d[1:]
+				if protoLen == 0 || len(d) < protoLen {
+					return false
+				}
+				m.ALPNProtocols = append(m.ALPNProtocols, string(d[:protoLen]))
+				d = d[protoLen:]
+			}
 		case extensionSessionTicket:
 			// http://tools.ietf.org/html/rfc5077#section-3.2
 			m.TicketSupported = true
 			m.SessionTicket = data[:length]
+		case extensionEarlyData:
+			// https://tools.ietf.org/html/rfc8446#section-4.2.10
+			if length != 0 {
+				return false
+			}
+			m.EarlyData = true
+		case extensionSupportedVersions:
+			// https://tools.ietf.org/html/rfc8446#section-4.2.1
+			if m.SupportedVersions, ok = readUint16List(data[:length], 1); !ok {
+				return false
+			}
+		case extensionPSKModes:
+			// https://tools.ietf.org/html/rfc8446#section-4.2.9
+			if length < 1 || int(data[0]) != length-1 {
+				return false
+			}
+			m.PSKModes = data[1:length]
+		case extensionECH:
+			// https://datatracker.ietf.org/doc/draft-ietf-tls-esni
+			m.ECH = true
+		case extensionKeyShare:
+			// https://tools.ietf.org/html/rfc8446#section-4.2.8
+			if length < 2 {
+				return false
+			}
+			l := int(data[0])<<8 | int(data[1])
+			if length != l+2 {
+				return false
+			}
+			d := data[2:length]
+			for len(d) != 0 {
+				if len(d) < 4 {
+					return false
+				}
+				group := uint16(d[0])<<8 | uint16(d[1])
+				keyLen := int(d[2])<<8 | int(d[3])
+				d = d[4:]
+				if keyLen == 0 || len(d) < keyLen {
+					return false
+				}
+				m.KeyShares = append(m.KeyShares, KeyShare{Group: group, Data: d[:keyLen]})
+				d = d[keyLen:]
+			}
 		}
 		data = data[length:]
 	}
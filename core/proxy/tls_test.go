@@ -0,0 +1,220 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// clientHello returns the raw ClientHello records sent by a crypto/tls client with config.
+func clientHello(t testing.TB, config *tls.Config) []byte {
+	t.Helper()
+
+	client, server := net.Pipe()
+	defer server.Close()
+
+	go func() {
+		tls.Client(client, config).Handshake()
+		client.Close()
+	}()
+
+	var raw bytes.Buffer
+	_, err := readClientHello(io.TeeReader(server, &raw))
+	require.NoError(t, err)
+
+	return raw.Bytes()
+}
+
+// rawClientHello returns a ClientHello record offering vers, ciphers and exts, in order.
+func rawClientHello(vers uint16, ciphers []uint16, exts []Extension) []byte {
+	body := binary.BigEndian.AppendUint16(nil, vers)
+	body = append(body, make([]byte, 32)...)
+	body = append(body, 0)
+	body = binary.BigEndian.AppendUint16(body, uint16(2*len(ciphers)))
+	for _, c := range ciphers {
+		body = binary.BigEndian.AppendUint16(body, c)
+	}
+	body = append(body, 1, 0)
+
+	var extData []byte
+	for _, ext := range exts {
+		extData = binary.BigEndian.AppendUint16(extData, ext.Type)
+		extData = binary.BigEndian.AppendUint16(extData, uint16(len(ext.Data)))
+		extData = append(extData, ext.Data...)
+	}
+	body = binary.BigEndian.AppendUint16(body, uint16(len(extData)))
+	body = append(body, extData...)
+
+	hs := append([]byte{typeClientHello, 0}, binary.BigEndian.AppendUint16(nil, uint16(len(body)))...)
+	hs = append(hs, body...)
+
+	record := []byte{byte(recordTypeHandshake), 0x03, 0x01}
+	record = binary.BigEndian.AppendUint16(record, uint16(len(hs)))
+	return append(record, hs...)
+}
+
+// uint16List returns list prefixed by its length in lenBytes bytes.
+func uint16List(lenBytes int, list ...uint16) []byte {
+	var data []byte
+	for _, v := range list {
+		data = binary.BigEndian.AppendUint16(data, v)
+	}
+	if lenBytes == 1 {
+		return append([]byte{byte(len(data))}, data...)
+	}
+	return append(binary.BigEndian.AppendUint16(nil, uint16(len(data))), data...)
+}
+
+// serverNameData returns the server_name extension data for name.
+func serverNameData(name string) []byte {
+	entry := append([]byte{0}, binary.BigEndian.AppendUint16(nil, uint16(len(name)))...)
+	entry = append(entry, name...)
+	return append(binary.BigEndian.AppendUint16(nil, uint16(len(entry))), entry...)
+}
+
+// alpnData returns the ALPN extension data for protos.
+func alpnData(protos ...string) []byte {
+	var list []byte
+	for _, proto := range protos {
+		list = append(list, byte(len(proto)))
+		list = append(list, proto...)
+	}
+	return append(binary.BigEndian.AppendUint16(nil, uint16(len(list))), list...)
+}
+
+func TestReadClientHello(t *testing.T) {
+	raw := clientHello(t, &tls.Config{
+		ServerName: "app.com",
+		NextProtos: []string{"h2", "http/1.1"},
+	})
+
+	msg, err := readClientHello(bytes.NewReader(raw))
+	require.NoError(t, err)
+
+	require.Equal(t, "app.com", msg.ServerName)
+	require.Equal(t, []string{"h2", "http/1.1"}, msg.ALPNProtocols)
+	require.Contains(t, msg.SupportedVersions, uint16(tls.VersionTLS13))
+	require.Equal(t, uint16(tls.VersionTLS13), msg.MaxVersion())
+	require.NotEmpty(t, msg.SignatureAlgorithms)
+	require.NotEmpty(t, msg.KeyShares)
+	require.NotEmpty(t, msg.CipherSuites)
+
+	types := make([]uint16, len(msg.Extensions))
+	for i, ext := range msg.Extensions {
+		types[i] = ext.Type
+	}
+	require.Contains(t, types, extensionServerName)
+	require.Contains(t, types, extensionKeyShare)
+
+	msg, err = readClientHello(bytes.NewReader(clientHello(t, &tls.Config{
+		ServerName: "app.com",
+		MaxVersion: tls.VersionTLS12,
+	})))
+	require.NoError(t, err)
+	require.Equal(t, uint16(tls.VersionTLS12), msg.MaxVersion())
+	require.Empty(t, msg.KeyShares)
+}
+
+func TestIsGREASE(t *testing.T) {
+	require.True(t, isGREASE(0x0a0a))
+	require.True(t, isGREASE(0xfafa))
+	require.False(t, isGREASE(0x0a1a))
+	require.False(t, isGREASE(tls.VersionTLS13))
+}
+
+func FuzzReadClientHello(f *testing.F) {
+	f.Add(clientHello(f, &tls.Config{ServerName: "app.com", NextProtos: []string{"h2"}}))
+	f.Add(clientHello(f, &tls.Config{ServerName: "app.com", MaxVersion: tls.VersionTLS12}))
+	f.Add([]byte{0x16, 0x03, 0x01, 0x00, 0x00})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		msg, err := readClientHello(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+
+		msg.MaxVersion()
+		for _, ext := range msg.Extensions {
+			if !bytes.Contains(msg.Raw, ext.Data) {
+				t.Fatalf("extension %d data is not part of the message", ext.Type)
+			}
+		}
+	})
+}
+
+func TestFingerprint(t *testing.T) {
+	msg, err := readClientHello(bytes.NewReader(clientHello(t, &tls.Config{
+		ServerName: "app.com",
+		NextProtos: []string{"h2", "http/1.1"},
+	})))
+	require.NoError(t, err)
+
+	fp := msg.Fingerprint()
+	require.Len(t, fp.JA3, 32)
+	require.Regexp(t, `^t13d\d{4}h2_[0-9a-f]{12}_[0-9a-f]{12}$`, fp.JA4)
+	require.Len(t, strings.Split(msg.JA3(), ","), 5)
+
+	msg, err = readClientHello(bytes.NewReader(clientHello(t, &tls.Config{
+		MaxVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: true,
+	})))
+	require.NoError(t, err)
+	require.Regexp(t, `^t12i\d{4}00_`, msg.JA4())
+}
+
+// TestFingerprintKnownAnswers tests the fingerprints of the examples of the JA3 and JA4 specifications.
+func TestFingerprintKnownAnswers(t *testing.T) {
+	// https://github.com/salesforce/ja3, with GREASE values added.
+	msg, err := readClientHello(bytes.NewReader(rawClientHello(tls.VersionTLS10,
+		[]uint16{0x0a0a, 47, 53, 5, 10, 49161, 49162, 49171, 49172, 50, 56, 19, 4},
+		[]Extension{
+			{Type: 0x1a1a},
+			{Type: extensionServerName, Data: serverNameData("app.com")},
+			{Type: extensionSupportedCurves, Data: uint16List(2, 0x2a2a, 23, 24, 25)},
+			{Type: extensionSupportedPoints, Data: []byte{1, 0}},
+		},
+	)))
+	require.NoError(t, err)
+	require.Equal(t, "769,47-53-5-10-49161-49162-49171-49172-50-56-19-4,0-10-11,23-24-25,0", msg.JA3())
+	require.Equal(t, "ada70206e40642a3e4461f35503241d5", msg.Fingerprint().JA3)
+
+	// https://github.com/FoxIO-LLC/ja4/blob/main/technical_details/JA4.md, with GREASE values
+	// and a draft version added.
+	chrome := []Extension{
+		{Type: 0x3a3a},
+		{Type: 0x001b, Data: []byte{2, 0, 2}},
+		{Type: extensionSignatureAlgorithms, Data: uint16List(2, 0x0403, 0x0804, 0x0401, 0x0503, 0x0805, 0x0501, 0x0806, 0x0601)},
+		{Type: extensionServerName, Data: serverNameData("app.com")},
+		{Type: extensionSupportedVersions, Data: uint16List(1, 0x4a4a, 0x7f1c, tls.VersionTLS13, tls.VersionTLS12)},
+		{Type: extensionALPN, Data: alpnData("h2", "http/1.1")},
+		{Type: extensionSessionTicket},
+		{Type: extensionSupportedPoints, Data: []byte{1, 0}},
+		{Type: 0x0017},
+		{Type: 0x4469, Data: []byte{0, 3, 2, 'h', '2'}},
+		{Type: extensionPSKModes, Data: []byte{1, 1}},
+		{Type: extensionStatusRequest, Data: []byte{statusTypeOCSP, 0, 0, 0, 0}},
+		{Type: 0x0012},
+		{Type: extensionKeyShare, Data: append([]byte{0, 36, 0, 0x1d, 0, 32}, make([]byte, 32)...)},
+		{Type: 0xff01, Data: []byte{0}},
+		{Type: extensionSupportedCurves, Data: uint16List(2, 0x5a5a, 0x001d, 0x0017, 0x0018)},
+		{Type: 0x0015, Data: make([]byte, 8)},
+	}
+	ciphers := []uint16{0x6a6a, 0x1301, 0x1302, 0x1303, 0xc02b, 0xc02f, 0xc02c, 0xc030, 0xcca9, 0xcca8, 0xc013, 0xc014, 0x009c, 0x009d, 0x002f, 0x0035}
+
+	msg, err = readClientHello(bytes.NewReader(rawClientHello(tls.VersionTLS12, ciphers, chrome)))
+	require.NoError(t, err)
+	require.Equal(t, uint16(tls.VersionTLS13), msg.MaxVersion())
+	require.Equal(t, "t13d1516h2_8daaf6152771_e5627efa2ab1", msg.JA4())
+
+	// An ALPN value starting or ending with other than a letter or digit is fingerprinted in hex.
+	chrome[5].Data = alpnData("\xab\x01\xcd")
+	msg, err = readClientHello(bytes.NewReader(rawClientHello(tls.VersionTLS12, ciphers, chrome)))
+	require.NoError(t, err)
+	require.Equal(t, "t13d1516ad_8daaf6152771_e5627efa2ab1", msg.JA4())
+}
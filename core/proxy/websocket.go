@@ -0,0 +1,421 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Dyastin-0/tcprp/core/config"
+	"github.com/Dyastin-0/tcprp/core/metrics"
+)
+
+// WebSocket opcodes and close codes, from RFC 6455.
+const (
+	wsOpContinuation = 0x0
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xa
+
+	wsCloseGoingAway     = 1001
+	wsCloseProtocolError = 1002
+	wsCloseMessageTooBig = 1009
+)
+
+// wsCloseTimeout bounds waiting for the close frames of the peers once a close is started.
+const wsCloseTimeout = 5 * time.Second
+
+// wsPingPayload tags the pings sent by the proxy, whose pongs are not relayed.
+var wsPingPayload = []byte("tcprp")
+
+// wsCloseError is a violation closing a socket with code.
+type wsCloseError struct {
+	code   uint16
+	reason string
+}
+
+func (e *wsCloseError) Error() string {
+	return fmt.Sprintf("websocket closed with %d: %s", e.code, e.reason)
+}
+
+// wsFrameHeader is the header of a WebSocket frame.
+type wsFrameHeader struct {
+	fin     bool
+	opcode  byte
+	masked  bool
+	maskKey [4]byte
+	length  int64
+	// raw is the header as read, relayed unchanged.
+	raw []byte
+}
+
+// readFrameHeader reads the header of the next frame from r.
+func readFrameHeader(r *bufio.Reader) (*wsFrameHeader, error) {
+	raw := make([]byte, 2, 14)
+	if _, err := io.ReadFull(r, raw); err != nil {
+		return nil, err
+	}
+
+	h := &wsFrameHeader{
+		fin:    raw[0]&0x80 != 0,
+		opcode: raw[0] & 0x0f,
+		masked: raw[1]&0x80 != 0,
+		length: int64(raw[1] & 0x7f),
+	}
+
+	extended := 0
+	switch h.length {
+	case 126:
+		extended = 2
+	case 127:
+		extended = 8
+	}
+	if h.masked {
+		extended += 4
+	}
+	raw = raw[:2+extended]
+	if _, err := io.ReadFull(r, raw[2:]); err != nil {
+		return nil, err
+	}
+
+	rest := raw[2:]
+	switch h.length {
+	case 126:
+		h.length = int64(binary.BigEndian.Uint16(rest))
+		rest = rest[2:]
+	case 127:
+		length := binary.BigEndian.Uint64(rest)
+		if length>>63 != 0 {
+			return nil, &wsCloseError{code: wsCloseProtocolError, reason: "invalid frame length"}
+		}
+		h.length = int64(length)
+		rest = rest[8:]
+	}
+	if h.masked {
+		copy(h.maskKey[:], rest)
+	}
+	h.raw = raw
+
+	switch {
+	case h.opcode > wsOpBinary && h.opcode < wsOpClose, h.opcode > wsOpPong:
+		return nil, &wsCloseError{code: wsCloseProtocolError, reason: "unknown opcode"}
+	case h.opcode >= wsOpClose && (!h.fin || h.length > 125):
+		return nil, &wsCloseError{code: wsCloseProtocolError, reason: "invalid control frame"}
+	}
+	return h, nil
+}
+
+// unmask returns payload unmasked with the mask key of h, if it is masked.
+func (h *wsFrameHeader) unmask(payload []byte) []byte {
+	if !h.masked {
+		return payload
+	}
+	unmasked := make([]byte, len(payload))
+	for i, b := range payload {
+		unmasked[i] = b ^ h.maskKey[i%4]
+	}
+	return unmasked
+}
+
+// wsPeer is one end of a WebSocket connection relayed by the proxy.
+type wsPeer struct {
+	rwc io.ReadWriteCloser
+	r   *bufio.Reader
+	// mask is set for the backend, to which frames are sent masked as by a client.
+	mask bool
+	idle *time.Timer
+	// idleTimeout is reset by every frame read from the peer or relayed to it.
+	idleTimeout time.Duration
+
+	mu        sync.Mutex
+	closeSent bool
+}
+
+// touch resets the idle timer of p.
+func (p *wsPeer) touch() {
+	if p.idle != nil {
+		p.idle.Reset(p.idleTimeout)
+	}
+}
+
+// relay writes the frame of h and its payload read from r to p,
+// or discards the payload if a close was already sent to p.
+func (p *wsPeer) relay(h *wsFrameHeader, r io.Reader) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closeSent {
+		_, err := io.CopyN(io.Discard, r, h.length)
+		return err
+	}
+	if h.opcode == wsOpClose {
+		p.closeSent = true
+	}
+
+	if _, err := p.rwc.Write(h.raw); err != nil {
+		return err
+	}
+	_, err := io.CopyN(p.rwc, r, h.length)
+	return err
+}
+
+// writeFrame writes a control frame to p, unless a close was already sent to p.
+// It gives up without an error if wait is not set and p is busy.
+func (p *wsPeer) writeFrame(opcode byte, payload []byte, wait bool) error {
+	if wait {
+		p.mu.Lock()
+	} else if !p.mu.TryLock() {
+		return nil
+	}
+	defer p.mu.Unlock()
+
+	if p.closeSent {
+		return nil
+	}
+	if opcode == wsOpClose {
+		p.closeSent = true
+	}
+
+	frame := []byte{0x80 | opcode, byte(len(payload))}
+	if p.mask {
+		var key [4]byte
+		rand.Read(key[:])
+		frame[1] |= 0x80
+		frame = append(frame, key[:]...)
+		for i, b := range payload {
+			frame = append(frame, b^key[i%4])
+		}
+	} else {
+		frame = append(frame, payload...)
+	}
+
+	_, err := p.rwc.Write(frame)
+	return err
+}
+
+// wsSession relays the frames of an upgraded connection between a client and a backend.
+type wsSession struct {
+	conf    *config.WebSocket
+	client  *wsPeer
+	backend *wsPeer
+	metrics *metrics.Metrics
+
+	closeOnce sync.Once
+}
+
+// websocket relays the frames of an upgraded connection between client and backend until
+// either closes it, closing it itself when a peer is idle, sends a message larger than
+// allowed, or the proxy shuts down.
+func (p *Proxy) websocket(conf *config.WebSocket, client, backend io.ReadWriteCloser, m *metrics.Metrics) error {
+	done, tracked := p.trackWebSocket()
+	if tracked {
+		defer p.websockets.Done()
+	}
+
+	ws := &wsSession{
+		conf:    conf,
+		client:  &wsPeer{rwc: client, r: bufio.NewReader(client), idleTimeout: conf.IdleTimeout},
+		backend: &wsPeer{rwc: backend, r: bufio.NewReader(backend), idleTimeout: conf.IdleTimeout, mask: true},
+		metrics: m,
+	}
+	defer ws.closeConns()
+
+	idle := make(chan struct{}, 1)
+	if conf.IdleTimeout > 0 {
+		for _, peer := range []*wsPeer{ws.client, ws.backend} {
+			peer.idle = time.AfterFunc(conf.IdleTimeout, func() {
+				select {
+				case idle <- struct{}{}:
+				default:
+				}
+			})
+			defer peer.idle.Stop()
+		}
+	}
+
+	var ping <-chan time.Time
+	if conf.PingInterval > 0 {
+		ticker := time.NewTicker(conf.PingInterval)
+		defer ticker.Stop()
+		ping = ticker.C
+	}
+
+	errc := make(chan error, 2)
+	go func() { errc <- ws.relay(ws.client, ws.backend, ws.countIngress) }()
+	go func() { errc <- ws.relay(ws.backend, ws.client, ws.countEgress) }()
+
+	var closing <-chan time.Time
+	startClose := func(code uint16) {
+		if closing == nil {
+			closing = time.After(wsCloseTimeout)
+		}
+		go ws.close(code)
+	}
+
+	var err error
+	for finished := 0; finished < 2; {
+		select {
+		case relayErr := <-errc:
+			finished++
+
+			var closeErr *wsCloseError
+			switch {
+			case relayErr == nil:
+				// A close was relayed, the other peer is expected to answer it.
+				if closing == nil {
+					closing = time.After(wsCloseTimeout)
+				}
+			case errors.As(relayErr, &closeErr):
+				startClose(closeErr.code)
+				err = relayErr
+			default:
+				ws.closeConns()
+				if closing == nil && relayErr != io.EOF && relayErr != io.ErrUnexpectedEOF && !errors.Is(relayErr, net.ErrClosed) {
+					err = relayErr
+				}
+			}
+
+		case <-ping:
+			ws.client.writeFrame(wsOpPing, wsPingPayload, false)
+			ws.backend.writeFrame(wsOpPing, wsPingPayload, false)
+
+		case <-idle:
+			startClose(wsCloseGoingAway)
+
+		case <-done:
+			done = nil
+			startClose(wsCloseGoingAway)
+
+		case <-closing:
+			ws.closeConns()
+		}
+	}
+	return err
+}
+
+// relay relays the frames of src to dst until src sends a close frame, counting its messages.
+func (ws *wsSession) relay(src, dst *wsPeer, count func()) error {
+	var size int64
+	for {
+		h, err := readFrameHeader(src.r)
+		if err != nil {
+			return err
+		}
+		src.touch()
+
+		if h.opcode >= wsOpClose {
+			payload := make([]byte, h.length)
+			if _, err := io.ReadFull(src.r, payload); err != nil {
+				return err
+			}
+			if h.opcode == wsOpPong && bytes.Equal(h.unmask(payload), wsPingPayload) {
+				continue
+			}
+			dst.touch()
+			if err := dst.relay(h, bytes.NewReader(payload)); err != nil {
+				return err
+			}
+			if h.opcode == wsOpClose {
+				return nil
+			}
+			continue
+		}
+
+		if h.opcode != wsOpContinuation {
+			size = 0
+		}
+		size += h.length
+		if ws.conf.MaxMessageSize > 0 && size > ws.conf.MaxMessageSize {
+			return &wsCloseError{code: wsCloseMessageTooBig, reason: "message too big"}
+		}
+
+		// A socket where only one peer sends is active, so dst is not idle either.
+		dst.touch()
+		if err := dst.relay(h, src.r); err != nil {
+			return err
+		}
+		if h.fin {
+			count()
+		}
+	}
+}
+
+// close sends a close frame with code to both peers, unless one was already sent.
+func (ws *wsSession) close(code uint16) {
+	payload := binary.BigEndian.AppendUint16(nil, code)
+	ws.client.writeFrame(wsOpClose, payload, true)
+	ws.backend.writeFrame(wsOpClose, payload, true)
+}
+
+// closeConns closes the connections to both peers.
+func (ws *wsSession) closeConns() {
+	ws.closeOnce.Do(func() {
+		ws.client.rwc.Close()
+		ws.backend.rwc.Close()
+	})
+}
+
+// countIngress counts a message from the client.
+func (ws *wsSession) countIngress() {
+	if ws.metrics != nil {
+		ws.metrics.IncrementWebSocketIngressMessages()
+	}
+}
+
+// countEgress counts a message to the client.
+func (ws *wsSession) countEgress() {
+	if ws.metrics != nil {
+		ws.metrics.IncrementWebSocketEgressMessages()
+	}
+}
+
+// trackWebSocket returns the channel closed when p shuts down, and reports whether
+// the WebSocket connection starting was added to those waited for by Shutdown.
+func (p *Proxy) trackWebSocket() (<-chan struct{}, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.done == nil {
+		p.done = make(chan struct{})
+	}
+	if p.shuttingDown {
+		return p.done, false
+	}
+	p.websockets.Add(1)
+	return p.done, true
+}
+
+// Shutdown closes the WebSocket connections relayed in WebSocket mode with a close handshake,
+// and waits for them to be closed, or for ctx to be done.
+func (p *Proxy) Shutdown(ctx context.Context) error {
+	p.mu.Lock()
+	if p.done == nil {
+		p.done = make(chan struct{})
+	}
+	if !p.shuttingDown {
+		p.shuttingDown = true
+		close(p.done)
+	}
+	p.mu.Unlock()
+
+	closed := make(chan struct{})
+	go func() {
+		p.websockets.Wait()
+		close(closed)
+	}()
+
+	select {
+	case <-closed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
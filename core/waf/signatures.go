@@ -0,0 +1,43 @@
+package waf
+
+import "regexp"
+
+// Names of the signature lists.
+const (
+	SignaturesSQLi = "sqli"
+	SignaturesXSS  = "xss"
+)
+
+// signatures are the signature lists by name, as rule IDs and patterns.
+var signatures = map[string][][2]string{
+	SignaturesSQLi: {
+		{"sqli-union", `(?i)\bunion\b(\s|/\*.*?\*/)+(all\s+)?select\b`},
+		{"sqli-tautology", `(?i)['"\d)]\s*\b(or|and)\b\s+['"]?(\w+)['"]?\s*(=|<>|!=|like)\s*['"]?\w+`},
+		{"sqli-comment", `(?i)['"]\s*(--|#|/\*)`},
+		{"sqli-stacked", `(?i);\s*(drop|delete|insert|update|alter|create|truncate|exec)\b`},
+		{"sqli-time", `(?i)\b(sleep|benchmark|pg_sleep)\s*\(|\bwaitfor\s+delay\b`},
+		{"sqli-schema", `(?i)\b(information_schema|pg_catalog|sqlite_master|sys\.objects)\b`},
+	},
+	SignaturesXSS: {
+		{"xss-script", `(?i)<\s*script\b`},
+		{"xss-handler", `(?i)<[^>]*\bon[a-z]+\s*=`},
+		{"xss-uri", `(?i)\b(javascript|vbscript)\s*:|data\s*:\s*text/html`},
+		{"xss-tag", `(?i)<\s*(iframe|object|embed|svg|math|base|form)\b`},
+		{"xss-call", `(?i)\b(alert|prompt|confirm|eval)\s*\(|document\.(cookie|domain|write)`},
+	},
+}
+
+// Signatures returns the rules of the signature list name, and whether it exists.
+// The rules match the values inspected by rules without a header.
+func Signatures(name string) ([]*Rule, bool) {
+	list, ok := signatures[name]
+	if !ok {
+		return nil, false
+	}
+
+	rules := make([]*Rule, len(list))
+	for i, sig := range list {
+		rules[i] = &Rule{ID: sig[0], Pattern: regexp.MustCompile(sig[1])}
+	}
+	return rules, true
+}
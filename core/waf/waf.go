@@ -0,0 +1,135 @@
+// Package waf inspects requests before they are sent to a backend.
+package waf
+
+import (
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// MethodRuleID is the ID of the rule matched by requests with a method outside the allowlist.
+const MethodRuleID = "method-not-allowed"
+
+// signatureHeaders are the request headers inspected by rules without a header.
+var signatureHeaders = []string{"Cookie", "Referer", "User-Agent"}
+
+// Inspector inspects requests after route matching and before they are sent to a backend.
+// Implementations that read the body must replace it with one returning the same bytes.
+type Inspector interface {
+	Inspect(req *http.Request) Verdict
+}
+
+// Verdict is the outcome of inspecting a request.
+type Verdict struct {
+	// Status is the status of the response blocking the request, or 0 if it is allowed.
+	Status int
+	// Matches are the IDs of the rules the request matched, including the log-only ones.
+	Matches []string
+}
+
+// Rule matches requests by path and header.
+// A rule with a Pattern but no Header matches the path, the query keys and values,
+// and the Cookie, Referer and User-Agent headers of requests.
+type Rule struct {
+	ID string
+	// Path matches the unescaped path of requests.
+	Path *regexp.Regexp
+	// Header names the header whose values Pattern matches.
+	Header  string
+	Pattern *regexp.Regexp
+	// LogOnly reports matches without blocking the request.
+	LogOnly bool
+}
+
+// matches reports whether req matches r, given the values inspected by rules without a header.
+func (r *Rule) matches(req *http.Request, values func() []string) bool {
+	if r.Path != nil && !r.Path.MatchString(req.URL.Path) {
+		return false
+	}
+	if r.Pattern == nil {
+		return true
+	}
+	if r.Header != "" {
+		return slices.ContainsFunc(req.Header.Values(r.Header), r.Pattern.MatchString)
+	}
+	return slices.ContainsFunc(values(), r.Pattern.MatchString)
+}
+
+// Engine is an Inspector matching requests against rules and a method allowlist.
+type Engine struct {
+	rules   []*Rule
+	methods []string
+	logOnly bool
+}
+
+// NewEngine returns a new Engine blocking requests matching rules that are not LogOnly,
+// or with a method outside methods if there are any and logOnly is not set.
+func NewEngine(rules []*Rule, methods []string, logOnly bool) *Engine {
+	return &Engine{rules: rules, methods: methods, logOnly: logOnly}
+}
+
+// Inspect matches req against the rules of e.
+func (e *Engine) Inspect(req *http.Request) Verdict {
+	var v Verdict
+	block := func(logOnly bool) {
+		if !logOnly {
+			v.Status = http.StatusForbidden
+		}
+	}
+
+	if len(e.methods) > 0 && !slices.Contains(e.methods, req.Method) {
+		v.Matches = append(v.Matches, MethodRuleID)
+		block(e.logOnly)
+	}
+
+	var values []string
+	inspected := func() []string {
+		if values == nil {
+			values = inspectedValues(req)
+		}
+		return values
+	}
+
+	for _, rule := range e.rules {
+		if rule.matches(req, inspected) {
+			v.Matches = append(v.Matches, rule.ID)
+			block(rule.LogOnly)
+		}
+	}
+	return v
+}
+
+// inspectedValues returns the values of req matched by rules without a header.
+func inspectedValues(req *http.Request) []string {
+	values := []string{req.URL.Path}
+
+	query, err := url.ParseQuery(req.URL.RawQuery)
+	if err != nil {
+		// A malformed query is still inspected, unescaped as far as possible.
+		raw, unescapeErr := url.QueryUnescape(req.URL.RawQuery)
+		if unescapeErr != nil {
+			raw = req.URL.RawQuery
+		}
+		values = append(values, raw)
+	}
+	for key, vs := range query {
+		values = append(values, key)
+		values = append(values, vs...)
+	}
+
+	for _, name := range signatureHeaders {
+		values = append(values, req.Header.Values(name)...)
+	}
+
+	// Values escaped twice are inspected unescaped as well.
+	for _, value := range values {
+		if strings.Contains(value, "%") {
+			if unescaped, err := url.QueryUnescape(value); err == nil && unescaped != value {
+				values = append(values, unescaped)
+			}
+		}
+	}
+	return values
+}
@@ -0,0 +1,102 @@
+package waf
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEngine(t *testing.T) {
+	sqli, ok := Signatures(SignaturesSQLi)
+	require.True(t, ok)
+	xss, ok := Signatures(SignaturesXSS)
+	require.True(t, ok)
+	_, ok = Signatures("rce")
+	require.False(t, ok)
+
+	rules := append(sqli, xss...)
+	rules = append(rules,
+		&Rule{ID: "admin", Path: regexp.MustCompile(`^/admin`)},
+		&Rule{ID: "scanner", Header: "User-Agent", Pattern: regexp.MustCompile(`(?i)sqlmap|nikto`)},
+		&Rule{ID: "debug", Path: regexp.MustCompile(`^/api/`), Header: "X-Debug", Pattern: regexp.MustCompile(`.`), LogOnly: true},
+	)
+	engine := NewEngine(rules, []string{http.MethodGet, http.MethodPost}, false)
+
+	inspect := func(method, target string, header ...string) Verdict {
+		req := httptest.NewRequest(method, target, nil)
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		return engine.Inspect(req)
+	}
+
+	for _, target := range []string{
+		"/",
+		"/search?q=rock+and+roll",
+		"/search?q=tom%27s+shop&page=2",
+		"/articles/union-station",
+		"/products?sort=price&order=desc",
+		"/docs/select-a-plan",
+	} {
+		v := inspect(http.MethodGet, target)
+		require.Zero(t, v.Status, target)
+		require.Empty(t, v.Matches, target)
+	}
+
+	for target, id := range map[string]string{
+		"/items?id=1+UNION+SELECT+password+FROM+users": "sqli-union",
+		"/items?id=1%20or%201%3D1":                     "sqli-tautology",
+		"/login?user=admin%27--":                       "sqli-comment",
+		"/items?id=1;DROP%20TABLE%20users":             "sqli-stacked",
+		"/items?id=1+AND+SLEEP(5)":                     "sqli-time",
+		"/items?id=information_schema.tables":          "sqli-schema",
+		"/search?q=%3Cscript%3Ealert(1)%3C/script%3E":  "xss-script",
+		"/search?q=%3Cimg+src=x+onerror=x%3E":          "xss-handler",
+		"/redirect?to=javascript:x":                    "xss-uri",
+		"/search?q=%3Ciframe+src=x%3E":                 "xss-tag",
+		"/search?q=document.cookie":                    "xss-call",
+		"/search?q=%253Cscript%253E":                   "xss-script",
+		"/admin/users":                                 "admin",
+	} {
+		v := inspect(http.MethodGet, target)
+		require.Equal(t, http.StatusForbidden, v.Status, target)
+		require.Contains(t, v.Matches, id, target)
+	}
+
+	v := inspect(http.MethodGet, "/", "Cookie", "session=' OR '1'='1")
+	require.Equal(t, http.StatusForbidden, v.Status)
+	require.Contains(t, v.Matches, "sqli-tautology")
+
+	v = inspect(http.MethodGet, "/", "User-Agent", "sqlmap/1.7")
+	require.Equal(t, http.StatusForbidden, v.Status)
+	require.Equal(t, []string{"scanner"}, v.Matches)
+
+	v = inspect(http.MethodDelete, "/")
+	require.Equal(t, http.StatusForbidden, v.Status)
+	require.Equal(t, []string{MethodRuleID}, v.Matches)
+
+	v = inspect(http.MethodGet, "/api/users", "X-Debug", "1")
+	require.Zero(t, v.Status)
+	require.Equal(t, []string{"debug"}, v.Matches)
+
+	v = inspect(http.MethodGet, "/", "X-Debug", "1")
+	require.Empty(t, v.Matches)
+
+	for _, rule := range xss {
+		rule.LogOnly = true
+	}
+	admin := &Rule{ID: "admin", Path: regexp.MustCompile(`^/admin`), LogOnly: true}
+	logOnly := NewEngine(append(xss, admin), []string{http.MethodGet}, true)
+	v = logOnly.Inspect(httptest.NewRequest(http.MethodPut, "/admin?q=%3Cscript%3E", nil))
+	require.Zero(t, v.Status)
+	require.Equal(t, []string{MethodRuleID, "xss-script", "admin"}, v.Matches)
+
+	// Rules in block mode block under an engine in log mode.
+	admin.LogOnly = false
+	v = logOnly.Inspect(httptest.NewRequest(http.MethodPut, "/admin", nil))
+	require.Equal(t, http.StatusForbidden, v.Status)
+	require.Equal(t, []string{MethodRuleID, "admin"}, v.Matches)
+}
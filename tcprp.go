@@ -5,6 +5,8 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 
 	_ "net/http/pprof"
 
@@ -16,9 +18,12 @@ func main() {
 		log.Println(http.ListenAndServe("localhost:6060", nil))
 	}()
 
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	command := cmd.New()
 
-	if err := command.Run(context.Background(), os.Args); err != nil {
+	if err := command.Run(ctx, os.Args); err != nil {
 		panic(err)
 	}
 }